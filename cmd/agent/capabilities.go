@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/calc"
+)
+
+// fullOperation computes a whole expression at once; compute supports it
+// besides the operations of the calc package.
+const fullOperation = "FULL"
+
+// errUnsupported marks tasks this agent cannot compute. They are reported as
+// transient so that the orchestrator retries them, possibly on another agent.
+var errUnsupported = errors.New("not supported")
+
+var (
+	// operations are the operations this agent computes and advertises;
+	// the orchestrator only hands out tasks with one of them.
+	operations []string
+	// tags describe the agent, e.g. "gpu-free" or "high-precision".
+	// Expressions may require tags from the agents computing them.
+	tags []string
+)
+
+// loadCapabilities reads AGENT_OPERATIONS, a subset of the supported
+// operations (all of them by default), and AGENT_TAGS.
+func loadCapabilities() error {
+	supported := append(calc.Operations(), fullOperation)
+	operations = supported
+	if list := splitList(os.Getenv("AGENT_OPERATIONS")); len(list) > 0 {
+		for _, op := range list {
+			if !slices.Contains(supported, op) {
+				return fmt.Errorf("AGENT_OPERATIONS: unsupported operation %q", op)
+			}
+		}
+		operations = list
+	}
+	tags = splitList(os.Getenv("AGENT_TAGS"))
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
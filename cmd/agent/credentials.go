@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// dialOptions configures the connection to the orchestrator from
+// GRPC_TLS_CA (enables TLS), GRPC_TLS_CERT/GRPC_TLS_KEY (client certificate
+// for mutual TLS), GRPC_TLS_SERVER_NAME and AGENT_TOKEN.
+func dialOptions() ([]grpc.DialOption, error) {
+	caFile := os.Getenv("GRPC_TLS_CA")
+	certFile := os.Getenv("GRPC_TLS_CERT")
+	keyFile := os.Getenv("GRPC_TLS_KEY")
+	useTLS := caFile != "" || certFile != ""
+
+	var opts []grpc.DialOption
+	if useTLS {
+		tlsConfig := &tls.Config{
+			ServerName: os.Getenv("GRPC_TLS_SERVER_NAME"),
+			MinVersion: tls.VersionTLS12,
+		}
+		if caFile != "" {
+			pool, err := loadCertPool(caFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if token := os.Getenv("AGENT_TOKEN"); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(agentToken{
+			token:   token,
+			agentID: agentID,
+			secure:  useTLS,
+		}))
+	}
+	return opts, nil
+}
+
+// agentToken attaches the agent token and ID to every call.
+type agentToken struct {
+	token   string
+	agentID string
+	secure  bool
+}
+
+func (t agentToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + t.token,
+		"agent-id":      t.agentID,
+	}, nil
+}
+
+func (t agentToken) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
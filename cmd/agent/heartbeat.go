@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	protocalc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+)
+
+// version is reported to the orchestrator on registration; set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// runHeartbeats registers the agent and keeps sending heartbeats, registering
+// again whenever the orchestrator no longer knows the agent.
+func runHeartbeats(client protocalc.CalcServiceClient) {
+	for {
+		interval, err := register(client)
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("[AGENT] server does not support agent registration")
+			return
+		}
+		if err != nil {
+			log.Printf("[AGENT] RegisterAgent error: %v", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		for {
+			time.Sleep(interval)
+			resp, err := client.Heartbeat(context.Background(), &protocalc.HeartbeatRequest{AgentId: agentID})
+			if err != nil {
+				log.Printf("[AGENT] Heartbeat error: %v", err)
+				continue
+			}
+			if resp.Status != "OK" {
+				log.Printf("[AGENT] Heartbeat status=%s, registering again", resp.Status)
+				break
+			}
+		}
+	}
+}
+
+func register(client protocalc.CalcServiceClient) (time.Duration, error) {
+	host, _ := os.Hostname()
+	resp, err := client.RegisterAgent(context.Background(), &protocalc.RegisterAgentRequest{
+		AgentId:        agentID,
+		Hostname:       host,
+		Version:        version,
+		ComputingPower: int32(computingPower),
+		Operations:     operations,
+		Tags:           tags,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	interval := time.Duration(resp.HeartbeatIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	log.Printf("[AGENT] registered as %s, heartbeat every %v", agentID, interval)
+	return interval, nil
+}
@@ -2,21 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/calc"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 	protocalc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
 )
 
 var (
 	grpcAddr       = "localhost:50051"
 	computingPower = 1
+	agentID        string
 )
 
 func main() {
@@ -36,13 +43,27 @@ func main() {
 		grpcAddr = addrFromEnv
 	}
 
-	log.Printf("[AGENT] Starting with %d workers. gRPC server = %s\n",
-		computingPower, grpcAddr)
+	agentID = os.Getenv("AGENT_ID")
+	if agentID == "" {
+		host, _ := os.Hostname()
+		agentID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	if err := loadCapabilities(); err != nil {
+		log.Fatalf("invalid agent capabilities: %v", err)
+	}
 
-	conn, err := grpc.NewClient(
-		"dns:///"+grpcAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	log.Printf("[AGENT] %s starting with %d workers. gRPC server = %s\n",
+		agentID, computingPower, grpcAddr)
+	if len(tags) > 0 {
+		log.Printf("[AGENT] tags: %s", strings.Join(tags, ", "))
+	}
+
+	opts, err := dialOptions()
+	if err != nil {
+		log.Fatalf("invalid gRPC security settings: %v", err)
+	}
+	conn, err := grpc.NewClient("dns:///"+grpcAddr, opts...)
 	if err != nil {
 		log.Fatalf("failed to create new gRPC client: %v", err)
 	}
@@ -50,6 +71,18 @@ func main() {
 
 	client := protocalc.NewCalcServiceClient(conn)
 
+	go runHeartbeats(client)
+
+	for {
+		err := runStream(client)
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("[AGENT] server does not support WorkStream, polling with %d workers", computingPower)
+			break
+		}
+		log.Printf("[AGENT] work stream closed: %v; reconnecting", err)
+		time.Sleep(2 * time.Second)
+	}
+
 	for i := 0; i < computingPower; i++ {
 		go worker(i, client)
 	}
@@ -63,7 +96,11 @@ func worker(workerID int, client protocalc.CalcServiceClient) {
 	for {
 		time.Sleep(2 * time.Second)
 
-		gtResp, err := client.GetTask(context.Background(), &protocalc.GetTaskRequest{})
+		gtResp, err := client.GetTask(context.Background(), &protocalc.GetTaskRequest{
+			AgentId:    agentID,
+			Operations: operations,
+			Tags:       tags,
+		})
 		if err != nil {
 			log.Printf("[Worker #%d] GetTask error: %v", workerID, err)
 			continue
@@ -87,17 +124,53 @@ func worker(workerID int, client protocalc.CalcServiceClient) {
 			task.OperationTime,
 		)
 
-		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+		if tooLate(task) {
+			err := errTooLate(task)
+			log.Printf("[Worker #%d] task ID=%d %v", workerID, task.Id, err)
+			reportError(workerID, client, task.Id, err)
+			continue
+		}
+
+		ctx, stopRenewal := context.WithCancel(context.Background())
+		dropped := make(chan struct{})
+		go keepLease(ctx, task.LeaseMs, func(ctx context.Context) (bool, int32) {
+			resp, err := client.RenewLease(ctx, &protocalc.RenewLeaseRequest{Id: task.Id, AgentId: agentID})
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[Worker #%d] RenewLease error: %v", workerID, err)
+				}
+				return true, 0
+			}
+			if resp.Status != "OK" {
+				log.Printf("[Worker #%d] lease on task ID=%d lost: %s", workerID, task.Id, resp.Status)
+				if isDropStatus(resp.Status) {
+					close(dropped)
+				}
+				return false, 0
+			}
+			return true, resp.LeaseMs
+		})
 
-		resultValue, err := compute(task.Arg1, task.Arg2, task.Operation)
+		select {
+		case <-dropped:
+			stopRenewal()
+			log.Printf("[Worker #%d] dropped task ID=%d", workerID, task.Id)
+			continue
+		case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
+		}
+
+		resultValue, err := compute(task)
+		stopRenewal()
 		if err != nil {
 			log.Printf("[Worker #%d] compute error: %v", workerID, err)
+			reportError(workerID, client, task.Id, err)
 			continue
 		}
 
 		prReq := &protocalc.PostResultRequest{
-			Id:     task.Id,
-			Result: resultValue,
+			Id:      task.Id,
+			Result:  resultValue,
+			AgentId: agentID,
 		}
 		prResp, err := client.PostResult(context.Background(), prReq)
 		if err != nil {
@@ -113,22 +186,84 @@ func worker(workerID int, client protocalc.CalcServiceClient) {
 	}
 }
 
-func compute(a, b float64, op string) (float64, error) {
-	switch op {
-	case "FULL":
-		return 42, nil
-	case "+":
-		return a + b, nil
-	case "-":
-		return a - b, nil
-	case "*":
-		return a * b, nil
-	case "/":
-		if b == 0 {
-			return 0, fmt.Errorf("division by zero")
+// tooLate reports whether the task cannot be computed before the deadline of
+// its expression, so there is no point in starting it.
+func tooLate(task *protocalc.TaskData) bool {
+	return task.DeadlineMs > 0 && task.DeadlineMs < int64(task.OperationTime)
+}
+
+// errDeadline is reported instead of the result of a task that is too late.
+// It is transient, so the orchestrator frees the lease at once and times the
+// expression out with its progress instead of waiting for the deadline.
+var errDeadline = errors.New("cannot finish before the deadline")
+
+func errTooLate(task *protocalc.TaskData) error {
+	return fmt.Errorf("%w (%d ms left, %s takes %d ms)",
+		errDeadline, task.DeadlineMs, task.Operation, task.OperationTime)
+}
+
+// isTransient reports whether err is not the fault of the task itself.
+func isTransient(err error) bool {
+	return errors.Is(err, errUnsupported) || errors.Is(err, errDeadline)
+}
+
+// isDropStatus reports whether the orchestrator no longer wants the task,
+// because its expression was cancelled or deleted.
+func isDropStatus(status string) bool {
+	return status == "CANCELLED" || status == "NOT_FOUND"
+}
+
+// keepLease calls renew at a third of the lease duration until ctx is done
+// or renew reports the lease lost, so long operations are not requeued while
+// still being computed. renew may return a new lease duration.
+func keepLease(ctx context.Context, leaseMs int32, renew func(ctx context.Context) (bool, int32)) {
+	if leaseMs <= 0 {
+		return
+	}
+	interval := time.Duration(leaseMs) * time.Millisecond / 3
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		ok, newLeaseMs := renew(ctx)
+		if !ok {
+			return
+		}
+		if newLeaseMs > 0 {
+			interval = time.Duration(newLeaseMs) * time.Millisecond / 3
 		}
-		return a / b, nil
+	}
+}
+
+func reportError(workerID int, client protocalc.CalcServiceClient, taskID int32, computeErr error) {
+	reResp, err := client.ReportError(context.Background(), &protocalc.ReportErrorRequest{
+		Id:        taskID,
+		Error:     computeErr.Error(),
+		AgentId:   agentID,
+		Transient: isTransient(computeErr),
+	})
+	if err != nil {
+		log.Printf("[Worker #%d] ReportError error: %v", workerID, err)
+		return
+	}
+	if reResp.Status != "OK" {
+		log.Printf("[Worker #%d] ReportError status=%s", workerID, reResp.Status)
+	}
+}
+
+func compute(task *protocalc.TaskData) (float64, error) {
+	switch {
+	case !slices.Contains(operations, task.Operation):
+		return 0, fmt.Errorf("operation %s is %w by agent %s", task.Operation, errUnsupported, agentID)
+	case task.Operation == fullOperation:
+		return 42, nil
+	case parser.IsFunction(task.Operation):
+		return calc.ApplyFunc(task.Operation, task.Args)
 	default:
-		return 0, fmt.Errorf("unknown operation: %s", op)
+		return calc.Apply(task.Operation, task.Arg1, task.Arg2)
 	}
 }
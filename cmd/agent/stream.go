@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	protocalc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+)
+
+// runStream receives tasks pushed by the orchestrator over WorkStream and
+// computes up to computingPower of them at once. It returns when the stream
+// breaks; tasks in flight are abandoned and requeued by the orchestrator.
+func runStream(client protocalc.CalcServiceClient) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.WorkStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sendMu sync.Mutex
+	send := func(msg *protocalc.AgentMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	hello := &protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Hello{Hello: &protocalc.AgentHello{
+		AgentId:    agentID,
+		Capacity:   int32(computingPower),
+		Operations: operations,
+		Tags:       tags,
+	}}}
+	if err := send(hello); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// running maps the tasks being computed to the functions dropping them.
+	var runningMu sync.Mutex
+	running := make(map[int32]context.CancelFunc)
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch p := msg.Payload.(type) {
+		case *protocalc.ServerMessage_Task:
+			taskCtx, drop := context.WithCancel(ctx)
+			runningMu.Lock()
+			running[p.Task.Id] = drop
+			runningMu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					runningMu.Lock()
+					delete(running, p.Task.Id)
+					runningMu.Unlock()
+					drop()
+				}()
+				runStreamTask(taskCtx, p.Task, send)
+			}()
+		case *protocalc.ServerMessage_Ack:
+			if p.Ack.Status == "OK" {
+				continue
+			}
+			log.Printf("[AGENT] task ID=%d: %s", p.Ack.Id, p.Ack.Status)
+			if isDropStatus(p.Ack.Status) {
+				runningMu.Lock()
+				if drop, ok := running[p.Ack.Id]; ok {
+					log.Printf("[AGENT] dropped task ID=%d", p.Ack.Id)
+					drop()
+				}
+				runningMu.Unlock()
+			}
+		}
+	}
+}
+
+func runStreamTask(ctx context.Context, task *protocalc.TaskData, send func(*protocalc.AgentMessage) error) {
+	log.Printf("[AGENT] got task ID=%d, op=%s, arg1=%.2f, arg2=%.2f, opTime=%d",
+		task.Id, task.Operation, task.Arg1, task.Arg2, task.OperationTime)
+
+	if tooLate(task) {
+		err := errTooLate(task)
+		log.Printf("[AGENT] task ID=%d %v", task.Id, err)
+		msg := &protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Error{Error: &protocalc.ReportErrorRequest{
+			Id:        task.Id,
+			Error:     err.Error(),
+			Transient: true,
+		}}}
+		if err := send(msg); err != nil {
+			log.Printf("[AGENT] cannot report task ID=%d: %v", task.Id, err)
+		}
+		return
+	}
+
+	leaseCtx, stopRenewal := context.WithCancel(ctx)
+	go keepLease(leaseCtx, task.LeaseMs, func(context.Context) (bool, int32) {
+		renew := &protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Renew{Renew: &protocalc.RenewLeaseRequest{
+			Id: task.Id,
+		}}}
+		return send(renew) == nil, 0
+	})
+
+	select {
+	case <-ctx.Done():
+		stopRenewal()
+		return
+	case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
+	}
+
+	resultValue, err := compute(task)
+	stopRenewal()
+
+	var msg *protocalc.AgentMessage
+	if err != nil {
+		log.Printf("[AGENT] compute error for task ID=%d: %v", task.Id, err)
+		msg = &protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Error{Error: &protocalc.ReportErrorRequest{
+			Id:        task.Id,
+			Error:     err.Error(),
+			Transient: isTransient(err),
+		}}}
+	} else {
+		msg = &protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Result{Result: &protocalc.PostResultRequest{
+			Id:     task.Id,
+			Result: resultValue,
+		}}}
+	}
+	if err := send(msg); err != nil {
+		log.Printf("[AGENT] cannot send result of task ID=%d: %v", task.Id, err)
+		return
+	}
+	log.Printf("[AGENT] done task ID=%d, result=%.2f", task.Id, resultValue)
+}
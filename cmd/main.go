@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/grpcserver"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/handler"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/scheduler"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/webhook"
 )
 
 func main() {
@@ -16,10 +23,40 @@ func main() {
 		log.Fatalf("cannot init DB: %v", err)
 	}
 
+	repository.Retry = repository.RetryPolicy{
+		MaxRetries: config.TaskMaxRetries(),
+		Backoff:    config.RetryBackoff(),
+		MaxBackoff: config.RetryBackoffMax(),
+	}
+	repository.WebhookRetry = repository.RetryPolicy{
+		MaxRetries: config.WebhookMaxRetries(),
+		Backoff:    config.WebhookBackoff(),
+		MaxBackoff: config.WebhookBackoffMax(),
+	}
+
+	for _, login := range config.AdminLogins() {
+		ok, err := repository.SetUserRole(login, model.RoleAdmin)
+		if err != nil {
+			log.Fatalf("cannot set role of %s: %v", login, err)
+		}
+		if ok {
+			log.Printf("[MAIN] %s has the admin role", login)
+		}
+	}
+
 	if err := handler.InitTemplates(); err != nil {
 		log.Fatalf("cannot init templates: %v", err)
 	}
 
+	go scheduler.StartLeaseReaper(context.Background(), config.ReaperInterval())
+	go scheduler.StartDeadlineReaper(context.Background(), config.ReaperInterval())
+	go scheduler.StartIdempotencyReaper(context.Background(), config.ReaperInterval())
+	go scheduler.StartAgentMonitor(context.Background(), agents.Default,
+		config.HeartbeatInterval(), config.AgentTimeout())
+	go scheduler.StartRoutingMonitor(context.Background(), agents.Default, config.HeartbeatInterval())
+	go scheduler.StartWebhookDispatcher(context.Background(),
+		webhook.NewClient(config.WebhookTimeout()), config.ReaperInterval())
+
 	go func() {
 		grpcAddr := os.Getenv("GRPC_ADDR")
 		if grpcAddr == "" {
@@ -31,17 +68,32 @@ func main() {
 	http.HandleFunc("/api/v1/register", handler.HandleRegister)
 	http.HandleFunc("/api/v1/login", handler.HandleLogin)
 
-	http.HandleFunc("/", handler.HandleFrontIndex)
-	http.HandleFunc("/front/add", handler.HandleFrontAdd)
-	http.HandleFunc("/expression/", handler.HandleFrontExpression)
+	http.Handle("/",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleFrontIndex)))
+	http.Handle("/front/add",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleFrontAdd)))
+	http.Handle("/expression/",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleFrontExpression)))
 
 	// 6) Защищённые эндпоинты — AuthMiddleware
 	http.Handle("/api/v1/calculate",
 		handler.AuthMiddleware(http.HandlerFunc(handler.HandleCreateExpression)))
+	http.Handle("/api/v1/calculate/batch",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleCreateBatch)))
+	http.Handle("/api/v1/batches/",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleGetBatch)))
 	http.Handle("/api/v1/expressions",
 		handler.AuthMiddleware(http.HandlerFunc(handler.HandleGetAllExpressions)))
 	http.Handle("/api/v1/expressions/",
-		handler.AuthMiddleware(http.HandlerFunc(handler.HandleGetExpressionByID)))
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleExpression)))
+	http.Handle("/api/v1/agents",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleGetAgents)))
+	http.Handle("/api/v1/webhook",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleWebhook)))
+	http.Handle("/api/v1/webhook/deliveries",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleWebhookDeliveries)))
+	http.Handle("/api/v1/admin/",
+		handler.AuthMiddleware(http.HandlerFunc(handler.HandleAdmin)))
 
 	fs := http.FileServer(http.Dir("./web/static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
@@ -2,19 +2,33 @@ package main_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/calc"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/grpcserver"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/handler"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/planner"
+	protocalc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
 
@@ -291,6 +305,35 @@ func TestIntegration_ComplexExpressions(t *testing.T) {
 			wantStatus: model.StatusDone,
 			wantResult: floatPtr(-5),
 		},
+		{
+			name:       "PowerRightAssoc",
+			expression: "2^3^2",
+			wantStatus: model.StatusDone,
+			wantResult: floatPtr(512),
+		},
+		{
+			name:       "NegatedPower",
+			expression: "-2^2",
+			wantStatus: model.StatusDone,
+			wantResult: floatPtr(-4),
+		},
+		{
+			name:       "Functions",
+			expression: "sqrt(16)+max(1,2,3)",
+			wantStatus: model.StatusDone,
+			wantResult: floatPtr(7),
+		},
+		{
+			name:       "DivisionByZero",
+			expression: "1/(2-2)+3",
+			wantStatus: model.StatusError,
+		},
+		{
+			name:       "ModuloIntDivision",
+			expression: "7%3+7//2",
+			wantStatus: model.StatusDone,
+			wantResult: floatPtr(4),
+		},
 	}
 
 	for _, tc := range tests {
@@ -336,21 +379,25 @@ func TestIntegration_ComplexExpressions(t *testing.T) {
 
 				var taskResp struct {
 					Task struct {
-						ID            int     `json:"id"`
-						Arg1          float64 `json:"arg1"`
-						Arg2          float64 `json:"arg2"`
-						Operation     string  `json:"operation"`
-						OperationTime int     `json:"operation_time"`
+						ID            int       `json:"id"`
+						Arg1          float64   `json:"arg1"`
+						Arg2          float64   `json:"arg2"`
+						Operation     string    `json:"operation"`
+						OperationTime int       `json:"operation_time"`
+						Args          []float64 `json:"args"`
 					} `json:"task"`
 				}
 				_ = json.NewDecoder(getResp.Body).Decode(&taskResp)
 				_ = getResp.Body.Close()
 
-				resVal := computeStub(taskResp.Task.Arg1, taskResp.Task.Arg2, taskResp.Task.Operation)
-				bodyReq, _ := json.Marshal(map[string]interface{}{
-					"id":     taskResp.Task.ID,
-					"result": resVal,
-				})
+				payload := map[string]interface{}{"id": taskResp.Task.ID}
+				resVal, err := computeStub(taskResp.Task.Arg1, taskResp.Task.Arg2, taskResp.Task.Args, taskResp.Task.Operation)
+				if err != nil {
+					payload["error"] = err.Error()
+				} else {
+					payload["result"] = resVal
+				}
+				bodyReq, _ := json.Marshal(payload)
 				postResp, err := http.Post(server.URL+"/internal/task", "application/json", bytes.NewReader(bodyReq))
 				if err != nil {
 					t.Fatalf("POST /internal/task error: %v", err)
@@ -385,28 +432,51 @@ func TestIntegration_ComplexExpressions(t *testing.T) {
 				if expr.Result != nil {
 					t.Errorf("status=ERROR, but result=%.2f != nil for expr=%q", *expr.Result, tc.expression)
 				}
+				if expr.Error == "" {
+					t.Errorf("status=ERROR, but error is empty for expr=%q", tc.expression)
+				}
 			}
 		})
 	}
 }
 
-func computeStub(a, b float64, op string) float64 {
+func computeStub(a, b float64, args []float64, op string) (float64, error) {
 	switch op {
+	case "sqrt":
+		return math.Sqrt(args[0]), nil
+	case "max":
+		res := args[0]
+		for _, v := range args[1:] {
+			res = math.Max(res, v)
+		}
+		return res, nil
 	case "+":
-		return a + b
+		return a + b, nil
 	case "-":
-		return a - b
+		return a - b, nil
 	case "*":
-		return a * b
+		return a * b, nil
 	case "/":
 		if b == 0 {
-			return 0
+			return 0, errors.New("division by zero")
 		}
-		return a / b
+		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return 0, errors.New("modulo by zero")
+		}
+		return math.Mod(a, b), nil
+	case "^":
+		return math.Pow(a, b), nil
 	case "FULL":
-		return 42
+		return 42, nil
 	default:
-		return 0
+		return 0, nil
 	}
 }
 
@@ -535,3 +605,297 @@ func doAuthorizedGet(t *testing.T, url, token string) (*http.Response, error) {
 	req.Header.Set("Authorization", "Bearer "+token)
 	return http.DefaultClient.Do(req)
 }
+
+func TestStress_ConcurrentAgents(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	srv := grpcserver.NewGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	const (
+		expressions = 30
+		agents      = 40
+	)
+
+	want := make(map[string]float64)
+	totalTasks := 0
+	for i := 0; i < expressions; i++ {
+		raw := fmt.Sprintf("(%d+1)*(%d+2)+(%d+3)*(%d+4)-max(%d,1,2)/2", i, i, i, i, i)
+		expected, err := calc.Calc(raw)
+		if err != nil {
+			t.Fatalf("Calc(%q) error: %v", raw, err)
+		}
+		expr, err := repository.CreateExpression(raw, 1)
+		if err != nil {
+			t.Fatalf("CreateExpression error: %v", err)
+		}
+		root, err := parser.Parse(raw)
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		finalID, err := planner.PlanTasks(expr.ID, root, nil)
+		if err != nil {
+			t.Fatalf("PlanTasks error: %v", err)
+		}
+		expr.Status = model.StatusInProgress
+		expr.FinalTaskID = finalID
+		if err := repository.UpdateExpression(expr); err != nil {
+			t.Fatalf("UpdateExpression error: %v", err)
+		}
+		tasks, err := repository.GetTasksByExpressionID(expr.ID)
+		if err != nil {
+			t.Fatalf("GetTasksByExpressionID error: %v", err)
+		}
+		totalTasks += len(tasks)
+		want[expr.ID] = expected
+	}
+
+	var (
+		mu       sync.Mutex
+		executed = make(map[int32]int)
+		posted   int64
+		wg       sync.WaitGroup
+	)
+	deadline := time.Now().Add(30 * time.Second)
+
+	for a := 0; a < agents; a++ {
+		conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("grpc.NewClient error: %v", err)
+		}
+		defer conn.Close()
+		client := protocalc.NewCalcServiceClient(conn)
+		agentID := fmt.Sprintf("stress-agent-%d", a)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			for atomic.LoadInt64(&posted) < int64(totalTasks) && time.Now().Before(deadline) {
+				resp, err := client.GetTask(ctx, &protocalc.GetTaskRequest{AgentId: agentID})
+				if err != nil {
+					t.Errorf("%s: GetTask error: %v", agentID, err)
+					return
+				}
+				if resp.Status == "NO_TASK" {
+					time.Sleep(5 * time.Millisecond)
+					continue
+				}
+
+				task := resp.Task
+				mu.Lock()
+				executed[task.Id]++
+				mu.Unlock()
+
+				res, err := computeStub(task.Arg1, task.Arg2, task.Args, task.Operation)
+				if err != nil {
+					t.Errorf("%s: compute task %d error: %v", agentID, task.Id, err)
+					return
+				}
+				pr, err := client.PostResult(ctx, &protocalc.PostResultRequest{Id: task.Id, Result: res, AgentId: agentID})
+				if err != nil {
+					t.Errorf("%s: PostResult error: %v", agentID, err)
+					return
+				}
+				if pr.Status != "OK" {
+					t.Errorf("%s: PostResult task %d status=%s", agentID, task.Id, pr.Status)
+				}
+				atomic.AddInt64(&posted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(executed) != totalTasks {
+		t.Errorf("executed %d distinct tasks, want %d", len(executed), totalTasks)
+	}
+	for id, n := range executed {
+		if n != 1 {
+			t.Errorf("task %d was handed out %d times", id, n)
+		}
+	}
+
+	for id, expected := range want {
+		expr, err := repository.GetExpressionByIDNoUserCheck(id)
+		if err != nil {
+			t.Fatalf("GetExpressionByIDNoUserCheck error: %v", err)
+		}
+		if expr.Status != model.StatusDone || expr.Result == nil || *expr.Result != expected {
+			t.Errorf("expression %q = %s %v, want DONE %v", expr.Raw, expr.Status, expr.Result, expected)
+		}
+	}
+}
+
+func TestWorkStream(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	srv := grpcserver.NewGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient error: %v", err)
+	}
+	defer conn.Close()
+	client := protocalc.NewCalcServiceClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.WorkStream(ctx)
+	if err != nil {
+		t.Fatalf("WorkStream error: %v", err)
+	}
+	const capacity = 2
+	err = stream.Send(&protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Hello{Hello: &protocalc.AgentHello{
+		AgentId:  "stream-agent",
+		Capacity: capacity,
+	}}})
+	if err != nil {
+		t.Fatalf("send hello error: %v", err)
+	}
+
+	tasks := make(chan *protocalc.TaskData, 16)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				close(tasks)
+				return
+			}
+			if task := msg.GetTask(); task != nil {
+				tasks <- task
+			}
+		}
+	}()
+
+	raw := "(1+2)*(3+4)+(5+6)*(7+8)"
+	expr, err := repository.CreateExpression(raw, 1)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	root, err := parser.Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	created := time.Now()
+	finalID, err := planner.PlanTasks(expr.ID, root, nil)
+	if err != nil {
+		t.Fatalf("PlanTasks error: %v", err)
+	}
+	expr.Status = model.StatusInProgress
+	expr.FinalTaskID = finalID
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	receive := func() *protocalc.TaskData {
+		select {
+		case task, ok := <-tasks:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			return task
+		case <-time.After(5 * time.Second):
+			t.Fatal("no task pushed within 5s")
+		}
+		return nil
+	}
+
+	var inflight []*protocalc.TaskData
+	for len(inflight) < capacity {
+		inflight = append(inflight, receive())
+	}
+	if wait := time.Since(created); wait > 500*time.Millisecond {
+		t.Errorf("first tasks pushed after %v, want no polling delay", wait)
+	}
+	select {
+	case task := <-tasks:
+		t.Fatalf("task %d pushed beyond capacity %d", task.Id, capacity)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	for sent := 0; sent < 7; sent++ {
+		if len(inflight) == 0 {
+			inflight = append(inflight, receive())
+		}
+		task := inflight[0]
+		inflight = inflight[1:]
+		res, err := computeStub(task.Arg1, task.Arg2, task.Args, task.Operation)
+		if err != nil {
+			t.Fatalf("compute error: %v", err)
+		}
+		err = stream.Send(&protocalc.AgentMessage{Payload: &protocalc.AgentMessage_Result{Result: &protocalc.PostResultRequest{
+			Id:     task.Id,
+			Result: res,
+		}}})
+		if err != nil {
+			t.Fatalf("send result error: %v", err)
+		}
+
+	collect:
+		for {
+			select {
+			case task := <-tasks:
+				inflight = append(inflight, task)
+				if len(inflight) > capacity {
+					t.Fatalf("%d tasks in flight, capacity is %d", len(inflight), capacity)
+				}
+			case <-time.After(100 * time.Millisecond):
+				break collect
+			}
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := repository.GetExpressionByIDNoUserCheck(expr.ID)
+		if err != nil {
+			t.Fatalf("GetExpressionByIDNoUserCheck error: %v", err)
+		}
+		if got.Status == model.StatusDone {
+			if got.Result == nil || *got.Result != 186 {
+				t.Errorf("result = %v, want 186", got.Result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expression not done, status=%s", got.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A task held by a disconnected agent goes back to the queue at once.
+	if _, err := repository.CreateTaskWithArgs(expr.ID, "+", floatPtr(1), nil, floatPtr(1), nil); err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	task := receive()
+	cancel()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		stored, err := repository.GetTaskByID(int(task.Id))
+		if err != nil {
+			t.Fatalf("GetTaskByID error: %v", err)
+		}
+		if stored.Status == model.TaskStatusWaiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task of a disconnected agent stays %s", stored.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
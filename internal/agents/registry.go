@@ -0,0 +1,198 @@
+package agents
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+const (
+	StatusAlive = "ALIVE"
+	StatusDead  = "DEAD"
+)
+
+// Reputation starts at InitialReputation. An agent outvoted on a replicated
+// task loses ReputationPenalty points and gains ReputationReward for each
+// vote it wins, never going above the initial value or below zero.
+const (
+	InitialReputation = 100
+	ReputationPenalty = 10
+	ReputationReward  = 1
+)
+
+type Agent struct {
+	ID             string    `json:"id"`
+	Hostname       string    `json:"hostname"`
+	Version        string    `json:"version"`
+	ComputingPower int       `json:"computing_power"`
+	Operations     []string  `json:"operations"`
+	Tags           []string  `json:"tags,omitempty"`
+	Status         string    `json:"status"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastSeen       time.Time `json:"last_seen"`
+
+	Reputation int `json:"reputation"`
+	VotesWon   int `json:"votes_won"`
+	VotesLost  int `json:"votes_lost"`
+}
+
+// Registry keeps the agents known to this orchestrator in memory. Agents
+// register again after an orchestrator restart.
+type Registry struct {
+	mu     sync.Mutex
+	agents map[string]*Agent
+}
+
+func NewRegistry() *Registry {
+	return &Registry{agents: make(map[string]*Agent)}
+}
+
+var Default = NewRegistry()
+
+// Register adds the agent or replaces a previous registration with the
+// same ID, marking it alive. The reputation of a known agent is kept.
+func (r *Registry) Register(a Agent, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a.Reputation, a.VotesWon, a.VotesLost = InitialReputation, 0, 0
+	if prev, ok := r.agents[a.ID]; ok {
+		a.Reputation, a.VotesWon, a.VotesLost = prev.Reputation, prev.VotesWon, prev.VotesLost
+	}
+	a.Status = StatusAlive
+	a.RegisteredAt = now
+	a.LastSeen = now
+	r.agents[a.ID] = &a
+}
+
+// Heartbeat records that the agent is alive. It returns false if the agent
+// is unknown or was already declared dead and has to register again.
+func (r *Registry) Heartbeat(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.agents[id]
+	if !ok || a.Status != StatusAlive {
+		return false
+	}
+	a.LastSeen = now
+	return true
+}
+
+// MarkDead declares dead every alive agent not seen for longer than timeout
+// and returns their IDs.
+func (r *Registry) MarkDead(now time.Time, timeout time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var dead []string
+	for id, a := range r.agents {
+		if a.Status == StatusAlive && now.Sub(a.LastSeen) > timeout {
+			a.Status = StatusDead
+			dead = append(dead, id)
+		}
+	}
+	sort.Strings(dead)
+	return dead
+}
+
+// RecordVote updates the reputation of the agents whose answers won or lost
+// a vote on a replicated task. Agents that never registered are skipped.
+func (r *Registry) RecordVote(winners, losers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range winners {
+		if a, ok := r.agents[id]; ok {
+			a.VotesWon++
+			a.Reputation = min(a.Reputation+ReputationReward, InitialReputation)
+		}
+	}
+	for _, id := range losers {
+		if a, ok := r.agents[id]; ok {
+			a.VotesLost++
+			a.Reputation = max(a.Reputation-ReputationPenalty, 0)
+		}
+	}
+}
+
+// RecordRun accepts the answer of agentID for a leased task, see
+// repository.RecordRun, and credits the agents of a decided vote. It
+// returns false if agentID lost the lease meanwhile.
+func (r *Registry) RecordRun(task *model.Task, agentID string, result *float64, errText string) (bool, error) {
+	vote, held, err := repository.RecordRun(task, agentID, result, errText, config.ReplicationTolerance())
+	if err != nil || !held {
+		return false, err
+	}
+	if len(vote.Winners) > 0 || len(vote.Losers) > 0 {
+		r.RecordVote(vote.Winners, vote.Losers)
+		if len(vote.Losers) > 0 {
+			log.Printf("[VOTE] task %d: agents %v outvoted by %v", task.ReplicaOf, vote.Losers, vote.Winners)
+		}
+	}
+	return true, nil
+}
+
+// Capable counts the alive agents having all tags that can compute op.
+func (r *Registry) Capable(op string, tags []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, a := range r.agents {
+		if a.Status == StatusAlive && a.can(op, tags) {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *Agent) can(op string, tags []string) bool {
+	if len(a.Operations) > 0 && !slices.Contains(a.Operations, op) {
+		return false
+	}
+	for _, tag := range tags {
+		if !slices.Contains(a.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of agents ever registered, alive or dead.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.agents)
+}
+
+func (r *Registry) Get(id string) (Agent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.agents[id]
+	if !ok {
+		return Agent{}, false
+	}
+	return *a, true
+}
+
+// List returns a snapshot of all agents ordered by ID.
+func (r *Registry) List() []Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
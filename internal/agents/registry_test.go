@@ -0,0 +1,109 @@
+package agents_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+)
+
+func TestRegistry(t *testing.T) {
+	r := agents.NewRegistry()
+	start := time.Now()
+
+	r.Register(agents.Agent{ID: "b", ComputingPower: 2, Operations: []string{"+"}}, start)
+	r.Register(agents.Agent{ID: "a", ComputingPower: 1}, start)
+
+	list := r.List()
+	if len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("List() = %+v, want agents a and b in order", list)
+	}
+	if list[1].Status != agents.StatusAlive || list[1].ComputingPower != 2 {
+		t.Errorf("unexpected agent %+v", list[1])
+	}
+
+	if r.Heartbeat("unknown", start) {
+		t.Error("Heartbeat of an unknown agent must fail")
+	}
+	if !r.Heartbeat("a", start.Add(5*time.Second)) {
+		t.Error("Heartbeat of a registered agent must succeed")
+	}
+
+	dead := r.MarkDead(start.Add(8*time.Second), 6*time.Second)
+	if len(dead) != 1 || dead[0] != "b" {
+		t.Fatalf("MarkDead() = %v, want [b]", dead)
+	}
+	if a, _ := r.Get("b"); a.Status != agents.StatusDead {
+		t.Errorf("agent b status = %s, want %s", a.Status, agents.StatusDead)
+	}
+	if dead := r.MarkDead(start.Add(9*time.Second), 6*time.Second); len(dead) != 0 {
+		t.Errorf("an agent must be declared dead once, got %v", dead)
+	}
+
+	if r.Heartbeat("b", start.Add(10*time.Second)) {
+		t.Error("a dead agent must register again")
+	}
+	r.Register(agents.Agent{ID: "b"}, start.Add(10*time.Second))
+	if a, _ := r.Get("b"); a.Status != agents.StatusAlive {
+		t.Errorf("re-registered agent status = %s, want %s", a.Status, agents.StatusAlive)
+	}
+}
+
+func TestRegistry_RecordVote(t *testing.T) {
+	r := agents.NewRegistry()
+	now := time.Now()
+	r.Register(agents.Agent{ID: "good"}, now)
+	r.Register(agents.Agent{ID: "bad"}, now)
+
+	for i := 0; i < 3; i++ {
+		r.RecordVote([]string{"good", "unregistered"}, []string{"bad"})
+	}
+
+	good, _ := r.Get("good")
+	bad, _ := r.Get("bad")
+	if good.Reputation != agents.InitialReputation || good.VotesWon != 3 || good.VotesLost != 0 {
+		t.Errorf("good agent = %+v", good)
+	}
+	want := agents.InitialReputation - 3*agents.ReputationPenalty
+	if bad.Reputation != want || bad.VotesLost != 3 {
+		t.Errorf("bad agent reputation = %d with %d lost votes, want %d", bad.Reputation, bad.VotesLost, want)
+	}
+	if _, ok := r.Get("unregistered"); ok {
+		t.Error("votes must not register unknown agents")
+	}
+
+	r.Register(agents.Agent{ID: "bad", Version: "2"}, now.Add(time.Minute))
+	if again, _ := r.Get("bad"); again.Reputation != want {
+		t.Errorf("reputation reset on registration: %d", again.Reputation)
+	}
+}
+
+func TestRegistry_Capable(t *testing.T) {
+	r := agents.NewRegistry()
+	now := time.Now()
+	r.Register(agents.Agent{ID: "adder", Operations: []string{"+", "-"}}, now)
+	r.Register(agents.Agent{ID: "gpu", Operations: []string{"*"}, Tags: []string{"gpu-free"}}, now)
+
+	for op, want := range map[string]int{"+": 1, "*": 1, "sqrt": 0} {
+		if n := r.Capable(op, nil); n != want {
+			t.Errorf("Capable(%s) without tags = %d, want %d", op, n, want)
+		}
+	}
+	for op, want := range map[string]int{"+": 0, "*": 1} {
+		if n := r.Capable(op, []string{"gpu-free"}); n != want {
+			t.Errorf("Capable(%s) with tags = %d, want %d", op, n, want)
+		}
+	}
+
+	r.MarkDead(now.Add(time.Minute), time.Second)
+	r.Register(agents.Agent{ID: "any"}, now.Add(time.Minute))
+	if n := r.Capable("sqrt", nil); n != 1 {
+		t.Errorf("an agent without an operation list computes anything, Capable(sqrt) = %d", n)
+	}
+	if n := r.Capable("*", []string{"gpu-free"}); n != 0 {
+		t.Errorf("dead agents must not count, Capable(*) = %d", n)
+	}
+	if n := r.Capable("+", nil); n != 1 {
+		t.Errorf("Capable(+) = %d, want only the alive agent", n)
+	}
+}
@@ -2,104 +2,58 @@ package calc
 
 import (
 	"fmt"
-	"math"
-	"strconv"
-	"strings"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 )
 
 func Calc(expression string) (float64, error) {
-	expression = strings.ReplaceAll(expression, " ", "")
+	root, err := parser.Parse(expression)
+	if err != nil {
+		return 0.0, err
+	}
+	if err := parser.CheckIdentifiers(expression, root, nil); err != nil {
+		return 0.0, err
+	}
+	return Eval(root, nil)
+}
 
-	for strings.Contains(expression, "(") {
-		lp := strings.Index(expression, "(")
-		var err error
-		expression, err = RemoveParentheses(expression, lp)
+func Eval(node parser.Node, vars map[string]float64) (float64, error) {
+	switch n := node.(type) {
+	case *parser.Number:
+		return n.Value, nil
+	case *parser.Ident:
+		v, ok := parser.Lookup(n.Name, vars)
+		if !ok {
+			return 0.0, fmt.Errorf("unknown identifier %q", n.Name)
+		}
+		return v, nil
+	case *parser.Unary:
+		x, err := Eval(n.X, vars)
 		if err != nil {
 			return 0.0, err
 		}
-	}
-
-	for strings.Contains(expression, "/") || strings.Contains(expression, "*") {
-		index_mul := strings.Index(expression, "*")
-		index_div := strings.Index(expression, "/")
-		left := -1
-		right := -1
-		var err error
-
-		if index_div == -1 {
-			index_div = math.MaxInt64
-		} else {
-			index_mul = math.MaxInt64
-		}
-
-		if index_div < index_mul {
-
-			left, right, err = FindBorders(expression, index_div)
-			if err != nil {
-				return 0.0, err
-			}
-		} else {
-			left, right, err = FindBorders(expression, index_mul)
-			if err != nil {
-				return 0.0, err
-			}
-		}
-
-		result, err := Compute(expression[left:right])
+		return -x, nil
+	case *parser.Binary:
+		x, err := Eval(n.X, vars)
 		if err != nil {
 			return 0.0, err
 		}
-
-		expression = expression[:left] + string(fmt.Sprintf("%f", result)) + expression[right:]
-
-	}
-
-	if len(expression) > 1 {
-		if string(expression[0]) == "-" && string(expression[1]) == "-" {
-			expression = strings.Replace(expression, "-", "", 2)
-		}
-	}
-
-	for strings.Contains(expression, "+") || (strings.Contains(expression, "-") && (strings.Index(expression, "-") != 0 || strings.Count(expression, "-") != 1)) {
-		index_add := strings.Index(expression, "+")
-		index_sub := strings.Index(expression, "-")
-		if index_sub == 0 {
-			index_sub = FindSecondOccurence(expression, '-')
-		}
-
-		left := -1
-		right := -1
-		var err error
-
-		if index_add == -1 {
-			index_add = math.MaxInt64
-		} else {
-			index_sub = math.MaxInt64
+		y, err := Eval(n.Y, vars)
+		if err != nil {
+			return 0.0, err
 		}
-
-		if index_sub < index_add || index_add == -1 {
-			left, right, err = FindBorders(expression, index_sub)
+		return Apply(n.Op, x, y)
+	case *parser.Call:
+		args := make([]float64, 0, len(n.Args))
+		for _, arg := range n.Args {
+			v, err := Eval(arg, vars)
 			if err != nil {
 				return 0.0, err
 			}
-		} else {
-			left, right, err = FindBorders(expression, index_add)
-			if err != nil {
-				return 0.0, err
-			}
-		}
-		result, err := Compute(expression[left:right])
-		if err != nil {
-			return 0.0, err
+			args = append(args, v)
 		}
-
-		expression = expression[:left] + string(fmt.Sprintf("%f", result)) + expression[right:]
-
-	}
-
-	res, err := strconv.ParseFloat(expression, 64)
-	if err != nil {
-		return 0.0, err
+		return ApplyFunc(n.Name, args)
+	default:
+		return 0.0, fmt.Errorf("unsupported node %T", node)
 	}
-	return res, nil
 }
@@ -1,203 +1,121 @@
 package calc
 
 import (
-	"bytes"
-	"math"
 	"testing"
 )
 
-func TestFindSecondOccurence(t *testing.T) {
+func TestCalc(t *testing.T) {
 	tests := []struct {
 		name       string
 		expression string
-		char       rune
-		want       int
+		want       float64
+		wantErr    bool
 	}{
 		{
-			name:       "No occurrences",
-			expression: "12345",
-			char:       '+',
-			want:       math.MaxInt64,
+			name:       "Simple expression +",
+			expression: "1+2",
+			want:       3,
+			wantErr:    false,
 		},
 		{
-			name:       "One occurrence",
-			expression: "1+2",
-			char:       '+',
-			want:       math.MaxInt64,
+			name:       "Expression with parentheses",
+			expression: "(2+3)*4",
+			want:       20,
+			wantErr:    false,
 		},
 		{
-			name:       "Two occurrences",
-			expression: "1+2+3",
-			char:       '+',
-			want:       3,
+			name:       "Nested parentheses",
+			expression: "((1+2)*3)",
+			want:       9,
+			wantErr:    false,
 		},
 		{
-			name:       "More than two occurrences",
-			expression: "1-2-3-4",
-			char:       '-',
-			want:       3,
+			name:       "Extended literals",
+			expression: "0xFF + 0b1010 * 1_000 - 2.5e2",
+			want:       10005,
+			wantErr:    false,
 		},
 		{
-			name:       "Empty string",
-			expression: "",
-			char:       '-',
-			want:       math.MaxInt64,
+			name:       "Division by zero in parentheses",
+			expression: "(10/0)",
+			want:       0,
+			wantErr:    true,
 		},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			got := FindSecondOccurence(tc.expression, tc.char)
-			if got != tc.want {
-				t.Errorf("FindSecondOccurence(%q, %q) = %d; want %d",
-					tc.expression, string(tc.char), got, tc.want)
-			}
-		})
-	}
-}
-
-func TestFindBorders(t *testing.T) {
-	tests := []struct {
-		name       string
-		expression string
-		index      int
-		wantLeft   int
-		wantRight  int
-		wantErr    error
-	}{
 		{
-			name:       "Simple plus",
-			expression: "3+5",
-			index:      1,
-			wantLeft:   0,
-			wantRight:  3,
-			wantErr:    nil,
+			name:       "Multiple operators in a row with negative number",
+			expression: "2--2",
+			want:       4,
+			wantErr:    false,
 		},
 		{
-			name:       "Operator at the end",
-			expression: "123+",
-			index:      3,
-			wantLeft:   0,
-			wantRight:  4,
-			wantErr:    nil,
+			name:       "Complex expression",
+			expression: "3+5*2-8/4",
+			want:       11,
+			wantErr:    false,
 		},
 		{
-			name:       "Negative number in expression",
-			expression: "10*-2",
-			index:      2,
-			wantLeft:   0,
-			wantRight:  5,
-			wantErr:    nil,
+			name:       "Unary minus after operator",
+			expression: "2*-3",
+			want:       -6,
+			wantErr:    false,
 		},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			left, right, err := FindBorders(tc.expression, tc.index)
-			if (err != nil) && tc.wantErr == nil {
-				t.Fatalf("FindBorders(%q, %d) got err = %v, want no error",
-					tc.expression, tc.index, err)
-			}
-			if err == nil && tc.wantErr != nil {
-				t.Fatalf("FindBorders(%q, %d) got no error, want %v",
-					tc.expression, tc.index, tc.wantErr)
-			}
-			if left != tc.wantLeft || right != tc.wantRight {
-				t.Errorf("FindBorders(%q, %d) = (%d, %d); want (%d, %d)",
-					tc.expression, tc.index, left, right, tc.wantLeft, tc.wantRight)
-			}
-		})
-	}
-}
-
-func TestFindSecondParenthesis(t *testing.T) {
-	tests := []struct {
-		name       string
-		expression string
-		wantIndex  int
-		wantErr    bool
-	}{
 		{
-			name:       "No parentheses",
-			expression: "123+456",
-			wantIndex:  -1,
-			wantErr:    true,
+			name:       "Unary minus before parentheses",
+			expression: "-(1+2)",
+			want:       -3,
+			wantErr:    false,
 		},
 		{
-			name:       "Extra closing parenthesis",
-			expression: "1+2)",
-			wantIndex:  3,
+			name:       "Left associativity",
+			expression: "8 - 3 - 2",
+			want:       3,
 			wantErr:    false,
 		},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			got, err := FindSecondParenthesis(tc.expression)
-			if (err != nil) != tc.wantErr {
-				t.Fatalf("FindSecondParenthesis(%q) err=%v, wantErr=%v",
-					tc.expression, err, tc.wantErr)
-			}
-			if got != tc.wantIndex && !tc.wantErr {
-				t.Errorf("FindSecondParenthesis(%q) = %d; want %d",
-					tc.expression, got, tc.wantIndex)
-			}
-		})
-	}
-}
-
-func TestCompute(t *testing.T) {
-	tests := []struct {
-		name       string
-		expression string
-		want       float64
-		wantErr    bool
-	}{
 		{
-			name:       "Simple plus",
-			expression: "3+5",
-			want:       8,
+			name:       "Power is right-associative",
+			expression: "2^3^2",
+			want:       512,
 			wantErr:    false,
 		},
 		{
-			name:       "Simple minus",
-			expression: "10-3",
-			want:       7,
+			name:       "Power binds tighter than unary minus",
+			expression: "-2^2",
+			want:       -4,
 			wantErr:    false,
 		},
 		{
-			name:       "Simple multiply",
-			expression: "2*3",
-			want:       6,
+			name:       "Negative exponent",
+			expression: "2^-1",
+			want:       0.5,
 			wantErr:    false,
 		},
 		{
-			name:       "Simple division",
-			expression: "10/2",
-			want:       5,
+			name:       "Modulo and integer division",
+			expression: "7%3 + 7//2",
+			want:       4,
 			wantErr:    false,
 		},
 		{
-			name:       "Division by zero",
-			expression: "10/0",
+			name:       "Zero to a negative power",
+			expression: "0^-1",
 			want:       0,
 			wantErr:    true,
 		},
 		{
-			name:       "Negative number, plus",
-			expression: "-2+5",
-			want:       3,
+			name:       "Functions",
+			expression: "sqrt(16) + max(1, 7, 3) - abs(-2)",
+			want:       9,
 			wantErr:    false,
 		},
 		{
-			name:       "Invalid expression (no operator)",
-			expression: "123",
+			name:       "Square root of a negative number",
+			expression: "sqrt(-1)",
 			want:       0,
 			wantErr:    true,
 		},
 		{
-			name:       "Invalid expression (incorrect syntax)",
-			expression: "+2",
+			name:       "Incorrect expression (unsupported sequence)",
+			expression: "abc+123",
 			want:       0,
 			wantErr:    true,
 		},
@@ -205,149 +123,93 @@ func TestCompute(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := Compute(tc.expression)
+			got, err := Calc(tc.expression)
 			if (err != nil) != tc.wantErr {
-				t.Fatalf("Compute(%q) err=%v, wantErr=%v",
+				t.Fatalf("Calc(%q) err=%v, wantErr=%v",
 					tc.expression, err, tc.wantErr)
 			}
-			if !tc.wantErr && got != tc.want {
-				t.Errorf("Compute(%q) = %v, want %v",
+			if !tc.wantErr && !floatEquals(got, tc.want) {
+				t.Errorf("Calc(%q) = %v, want %v",
 					tc.expression, got, tc.want)
 			}
 		})
 	}
 }
 
-func TestRemoveParentheses(t *testing.T) {
+func TestApply(t *testing.T) {
 	tests := []struct {
-		name         string
-		expression   string
-		index        int
-		wantContains string
-		wantErr      bool
+		op      string
+		a, b    float64
+		want    float64
+		wantErr bool
 	}{
-		{
-			name:         "Simple parentheses",
-			expression:   "(1+2)",
-			index:        0,
-			wantContains: "3.000000",
-			wantErr:      false,
-		},
-		{
-			name:         "Nested parentheses",
-			expression:   "((1+2))",
-			index:        0,
-			wantContains: "3.000000",
-			wantErr:      false,
-		},
-		{
-			name:         "Unmatched parentheses",
-			expression:   "(1+2",
-			index:        0,
-			wantContains: "",
-			wantErr:      true,
-		},
-		{
-			name:         "Expression inside parentheses with minus",
-			expression:   "(-2+5)",
-			index:        0,
-			wantContains: "3.000000",
-			wantErr:      false,
-		},
-		{
-			name:         "Extra closing parenthesis",
-			expression:   "1+2)",
-			index:        1,
-			wantContains: "",
-			wantErr:      true,
-		},
+		{op: "^", a: 2, b: 10, want: 1024},
+		{op: "^", a: 0, b: 0, want: 1},
+		{op: "^", a: 0, b: -1, wantErr: true},
+		{op: "^", a: -8, b: 1.0 / 3, wantErr: true},
+		{op: "^", a: 10, b: 400, wantErr: true},
+		{op: "%", a: 7, b: 3, want: 1},
+		{op: "%", a: -7, b: 3, want: -1},
+		{op: "%", a: 7.5, b: 2, want: 1.5},
+		{op: "%", a: 1, b: 0, wantErr: true},
+		{op: "//", a: 7, b: 2, want: 3},
+		{op: "//", a: -7, b: 2, want: -4},
+		{op: "//", a: 1, b: 0, wantErr: true},
+		{op: "?", a: 1, b: 1, wantErr: true},
 	}
 
 	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			got, err := RemoveParentheses(tc.expression, tc.index)
-			if (err != nil) != tc.wantErr {
-				t.Fatalf("RemoveParentheses(%q, %d) err=%v, wantErr=%v",
-					tc.expression, tc.index, err, tc.wantErr)
-			}
-			if !tc.wantErr && !stringsContains(got, tc.wantContains) {
-				t.Errorf("RemoveParentheses(%q, %d) = %q; want substring %q",
-					tc.expression, tc.index, got, tc.wantContains)
-			}
-		})
+		got, err := Apply(tc.op, tc.a, tc.b)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Apply(%q, %v, %v) err=%v, wantErr=%v", tc.op, tc.a, tc.b, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !floatEquals(got, tc.want) {
+			t.Errorf("Apply(%q, %v, %v) = %v, want %v", tc.op, tc.a, tc.b, got, tc.want)
+		}
 	}
 }
 
-func TestCalc(t *testing.T) {
+func TestApplyFunc(t *testing.T) {
 	tests := []struct {
-		name       string
-		expression string
-		want       float64
-		wantErr    bool
+		name    string
+		args    []float64
+		want    float64
+		wantErr bool
 	}{
-		{
-			name:       "Simple expression +",
-			expression: "1+2",
-			want:       3,
-			wantErr:    false,
-		},
-		{
-			name:       "Expression with parentheses",
-			expression: "(2+3)*4",
-			want:       20,
-			wantErr:    false,
-		},
-		{
-			name:       "Nested parentheses",
-			expression: "((1+2)*3)",
-			want:       9,
-			wantErr:    false,
-		},
-		{
-			name:       "Division by zero in parentheses",
-			expression: "(10/0)",
-			want:       0,
-			wantErr:    true,
-		},
-		{
-			name:       "Multiple operators in a row with negative number",
-			expression: "2--2",
-			want:       4,
-			wantErr:    false,
-		},
-		{
-			name:       "Complex expression",
-			expression: "3+5*2-8/4",
-			want:       11,
-			wantErr:    false,
-		},
-		{
-			name:       "Incorrect expression (unsupported sequence)",
-			expression: "abc+123",
-			want:       0,
-			wantErr:    true,
-		},
+		{name: "sqrt", args: []float64{9}, want: 3},
+		{name: "sqrt", args: []float64{-1}, wantErr: true},
+		{name: "abs", args: []float64{-2.5}, want: 2.5},
+		{name: "sin", args: []float64{0}, want: 0},
+		{name: "cos", args: []float64{0}, want: 1},
+		{name: "ln", args: []float64{1}, want: 0},
+		{name: "ln", args: []float64{0}, wantErr: true},
+		{name: "log10", args: []float64{1000}, want: 3},
+		{name: "log10", args: []float64{-10}, wantErr: true},
+		{name: "log", args: []float64{8, 2}, want: 3},
+		{name: "log", args: []float64{8, 1}, wantErr: true},
+		{name: "exp", args: []float64{1000}, wantErr: true},
+		{name: "round", args: []float64{2.5}, want: 3},
+		{name: "round", args: []float64{-2.5}, want: -3},
+		{name: "min", args: []float64{3, -1, 2}, want: -1},
+		{name: "max", args: []float64{3, -1, 2, 8}, want: 8},
+		{name: "max", args: nil, wantErr: true},
+		{name: "sqrt", args: []float64{1, 2}, wantErr: true},
+		{name: "nope", args: []float64{1}, wantErr: true},
 	}
 
 	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			got, err := Calc(tc.expression)
-			if (err != nil) != tc.wantErr {
-				t.Fatalf("Calc(%q) err=%v, wantErr=%v",
-					tc.expression, err, tc.wantErr)
-			}
-			if !tc.wantErr && !floatEquals(got, tc.want) {
-				t.Errorf("Calc(%q) = %v, want %v",
-					tc.expression, got, tc.want)
-			}
-		})
+		got, err := ApplyFunc(tc.name, tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ApplyFunc(%q, %v) err=%v, wantErr=%v", tc.name, tc.args, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !floatEquals(got, tc.want) {
+			t.Errorf("ApplyFunc(%q, %v) = %v, want %v", tc.name, tc.args, got, tc.want)
+		}
 	}
 }
 
-func stringsContains(haystack, needle string) bool {
-	return bytes.Contains([]byte(haystack), []byte(needle))
-}
-
 func floatEquals(a, b float64) bool {
 	eps := 1e-9
 	return (a-b) < eps && (b-a) < eps
@@ -362,9 +224,20 @@ func TestCheckInput(t *testing.T) {
 		{"(2+3)*4", true},
 		{"2+a", false},
 		{"-2", true},
-		{"2 ^ 3", false},
+		{"2 ^ 3", true},
+		{"7 // 2 % 3", true},
+		{"2 ^", false},
+		{"2 */ 3", false},
 		{"(2+3 *", false},
+		{"2*-3", true},
+		{"-(1+2)", true},
+		{"1+2)", false},
+		{"5/*2", false},
 		{"", false},
+		{"1e-9 + 0xFF", true},
+		{"0b1010 * 1_000_000", true},
+		{"0b12", false},
+		{"1_", false},
 	}
 
 	for _, tc := range tests {
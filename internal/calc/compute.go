@@ -2,63 +2,46 @@ package calc
 
 import (
 	"errors"
-	"strconv"
-	"strings"
+	"math"
 )
 
-func Compute(expression string) (float64, error) {
-	var firstnum []rune
-	var secondnum []rune
-	var operator string
-	firstNumEnded := false
-	operators := "+-*/"
-
-	for i, char := range expression {
-		if strings.Contains(operators, string(char)) {
-			temp := operator
-			operator = string(char)
-			if (operator == "-" && i == 0) || firstNumEnded {
-				operator = temp
-			} else {
-				firstNumEnded = true
-				continue
-			}
-		}
-		if !firstNumEnded {
-			firstnum = append(firstnum, char)
-		} else {
-			secondnum = append(secondnum, char)
+func Apply(op string, a, b float64) (float64, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return 0.0, errors.New("division by zero")
 		}
-	}
-
-	if len(firstnum) == 0 || len(secondnum) == 0 || len(operator) == 0 {
-		return 0.0, errors.New("incorrect expression" + expression)
-	}
-
-	str_firstnum := string(firstnum)
-	float_firstnum, err := strconv.ParseFloat(str_firstnum, 64)
-	if err != nil {
-		return 0.0, errors.New("incorrect number: " + str_firstnum)
-	}
-
-	str_secondnum := string(secondnum)
-	float_secondnum, err := strconv.ParseFloat(string(secondnum), 64)
-	if err != nil {
-		return 0.0, errors.New("incorrect number: " + str_secondnum)
-	}
-
-	if operator == "+" {
-		return float_firstnum + float_secondnum, nil
-	} else if operator == "-" {
-		return float_firstnum - float_secondnum, nil
-	} else if operator == "*" {
-		return float_firstnum * float_secondnum, nil
-	} else if operator == "/" {
-		if float_secondnum == 0 {
+		return a / b, nil
+	case "//":
+		if b == 0 {
 			return 0.0, errors.New("division by zero")
 		}
-		return float_firstnum / float_secondnum, nil
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return 0.0, errors.New("modulo by zero")
+		}
+		// Like Go's math.Mod, the result takes the sign of the dividend.
+		return math.Mod(a, b), nil
+	case "^":
+		if a == 0 && b < 0 {
+			return 0.0, errors.New("zero raised to a negative power")
+		}
+		res := math.Pow(a, b)
+		if math.IsNaN(res) {
+			return 0.0, errors.New("negative base raised to a fractional power")
+		}
+		if math.IsInf(res, 0) {
+			return 0.0, errors.New("result is out of range")
+		}
+		return res, nil
 	}
 
-	return 0.0, errors.New("incorrect operator: " + operator)
+	return 0.0, errors.New("incorrect operator: " + op)
 }
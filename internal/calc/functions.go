@@ -0,0 +1,93 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
+)
+
+var unaryFunctions = map[string]func(float64) (float64, error){
+	"sqrt": func(x float64) (float64, error) {
+		if x < 0 {
+			return 0.0, errors.New("square root of a negative number")
+		}
+		return math.Sqrt(x), nil
+	},
+	"abs": func(x float64) (float64, error) { return math.Abs(x), nil },
+	"sin": func(x float64) (float64, error) { return math.Sin(x), nil },
+	"cos": func(x float64) (float64, error) { return math.Cos(x), nil },
+	"tan": func(x float64) (float64, error) { return math.Tan(x), nil },
+	"exp": func(x float64) (float64, error) { return math.Exp(x), nil },
+	"ln": func(x float64) (float64, error) {
+		if x <= 0 {
+			return 0.0, errors.New("logarithm of a non-positive number")
+		}
+		return math.Log(x), nil
+	},
+	"log10": func(x float64) (float64, error) {
+		if x <= 0 {
+			return 0.0, errors.New("logarithm of a non-positive number")
+		}
+		return math.Log10(x), nil
+	},
+	"round": func(x float64) (float64, error) { return math.Round(x), nil },
+}
+
+// Operations lists every task operation that Apply and ApplyFunc compute.
+func Operations() []string {
+	ops := []string{"+", "-", "*", "/", "//", "%", "^"}
+	names := make([]string, 0, len(parser.Functions))
+	for name := range parser.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(ops, names...)
+}
+
+// ApplyFunc evaluates a built-in function. log(x) is the natural logarithm,
+// log(x, b) is the logarithm of x to base b.
+func ApplyFunc(name string, args []float64) (float64, error) {
+	arity, ok := parser.Functions[name]
+	if !ok {
+		return 0.0, errors.New("unknown function: " + name)
+	}
+	if len(args) < arity.Min || (arity.Max >= 0 && len(args) > arity.Max) {
+		return 0.0, fmt.Errorf("%s expects %s, got %d", name, arity, len(args))
+	}
+
+	var res float64
+	var err error
+	switch name {
+	case "min":
+		res = args[0]
+		for _, a := range args[1:] {
+			res = math.Min(res, a)
+		}
+	case "max":
+		res = args[0]
+		for _, a := range args[1:] {
+			res = math.Max(res, a)
+		}
+	case "log":
+		res, err = unaryFunctions["ln"](args[0])
+		if err == nil && len(args) == 2 {
+			base := args[1]
+			if base <= 0 || base == 1 {
+				return 0.0, errors.New("invalid logarithm base")
+			}
+			res /= math.Log(base)
+		}
+	default:
+		res, err = unaryFunctions[name](args[0])
+	}
+	if err != nil {
+		return 0.0, err
+	}
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		return 0.0, errors.New("result is out of range")
+	}
+	return res, nil
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
+)
+
+var (
+	additionTime       int
+	subtractionTime    int
+	multiplicationTime int
+	divisionTime       int
+	intDivisionTime    int
+	moduloTime         int
+	exponentiationTime int
+	functionTime       int
+	fullTime           int
+
+	leaseSlack     int
+	reaperInterval int
+
+	heartbeatInterval int
+	agentTimeout      int
+
+	replicationFactor    int
+	replicationTolerance float64
+
+	taskMaxRetries    int
+	retryBackoff      int
+	retryBackoffLimit int
+
+	maxPriorityUser  int
+	maxPriorityAdmin int
+	adminLogins      []string
+
+	maxWait        int
+	maxBatchSize   int
+	idempotencyTTL int
+
+	webhookMaxRetries   int
+	webhookBackoff      int
+	webhookBackoffLimit int
+	webhookTimeout      int
+)
+
+// MaxReplication bounds the replication factor of an expression.
+const MaxReplication = 9
+
+func init() {
+	additionTime = GetEnvAsInt("TIME_ADDITION_MS", 1000)
+	subtractionTime = GetEnvAsInt("TIME_SUBTRACTION_MS", 1200)
+	multiplicationTime = GetEnvAsInt("TIME_MULTIPLICATIONS_MS", 2000)
+	divisionTime = GetEnvAsInt("TIME_DIVISIONS_MS", 2500)
+	intDivisionTime = GetEnvAsInt("TIME_INT_DIVISIONS_MS", 2500)
+	moduloTime = GetEnvAsInt("TIME_MODULO_MS", 2500)
+	exponentiationTime = GetEnvAsInt("TIME_EXPONENTIATION_MS", 3000)
+	functionTime = GetEnvAsInt("TIME_FUNCTIONS_MS", 2000)
+	fullTime = GetEnvAsInt("TIME_FULL_MS", 3000)
+
+	leaseSlack = GetEnvAsInt("LEASE_SLACK_MS", 5000)
+	reaperInterval = GetEnvAsInt("LEASE_REAPER_INTERVAL_MS", 1000)
+
+	heartbeatInterval = GetEnvAsInt("AGENT_HEARTBEAT_INTERVAL_MS", 2000)
+	agentTimeout = GetEnvAsInt("AGENT_TIMEOUT_MS", 3*heartbeatInterval)
+
+	replicationFactor = GetEnvAsInt("REPLICATION_FACTOR", 1)
+	replicationTolerance = GetEnvAsFloat("REPLICATION_TOLERANCE", 1e-9)
+
+	taskMaxRetries = GetEnvAsInt("TASK_MAX_RETRIES", 3)
+	retryBackoff = GetEnvAsInt("TASK_RETRY_BACKOFF_MS", 1000)
+	retryBackoffLimit = GetEnvAsInt("TASK_RETRY_BACKOFF_MAX_MS", 60000)
+
+	maxPriorityUser = GetEnvAsInt("MAX_PRIORITY_USER", 5)
+	maxPriorityAdmin = GetEnvAsInt("MAX_PRIORITY_ADMIN", 10)
+	for _, login := range strings.Split(os.Getenv("ADMIN_LOGINS"), ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			adminLogins = append(adminLogins, login)
+		}
+	}
+
+	maxWait = GetEnvAsInt("MAX_WAIT_MS", 60000)
+	maxBatchSize = GetEnvAsInt("MAX_BATCH_SIZE", 1000)
+	idempotencyTTL = GetEnvAsInt("IDEMPOTENCY_TTL_MS", 24*60*60*1000)
+
+	webhookMaxRetries = GetEnvAsInt("WEBHOOK_MAX_RETRIES", 5)
+	webhookBackoff = GetEnvAsInt("WEBHOOK_RETRY_BACKOFF_MS", 1000)
+	webhookBackoffLimit = GetEnvAsInt("WEBHOOK_RETRY_BACKOFF_MAX_MS", 600000)
+	webhookTimeout = GetEnvAsInt("WEBHOOK_TIMEOUT_MS", 5000)
+}
+
+func GetEnvAsInt(name string, defaultVal int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultVal
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		return defaultVal
+	}
+	return parsed
+}
+
+func GetEnvAsFloat(name string, defaultVal float64) float64 {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultVal
+	}
+	parsed, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return defaultVal
+	}
+	return parsed
+}
+
+// OperationTime returns the simulated duration of op in milliseconds.
+func OperationTime(op string) int {
+	switch op {
+	case "+", "ADD":
+		return additionTime
+	case "-", "SUB":
+		return subtractionTime
+	case "*", "MUL":
+		return multiplicationTime
+	case "/", "DIV":
+		return divisionTime
+	case "//", "IDIV":
+		return intDivisionTime
+	case "%", "MOD":
+		return moduloTime
+	case "^", "POW":
+		return exponentiationTime
+	case "FULL":
+		return fullTime
+	}
+	if parser.IsFunction(op) {
+		return functionTime
+	}
+	return additionTime
+}
+
+// LeaseDuration is how long an agent may hold op before it is requeued:
+// the operation time plus LEASE_SLACK_MS for network and scheduling delays.
+func LeaseDuration(op string) time.Duration {
+	return time.Duration(OperationTime(op)+leaseSlack) * time.Millisecond
+}
+
+func ReaperInterval() time.Duration {
+	return time.Duration(reaperInterval) * time.Millisecond
+}
+
+// HeartbeatInterval is how often agents are asked to send heartbeats.
+func HeartbeatInterval() time.Duration {
+	return time.Duration(heartbeatInterval) * time.Millisecond
+}
+
+// AgentTimeout is how long an agent may stay silent before it is declared
+// dead and its tasks are requeued.
+func AgentTimeout() time.Duration {
+	return time.Duration(agentTimeout) * time.Millisecond
+}
+
+// ReplicationFactor is the number of agents computing each task of an
+// expression that does not request its own replication.
+func ReplicationFactor() int {
+	if replicationFactor < 1 {
+		return 1
+	}
+	if replicationFactor > MaxReplication {
+		return MaxReplication
+	}
+	return replicationFactor
+}
+
+// ReplicationTolerance is the relative difference under which results of
+// replicated runs are considered equal.
+func ReplicationTolerance() float64 {
+	return replicationTolerance
+}
+
+// TaskMaxRetries is how many times a task failing transiently is retried
+// before it is declared dead.
+func TaskMaxRetries() int {
+	return max(taskMaxRetries, 0)
+}
+
+// RetryBackoff is the delay before the first retry of a task; it doubles
+// with every further retry up to RetryBackoffMax.
+func RetryBackoff() time.Duration {
+	return time.Duration(max(retryBackoff, 0)) * time.Millisecond
+}
+
+func RetryBackoffMax() time.Duration {
+	return time.Duration(max(retryBackoffLimit, retryBackoff, 0)) * time.Millisecond
+}
+
+// MaxWait bounds how long a request may wait for the result of an
+// expression; longer waits are shortened to it.
+func MaxWait() time.Duration {
+	return time.Duration(max(maxWait, 0)) * time.Millisecond
+}
+
+// MaxBatchSize bounds the number of expressions in one batch request.
+func MaxBatchSize() int {
+	return max(maxBatchSize, 1)
+}
+
+// IdempotencyTTL is how long an Idempotency-Key is remembered.
+func IdempotencyTTL() time.Duration {
+	return time.Duration(max(idempotencyTTL, 0)) * time.Millisecond
+}
+
+// WebhookMaxRetries is how many times a failed webhook delivery is retried.
+func WebhookMaxRetries() int {
+	return max(webhookMaxRetries, 0)
+}
+
+// WebhookBackoff is the delay before the first retry of a webhook; it
+// doubles with every further retry up to WebhookBackoffMax.
+func WebhookBackoff() time.Duration {
+	return time.Duration(max(webhookBackoff, 0)) * time.Millisecond
+}
+
+func WebhookBackoffMax() time.Duration {
+	return time.Duration(max(webhookBackoffLimit, webhookBackoff, 0)) * time.Millisecond
+}
+
+// WebhookTimeout bounds a single webhook request.
+func WebhookTimeout() time.Duration {
+	return time.Duration(webhookTimeout) * time.Millisecond
+}
+
+// MaxPriority is the highest expression priority a user of role may request.
+func MaxPriority(role string) int {
+	if role == model.RoleAdmin {
+		return maxPriorityAdmin
+	}
+	return maxPriorityUser
+}
+
+// AdminLogins lists the users given the admin role at startup (ADMIN_LOGINS).
+func AdminLogins() []string {
+	return adminLogins
+}
@@ -24,6 +24,11 @@ func InitDB() error {
 		return fmt.Errorf("cannot open db: %w", err)
 	}
 
+	// SQLite allows a single writer; one shared connection serializes
+	// access instead of failing with "database is locked", and keeps a
+	// ":memory:" database from being split across connections.
+	db.SetMaxOpenConns(1)
+
 	if err := db.Ping(); err != nil {
 		return fmt.Errorf("cannot ping db: %w", err)
 	}
@@ -42,7 +47,10 @@ func createTables(db *sql.DB) error {
     CREATE TABLE IF NOT EXISTS users (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         login TEXT NOT NULL UNIQUE,
-        password_hash TEXT NOT NULL
+        password_hash TEXT NOT NULL,
+        role TEXT NOT NULL DEFAULT 'user',
+        webhook_url TEXT,
+        webhook_secret TEXT
     );
     `
 
@@ -54,6 +62,26 @@ func createTables(db *sql.DB) error {
         status TEXT NOT NULL,
         result REAL,
         final_task_id INTEGER,
+        error TEXT,
+        replication INTEGER NOT NULL DEFAULT 1,
+        deadline INTEGER,
+        priority INTEGER NOT NULL DEFAULT 0,
+        unroutable TEXT,
+        callback_url TEXT,
+        batch_id TEXT,
+        label TEXT,
+        created_at INTEGER NOT NULL DEFAULT 0,
+        finished_at INTEGER,
+        FOREIGN KEY(user_id) REFERENCES users(id)
+    );
+    `
+
+	// batches groups expressions submitted by one batch request.
+	batchesTable := `
+    CREATE TABLE IF NOT EXISTS batches (
+        id TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL,
+        created_at INTEGER NOT NULL,
         FOREIGN KEY(user_id) REFERENCES users(id)
     );
     `
@@ -69,8 +97,96 @@ func createTables(db *sql.DB) error {
         arg2_task_id INTEGER,
         result REAL,
         status TEXT NOT NULL,
+        error TEXT,
+        lease_owner TEXT,
+        lease_expires_at INTEGER,
+        pending_deps INTEGER NOT NULL DEFAULT 0,
+        user_id INTEGER NOT NULL DEFAULT 0,
+        priority INTEGER NOT NULL DEFAULT 0,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        last_error TEXT,
+        retry_at INTEGER,
+        replica_of INTEGER,
+        FOREIGN KEY(expression_id) REFERENCES expressions(id)
+    );
+    `
+
+	taskArgsTable := `
+    CREATE TABLE IF NOT EXISTS task_args (
+        task_id INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        value REAL,
+        arg_task_id INTEGER,
+        PRIMARY KEY(task_id, position),
+        FOREIGN KEY(task_id) REFERENCES tasks(id)
+    );
+    `
+
+	taskRunsTable := `
+    CREATE TABLE IF NOT EXISTS task_runs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        task_id INTEGER NOT NULL,
+        agent_id TEXT NOT NULL,
+        result REAL,
+        error TEXT,
+        vote TEXT,
+        created_at INTEGER NOT NULL,
+        FOREIGN KEY(task_id) REFERENCES tasks(id)
+    );
+    `
+
+	expressionTagsTable := `
+    CREATE TABLE IF NOT EXISTS expression_tags (
+        expression_id TEXT NOT NULL,
+        tag TEXT NOT NULL,
+        PRIMARY KEY(expression_id, tag),
         FOREIGN KEY(expression_id) REFERENCES expressions(id)
     );
+    `
+
+	// fair_share remembers when each user last got a task claimed, so
+	// that the scheduler can serve users with ready tasks in turn.
+	fairShareTable := `
+    CREATE TABLE IF NOT EXISTS fair_share (
+        user_id INTEGER PRIMARY KEY,
+        last_served INTEGER NOT NULL DEFAULT 0
+    );
+    `
+
+	// webhook_deliveries queues the webhooks of finished expressions and
+	// keeps them afterwards as the delivery log.
+	webhookDeliveriesTable := `
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        expression_id TEXT NOT NULL,
+        url TEXT NOT NULL,
+        event TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        next_attempt_at INTEGER,
+        response_code INTEGER,
+        last_error TEXT,
+        created_at INTEGER NOT NULL,
+        delivered_at INTEGER,
+        finished_at INTEGER NOT NULL DEFAULT 0
+    );
+    `
+
+	// idempotency_keys maps the Idempotency-Key of a user to the expression
+	// created by the first request with it, until expires_at.
+	idempotencyKeysTable := `
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        user_id INTEGER NOT NULL,
+        key TEXT NOT NULL,
+        request_hash TEXT NOT NULL,
+        expression_id TEXT,
+        status_code INTEGER,
+        created_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL,
+        PRIMARY KEY(user_id, key)
+    );
     `
 
 	if _, err := db.Exec(usersTable); err != nil {
@@ -79,9 +195,163 @@ func createTables(db *sql.DB) error {
 	if _, err := db.Exec(expressionsTable); err != nil {
 		return err
 	}
+	if _, err := db.Exec(batchesTable); err != nil {
+		return err
+	}
 	if _, err := db.Exec(tasksTable); err != nil {
 		return err
 	}
+	if _, err := db.Exec(taskArgsTable); err != nil {
+		return err
+	}
+	if _, err := db.Exec(taskRunsTable); err != nil {
+		return err
+	}
+	if _, err := db.Exec(expressionTagsTable); err != nil {
+		return err
+	}
+	if _, err := db.Exec(fairShareTable); err != nil {
+		return err
+	}
+	if _, err := db.Exec(webhookDeliveriesTable); err != nil {
+		return err
+	}
+	if _, err := db.Exec(idempotencyKeysTable); err != nil {
+		return err
+	}
 
+	return migrate(db)
+}
+
+// columnMigrations lists columns added after the first release. Tables
+// created by an older build get them through ALTER TABLE.
+// A non-empty backfill statement runs once right after the column is added.
+var columnMigrations = []struct {
+	table, column, definition string
+	backfill                  string
+}{
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user'", ""},
+	{"users", "webhook_url", "TEXT", ""},
+	{"users", "webhook_secret", "TEXT", ""},
+	{"expressions", "error", "TEXT", ""},
+	{"expressions", "replication", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"expressions", "deadline", "INTEGER", ""},
+	{"expressions", "priority", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"expressions", "unroutable", "TEXT", ""},
+	{"expressions", "callback_url", "TEXT", ""},
+	{"expressions", "batch_id", "TEXT", ""},
+	{"expressions", "label", "TEXT", ""},
+	{"expressions", "created_at", "INTEGER NOT NULL DEFAULT 0", `
+        UPDATE expressions SET created_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000
+    `},
+	{"expressions", "finished_at", "INTEGER", `
+        UPDATE expressions SET finished_at = created_at WHERE status NOT IN ('PENDING', 'IN_PROGRESS')
+    `},
+	{"tasks", "error", "TEXT", ""},
+	{"tasks", "lease_owner", "TEXT", ""},
+	{"tasks", "lease_expires_at", "INTEGER", ""},
+	{"tasks", "pending_deps", "INTEGER NOT NULL DEFAULT 0", `
+        UPDATE tasks SET pending_deps =
+            (SELECT COUNT(*) FROM tasks d
+             WHERE d.status <> 'DONE' AND d.id IN (tasks.arg1_task_id, tasks.arg2_task_id))
+          + (SELECT COUNT(*) FROM task_args a JOIN tasks d ON d.id = a.arg_task_id
+             WHERE a.task_id = tasks.id AND d.status <> 'DONE')
+    `},
+	{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"tasks", "last_error", "TEXT", ""},
+	{"tasks", "retry_at", "INTEGER", ""},
+	{"tasks", "replica_of", "INTEGER", ""},
+	{"tasks", "user_id", "INTEGER NOT NULL DEFAULT 0", `
+        UPDATE tasks SET user_id =
+            COALESCE((SELECT e.user_id FROM expressions e WHERE e.id = tasks.expression_id), 0);
+        INSERT OR IGNORE INTO fair_share (user_id) SELECT DISTINCT user_id FROM tasks;
+    `},
+	{"tasks", "priority", "INTEGER NOT NULL DEFAULT 0", `
+        UPDATE tasks SET priority =
+            COALESCE((SELECT e.priority FROM expressions e WHERE e.id = tasks.expression_id), 0)
+    `},
+	{"webhook_deliveries", "finished_at", "INTEGER NOT NULL DEFAULT 0", `
+        UPDATE webhook_deliveries SET finished_at = COALESCE((
+            SELECT e.finished_at FROM expressions e WHERE e.id = webhook_deliveries.expression_id
+        ), 0)
+    `},
+}
+
+var indexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_expressions_deadline ON expressions(deadline) WHERE deadline IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_expressions_batch ON expressions(batch_id) WHERE batch_id IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_expressions_user_created ON expressions(user_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_expressions_user_status ON expressions(user_id, status, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_expressions_user_finished ON expressions(user_id, finished_at) WHERE finished_at IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_claim ON tasks(status, pending_deps, id)`,
+	// idx_tasks_ready serves the priority, user and task lookups of a claim.
+	`DROP INDEX IF EXISTS idx_tasks_fair`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_ready ON tasks(status, pending_deps, priority, user_id, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_expression ON tasks(expression_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_fair_share_served ON fair_share(last_served, user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_arg1_task ON tasks(arg1_task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_arg2_task ON tasks(arg2_task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_replica ON tasks(replica_of) WHERE replica_of IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_task_args_task ON task_args(arg_task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_task_runs_task ON task_runs(task_id, agent_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_user ON webhook_deliveries(user_id, id)`,
+	// A reopened expression is reported again when it finishes anew.
+	`DROP INDEX IF EXISTS idx_webhook_deliveries_target`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_deliveries_completion ON webhook_deliveries(expression_id, url, finished_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at)`,
+}
+
+func migrate(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		exists, err := hasColumn(db, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("cannot add %s.%s: %w", m.table, m.column, err)
+		}
+		if m.backfill != "" {
+			if _, err := db.Exec(m.backfill); err != nil {
+				return fmt.Errorf("cannot backfill %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+
+	for _, idx := range indexes {
+		if _, err := db.Exec(idx); err != nil {
+			return fmt.Errorf("cannot create index: %w", err)
+		}
+	}
 	return nil
 }
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,47 @@
+package grpcserver
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+)
+
+func (s *CalcServer) registry() *agents.Registry {
+	if s.Agents != nil {
+		return s.Agents
+	}
+	return agents.Default
+}
+
+func (s *CalcServer) RegisterAgent(ctx context.Context, req *calc.RegisterAgentRequest) (*calc.RegisterAgentResponse, error) {
+	if req.AgentId == "" {
+		return &calc.RegisterAgentResponse{Status: "BAD_REQUEST"}, nil
+	}
+
+	s.registry().Register(agents.Agent{
+		ID:             req.AgentId,
+		Hostname:       req.Hostname,
+		Version:        req.Version,
+		ComputingPower: int(req.ComputingPower),
+		Operations:     req.Operations,
+		Tags:           req.Tags,
+	}, time.Now())
+	log.Printf("[AGENTS] registered %q (%s, version %s, power %d)",
+		req.AgentId, req.Hostname, req.Version, req.ComputingPower)
+
+	return &calc.RegisterAgentResponse{
+		Status:              "OK",
+		HeartbeatIntervalMs: int32(config.HeartbeatInterval().Milliseconds()),
+	}, nil
+}
+
+func (s *CalcServer) Heartbeat(ctx context.Context, req *calc.HeartbeatRequest) (*calc.HeartbeatResponse, error) {
+	if !s.registry().Heartbeat(req.AgentId, time.Now()) {
+		return &calc.HeartbeatResponse{Status: "UNKNOWN_AGENT"}, nil
+	}
+	return &calc.HeartbeatResponse{Status: "OK"}, nil
+}
@@ -0,0 +1,273 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+)
+
+// Metadata keys agents use to authenticate on the gRPC channel.
+const (
+	authorizationKey = "authorization"
+	agentIDKey       = "agent-id"
+)
+
+// Security configures transport security and agent authentication of the
+// gRPC server. The zero value serves plaintext without authentication.
+type Security struct {
+	// CertFile and KeyFile enable TLS.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile additionally requires agents to present a client
+	// certificate signed by this CA (mutual TLS).
+	ClientCAFile string
+
+	// SharedToken is accepted from any agent. Such an agent is held to the
+	// first agent ID it uses on a connection.
+	SharedToken string
+	// AgentTokens maps an agent ID to its own token. An agent authenticated
+	// with its own token may only act under that ID.
+	AgentTokens map[string]string
+}
+
+// SecurityFromEnv reads GRPC_TLS_CERT, GRPC_TLS_KEY, GRPC_TLS_CA,
+// AGENT_TOKEN and AGENT_TOKENS ("id1=token1,id2=token2"). A shared token
+// alone is refused with REPLICATION_FACTOR above 1: one agent could vote
+// under several IDs over several connections.
+func SecurityFromEnv() (Security, error) {
+	sec := Security{
+		CertFile:     os.Getenv("GRPC_TLS_CERT"),
+		KeyFile:      os.Getenv("GRPC_TLS_KEY"),
+		ClientCAFile: os.Getenv("GRPC_TLS_CA"),
+		SharedToken:  os.Getenv("AGENT_TOKEN"),
+	}
+
+	tokens, err := parseAgentTokens(os.Getenv("AGENT_TOKENS"))
+	if err != nil {
+		return Security{}, err
+	}
+	sec.AgentTokens = tokens
+	if sec.SharedToken != "" && len(sec.AgentTokens) == 0 && config.ReplicationFactor() > 1 {
+		return Security{}, fmt.Errorf("REPLICATION_FACTOR above 1 requires AGENT_TOKENS, AGENT_TOKEN cannot tell agents apart")
+	}
+	return sec, nil
+}
+
+func parseAgentTokens(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		id, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || token == "" {
+			return nil, fmt.Errorf("invalid AGENT_TOKENS entry %q, want id=token", pair)
+		}
+		tokens[id] = token
+	}
+	return tokens, nil
+}
+
+func (sec Security) TLSEnabled() bool {
+	return sec.CertFile != "" || sec.KeyFile != ""
+}
+
+func (sec Security) AuthEnabled() bool {
+	return sec.SharedToken != "" || len(sec.AgentTokens) > 0
+}
+
+// ServerOptions returns the gRPC options that apply sec.
+func (sec Security) ServerOptions() ([]grpc.ServerOption, error) {
+	var opts []grpc.ServerOption
+
+	if sec.TLSEnabled() {
+		tlsConfig, err := sec.serverTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if sec.ClientCAFile != "" {
+		return nil, fmt.Errorf("GRPC_TLS_CA requires GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+
+	if sec.SharedToken != "" {
+		opts = append(opts, grpc.StatsHandler(connBinder{}))
+	}
+	if sec.AuthEnabled() {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(sec.unaryInterceptor),
+			grpc.ChainStreamInterceptor(sec.streamInterceptor),
+		)
+	}
+	return opts, nil
+}
+
+func (sec Security) serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(sec.CertFile, sec.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if sec.ClientCAFile != "" {
+		pool, err := loadCertPool(sec.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads PEM certificates from path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// authenticate checks the token in the request metadata. It returns a
+// function checking the agent ID the caller wants to act as.
+func (sec Security) authenticate(ctx context.Context) (func(agentID string) error, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := strings.TrimPrefix(firstValue(md, authorizationKey), "Bearer ")
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing agent token")
+	}
+
+	if sec.SharedToken != "" && tokensEqual(token, sec.SharedToken) {
+		return func(agentID string) error { return bindConn(ctx, agentID) }, nil
+	}
+	bound := firstValue(md, agentIDKey)
+	if expected, ok := sec.AgentTokens[bound]; ok && tokensEqual(token, expected) {
+		return func(agentID string) error { return checkAgentID(bound, agentID) }, nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid agent token")
+}
+
+func (sec Security) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	check, err := sec.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := req.(interface{ GetAgentId() string }); ok {
+		if err := check(r.GetAgentId()); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+func (sec Security) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	check, err := sec.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &boundStream{ServerStream: ss, check: check})
+}
+
+// boundStream rejects hello messages naming another agent than the one the
+// stream was authenticated as.
+type boundStream struct {
+	grpc.ServerStream
+	check func(agentID string) error
+}
+
+func (s *boundStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if msg, ok := m.(*calc.AgentMessage); ok && msg.GetHello() != nil {
+		return s.check(msg.GetHello().GetAgentId())
+	}
+	return nil
+}
+
+func checkAgentID(bound, requested string) error {
+	if requested != bound {
+		return status.Errorf(codes.PermissionDenied, "token of agent %q cannot act as %q", bound, requested)
+	}
+	return nil
+}
+
+type connKey struct{}
+
+// sharedConn is the agent ID a connection authenticated with the shared
+// token acts as.
+type sharedConn struct {
+	mu      sync.Mutex
+	agentID string
+}
+
+// connBinder tags every connection, so that bindConn can hold agents
+// sharing a token to one agent ID per connection.
+type connBinder struct{}
+
+func (connBinder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, connKey{}, &sharedConn{})
+}
+
+func (connBinder) HandleConn(context.Context, stats.ConnStats) {}
+
+func (connBinder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (connBinder) HandleRPC(context.Context, stats.RPCStats) {}
+
+// bindConn binds the connection of ctx to the first agent ID used on it and
+// rejects any other one, so that one connection cannot answer a replicated
+// task as several agents. Requests without an agent ID get no replicas and
+// are let through.
+func bindConn(ctx context.Context, agentID string) error {
+	conn, ok := ctx.Value(connKey{}).(*sharedConn)
+	if !ok || agentID == "" {
+		return nil
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.agentID == "" {
+		conn.agentID = agentID
+		return nil
+	}
+	if agentID != conn.agentID {
+		return status.Errorf(codes.PermissionDenied, "connection of agent %q cannot act as %q", conn.agentID, agentID)
+	}
+	return nil
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
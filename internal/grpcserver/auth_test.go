@@ -0,0 +1,305 @@
+package grpcserver_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/grpcserver"
+	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+type testPKI struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	clientCert tls.Certificate
+	pool       *x509.CertPool
+}
+
+// newTestPKI writes a CA and a localhost server certificate to a temporary
+// directory and returns a client certificate signed by the same CA.
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("create certificate: %v", err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("marshal key: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	}
+
+	p := testPKI{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "server.pem"),
+		keyFile:  filepath.Join(dir, "server-key.pem"),
+		pool:     x509.NewCertPool(),
+	}
+	p.pool.AddCert(caCert)
+
+	serverCert, serverKey := issue(2, "localhost", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := issue(3, "agent-1", x509.ExtKeyUsageClientAuth)
+	files := map[string][]byte{
+		p.caFile:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		p.certFile: serverCert,
+		p.keyFile:  serverKey,
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	p.clientCert, err = tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("load client certificate: %v", err)
+	}
+	return p
+}
+
+func startSecureServer(t *testing.T, sec grpcserver.Security) string {
+	t.Helper()
+	opts, err := sec.ServerOptions()
+	if err != nil {
+		t.Fatalf("ServerOptions error: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	srv := grpcserver.NewGRPCServer(opts...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func dial(t *testing.T, addr string, creds credentials.TransportCredentials) calc.CalcServiceClient {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatalf("grpc.NewClient error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return calc.NewCalcServiceClient(conn)
+}
+
+func withToken(token, agentID string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token, "agent-id", agentID)
+}
+
+func TestSecurity_Tokens(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	addr := startSecureServer(t, grpcserver.Security{
+		SharedToken: "shared-secret",
+		AgentTokens: map[string]string{"agent-1": "token-1"},
+	})
+	client := dial(t, addr, insecure.NewCredentials())
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		agentID string
+		code    codes.Code
+	}{
+		{"no token", context.Background(), "agent-1", codes.Unauthenticated},
+		{"wrong token", withToken("nope", "agent-1"), "agent-1", codes.Unauthenticated},
+		{"token of another agent", withToken("token-1", "agent-2"), "agent-2", codes.Unauthenticated},
+		{"shared token", withToken("shared-secret", "anyone"), "anyone", codes.OK},
+		{"agent token", withToken("token-1", "agent-1"), "agent-1", codes.OK},
+		{"agent token impersonating", withToken("token-1", "agent-1"), "agent-2", codes.PermissionDenied},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.GetTask(tc.ctx, &calc.GetTaskRequest{AgentId: tc.agentID})
+			if code := status.Code(err); code != tc.code {
+				t.Errorf("GetTask code = %v, want %v (err: %v)", code, tc.code, err)
+			}
+		})
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.WorkStream(withToken("token-1", "agent-1"))
+		if err != nil {
+			t.Fatalf("WorkStream error: %v", err)
+		}
+		hello := &calc.AgentMessage{Payload: &calc.AgentMessage_Hello{Hello: &calc.AgentHello{AgentId: "agent-2", Capacity: 1}}}
+		if err := stream.Send(hello); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("hello as another agent: got %v, want PermissionDenied", err)
+		}
+
+		stream, err = client.WorkStream(context.Background())
+		if err != nil {
+			t.Fatalf("WorkStream error: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("stream without token: got %v, want Unauthenticated", err)
+		}
+	})
+}
+
+func TestSecurity_SharedTokenBinding(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	addr := startSecureServer(t, grpcserver.Security{SharedToken: "shared-secret"})
+	ctx := withToken("shared-secret", "")
+
+	// One connection cannot answer replicas as several agents.
+	client := dial(t, addr, insecure.NewCredentials())
+	if _, err := client.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-a"}); err != nil {
+		t.Fatalf("GetTask as agent-a: %v", err)
+	}
+	if _, err := client.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-a"}); err != nil {
+		t.Errorf("GetTask as agent-a again: %v", err)
+	}
+	_, err := client.PostResult(ctx, &calc.PostResultRequest{Id: 1, AgentId: "agent-b"})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("PostResult as agent-b on the connection of agent-a: code = %v, want PermissionDenied", code)
+	}
+
+	stream, err := client.WorkStream(ctx)
+	if err != nil {
+		t.Fatalf("WorkStream error: %v", err)
+	}
+	hello := &calc.AgentMessage{Payload: &calc.AgentMessage_Hello{Hello: &calc.AgentHello{AgentId: "agent-b", Capacity: 1}}}
+	if err := stream.Send(hello); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("hello as agent-b on the connection of agent-a: got %v, want PermissionDenied", err)
+	}
+
+	other := dial(t, addr, insecure.NewCredentials())
+	if _, err := other.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-b"}); err != nil {
+		t.Errorf("GetTask as agent-b on its own connection: %v", err)
+	}
+}
+
+func TestSecurity_MutualTLS(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	pki := newTestPKI(t)
+
+	addr := startSecureServer(t, grpcserver.Security{
+		CertFile:     pki.certFile,
+		KeyFile:      pki.keyFile,
+		ClientCAFile: pki.caFile,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	withCert := dial(t, addr, credentials.NewTLS(&tls.Config{
+		RootCAs:      pki.pool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{pki.clientCert},
+	}))
+	resp, err := withCert.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-1"})
+	if err != nil {
+		t.Fatalf("GetTask with client certificate: %v", err)
+	}
+	if resp.Status != "NO_TASK" {
+		t.Errorf("GetTask status = %s, want NO_TASK", resp.Status)
+	}
+
+	withoutCert := dial(t, addr, credentials.NewTLS(&tls.Config{
+		RootCAs:    pki.pool,
+		ServerName: "localhost",
+	}))
+	if _, err := withoutCert.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-1"}); err == nil {
+		t.Error("GetTask without client certificate must fail")
+	}
+
+	plaintext := dial(t, addr, insecure.NewCredentials())
+	if _, err := plaintext.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-1"}); err == nil {
+		t.Error("GetTask over plaintext must fail")
+	}
+}
+
+func TestSecurity_Options(t *testing.T) {
+	if _, err := (grpcserver.Security{ClientCAFile: "ca.pem"}).ServerOptions(); err == nil {
+		t.Error("client CA without a server certificate must be rejected")
+	}
+	if _, err := (grpcserver.Security{CertFile: "missing.pem", KeyFile: "missing-key.pem"}).ServerOptions(); err == nil {
+		t.Error("missing certificate files must be rejected")
+	}
+
+	t.Setenv("AGENT_TOKENS", "agent-1=token-1, agent-2=token-2")
+	sec, err := grpcserver.SecurityFromEnv()
+	if err != nil {
+		t.Fatalf("SecurityFromEnv error: %v", err)
+	}
+	if len(sec.AgentTokens) != 2 || sec.AgentTokens["agent-2"] != "token-2" {
+		t.Errorf("AgentTokens = %v", sec.AgentTokens)
+	}
+
+	t.Setenv("AGENT_TOKENS", "agent-1")
+	if _, err := grpcserver.SecurityFromEnv(); err == nil {
+		t.Error("malformed AGENT_TOKENS must be rejected")
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"google.golang.org/grpc"
 
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
 	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
@@ -15,46 +18,31 @@ import (
 
 type CalcServer struct {
 	calc.UnimplementedCalcServiceServer
+
+	// Agents is the registry of connected agents; agents.Default if nil.
+	Agents *agents.Registry
 }
 
-func NewGRPCServer() *grpc.Server {
-	s := grpc.NewServer()
-	srv := &CalcServer{}
+func NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	srv := &CalcServer{Agents: agents.Default}
 	calc.RegisterCalcServiceServer(s, srv)
 	return s
 }
 
 func (s *CalcServer) GetTask(ctx context.Context, req *calc.GetTaskRequest) (*calc.GetTaskResponse, error) {
-	task, err := repository.GetNextWaitingTask()
+	caps := model.Capabilities{Operations: req.Operations, Tags: req.Tags}
+	task, err := repository.ClaimNextTaskFor(req.AgentId, caps, config.LeaseDuration)
 	if err != nil {
-		log.Printf("GetNextWaitingTask error: %v", err)
+		log.Printf("ClaimNextTask error: %v", err)
 		return &calc.GetTaskResponse{Status: "ERROR"}, fmt.Errorf("cannot get next task: %w", err)
 	}
 	if task == nil {
 		return &calc.GetTaskResponse{Status: "NO_TASK"}, nil
 	}
+	lease := config.LeaseDuration(task.Op)
 
-	task.Status = model.TaskStatusInProgress
-	if err := repository.UpdateTask(task); err != nil {
-		log.Printf("UpdateTask error: %v", err)
-		return &calc.GetTaskResponse{Status: "ERROR"}, err
-	}
-
-	operationTime := getOperationTime(task.Op)
-
-	a, b := fetchTaskArgs(task)
-
-	resp := &calc.GetTaskResponse{
-		Status: "OK",
-		Task: &calc.TaskData{
-			Id:            int32(task.ID),
-			Arg1:          a,
-			Arg2:          b,
-			Operation:     task.Op,
-			OperationTime: int32(operationTime),
-		},
-	}
-	return resp, nil
+	return &calc.GetTaskResponse{Status: "OK", Task: newTaskData(task, lease)}, nil
 }
 
 func (s *CalcServer) PostResult(ctx context.Context, req *calc.PostResultRequest) (*calc.PostResultResponse, error) {
@@ -67,111 +55,143 @@ func (s *CalcServer) PostResult(ctx context.Context, req *calc.PostResultRequest
 	if task == nil {
 		return &calc.PostResultResponse{Status: "NOT_FOUND"}, nil
 	}
+	if task.Status == model.TaskStatusCancelled {
+		return &calc.PostResultResponse{Status: "CANCELLED"}, nil
+	}
 	if task.Status != model.TaskStatusInProgress {
 		return &calc.PostResultResponse{Status: "BAD_STATUS"}, nil
 	}
+	if task.LeaseOwner != req.AgentId {
+		return &calc.PostResultResponse{Status: "LEASE_LOST"}, nil
+	}
 
 	resultVal := float64(req.Result)
-	task.Result = &resultVal
-	task.Status = model.TaskStatusDone
-	if err := repository.UpdateTask(task); err != nil {
-		log.Printf("UpdateTask error: %v", err)
+	held, err := s.registry().RecordRun(task, req.AgentId, &resultVal, "")
+	if err != nil {
+		log.Printf("RecordRun error: %v", err)
 		return &calc.PostResultResponse{Status: "ERROR"}, err
 	}
+	if !held {
+		return &calc.PostResultResponse{Status: "LEASE_LOST"}, nil
+	}
+	return &calc.PostResultResponse{Status: "OK"}, nil
+}
 
-	expr, err := repository.GetExpressionByIDForTask(task.ExpressionID)
+func (s *CalcServer) ReportError(ctx context.Context, req *calc.ReportErrorRequest) (*calc.ReportErrorResponse, error) {
+	task, err := repository.GetTaskByID(int(req.Id))
 	if err != nil {
-		log.Printf("GetExpressionByIDForTask error: %v", err)
-		return &calc.PostResultResponse{Status: "ERROR"}, err
+		log.Printf("GetTaskByID error: %v", err)
+		return &calc.ReportErrorResponse{Status: "ERROR"}, err
 	}
-	if expr == nil {
-		return &calc.PostResultResponse{Status: "ERROR"}, nil
+	if task == nil {
+		return &calc.ReportErrorResponse{Status: "NOT_FOUND"}, nil
+	}
+	if task.Status == model.TaskStatusCancelled {
+		return &calc.ReportErrorResponse{Status: "CANCELLED"}, nil
+	}
+	if task.Status != model.TaskStatusInProgress {
+		return &calc.ReportErrorResponse{Status: "BAD_STATUS"}, nil
+	}
+	if task.LeaseOwner != req.AgentId {
+		return &calc.ReportErrorResponse{Status: "LEASE_LOST"}, nil
 	}
 
-	if task.Op == "FULL" {
-		expr.Result = &resultVal
-		expr.Status = model.StatusDone
-		_ = repository.UpdateExpression(expr)
-	} else {
-		allDone, lastRes, err := checkAllTasksDone(expr.ID)
-		if err != nil {
-			log.Printf("checkAllTasksDone error: %v", err)
-			return &calc.PostResultResponse{Status: "ERROR"}, err
-		}
-		if allDone {
-			expr.Status = model.StatusDone
-			expr.Result = lastRes
-			_ = repository.UpdateExpression(expr)
+	reason := req.Error
+	if reason == "" {
+		reason = "computation failed"
+	}
+	if req.Transient {
+		if _, err := repository.RetryOrExpireTask(task.ID, req.AgentId, reason, time.Duration(config.OperationTime(task.Op))*time.Millisecond); err != nil {
+			log.Printf("RetryOrExpireTask error: %v", err)
+			return &calc.ReportErrorResponse{Status: "ERROR"}, err
 		}
+		return &calc.ReportErrorResponse{Status: "OK"}, nil
+	}
+	held, err := s.registry().RecordRun(task, req.AgentId, nil, reason)
+	if err != nil {
+		log.Printf("RecordRun error: %v", err)
+		return &calc.ReportErrorResponse{Status: "ERROR"}, err
+	}
+	if !held {
+		return &calc.ReportErrorResponse{Status: "LEASE_LOST"}, nil
 	}
 
-	return &calc.PostResultResponse{Status: "OK"}, nil
+	return &calc.ReportErrorResponse{Status: "OK"}, nil
 }
 
-func fetchTaskArgs(t *model.Task) (float64, float64) {
-	var a, b float64
-
-	if t.Arg1Value != nil {
-		a = *t.Arg1Value
-	} else if t.Arg1TaskID != nil {
-		depTask, _ := repository.GetTaskByID(*t.Arg1TaskID)
-		if depTask != nil && depTask.Result != nil {
-			a = *depTask.Result
-		}
+func (s *CalcServer) RenewLease(ctx context.Context, req *calc.RenewLeaseRequest) (*calc.RenewLeaseResponse, error) {
+	task, err := repository.GetTaskByID(int(req.Id))
+	if err != nil {
+		log.Printf("GetTaskByID error: %v", err)
+		return &calc.RenewLeaseResponse{Status: "ERROR"}, err
 	}
-
-	if t.Arg2Value != nil {
-		b = *t.Arg2Value
-	} else if t.Arg2TaskID != nil {
-		depTask, _ := repository.GetTaskByID(*t.Arg2TaskID)
-		if depTask != nil && depTask.Result != nil {
-			b = *depTask.Result
-		}
+	if task == nil {
+		return &calc.RenewLeaseResponse{Status: "NOT_FOUND"}, nil
+	}
+	if task.Status == model.TaskStatusCancelled {
+		return &calc.RenewLeaseResponse{Status: "CANCELLED"}, nil
 	}
 
-	return a, b
+	lease := config.LeaseDuration(task.Op)
+	renewed, err := repository.RenewLease(task.ID, req.AgentId, lease)
+	if err != nil {
+		log.Printf("RenewLease error: %v", err)
+		return &calc.RenewLeaseResponse{Status: "ERROR"}, err
+	}
+	if !renewed {
+		return &calc.RenewLeaseResponse{Status: "LEASE_LOST"}, nil
+	}
+	return &calc.RenewLeaseResponse{Status: "OK", LeaseMs: int32(lease.Milliseconds())}, nil
 }
 
-func checkAllTasksDone(exprID string) (bool, *float64, error) {
-	tasks, err := repository.GetTasksByExpressionID(exprID)
-	if err != nil {
-		return false, nil, err
+func newTaskData(task *model.Task, lease time.Duration) *calc.TaskData {
+	a, b, args := fetchTaskArgs(task)
+	return &calc.TaskData{
+		Id:            int32(task.ID),
+		Arg1:          a,
+		Arg2:          b,
+		Operation:     task.Op,
+		OperationTime: int32(config.OperationTime(task.Op)),
+		Args:          args,
+		LeaseMs:       int32(lease.Milliseconds()),
+		DeadlineMs:    remainingMs(task.Deadline),
 	}
-	if len(tasks) == 0 {
-		return true, nil, nil
+}
+
+// remainingMs is the time left until deadline, at least 1 ms once it has
+// passed so that it is not mistaken for "no deadline".
+func remainingMs(deadline *time.Time) int64 {
+	if deadline == nil {
+		return 0
 	}
+	return max(time.Until(*deadline).Milliseconds(), 1)
+}
 
-	var lastRes *float64
-	var lastID int
-	allDone := true
+func fetchTaskArgs(t *model.Task) (float64, float64, []float64) {
+	var args []float64
+	for _, arg := range t.Args() {
+		args = append(args, argValue(arg))
+	}
 
-	for _, t := range tasks {
-		if t.Status != model.TaskStatusDone {
-			allDone = false
-		}
-		if t.ID > lastID && t.Result != nil {
-			lastRes = t.Result
-			lastID = t.ID
-		}
+	var a, b float64
+	a = args[0]
+	if len(args) > 1 {
+		b = args[1]
 	}
-	return allDone, lastRes, nil
+	return a, b, args
 }
 
-func getOperationTime(op string) int {
-	switch op {
-	case "+", "ADD":
-		return 1000
-	case "-", "SUB":
-		return 1200
-	case "*", "MUL":
-		return 2000
-	case "/", "DIV":
-		return 2500
-	case "FULL":
-		return 3000
-	default:
-		return 1000
+func argValue(arg model.TaskArg) float64 {
+	if arg.Value != nil {
+		return *arg.Value
+	}
+	if arg.TaskID != nil {
+		depTask, _ := repository.GetTaskByID(*arg.TaskID)
+		if depTask != nil && depTask.Result != nil {
+			return *depTask.Result
+		}
 	}
+	return 0
 }
 
 func StartGRPCServer(addr string) {
@@ -180,8 +200,24 @@ func StartGRPCServer(addr string) {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	s := NewGRPCServer()
-	log.Printf("Starting gRPC server on %s...", addr)
+	sec, err := SecurityFromEnv()
+	if err != nil {
+		log.Fatalf("invalid gRPC security settings: %v", err)
+	}
+	opts, err := sec.ServerOptions()
+	if err != nil {
+		log.Fatalf("cannot configure gRPC security: %v", err)
+	}
+	if !sec.TLSEnabled() {
+		log.Printf("[WARN] gRPC server runs without TLS; set GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+	if !sec.AuthEnabled() {
+		log.Printf("[WARN] gRPC server accepts unauthenticated agents; set AGENT_TOKEN or AGENT_TOKENS")
+	}
+
+	s := NewGRPCServer(opts...)
+	log.Printf("Starting gRPC server on %s (tls=%t, mtls=%t, auth=%t)...",
+		addr, sec.TLSEnabled(), sec.ClientCAFile != "", sec.AuthEnabled())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
@@ -0,0 +1,413 @@
+package grpcserver_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/grpcserver"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/scheduler"
+)
+
+const testUserID int64 = 1
+
+func TestMain(m *testing.M) {
+	os.Setenv("DB_PATH", ":memory:")
+
+	if err := db.InitDB(); err != nil {
+		log.Fatal("failed to init db:", err)
+	}
+
+	code := m.Run()
+	os.Exit(code)
+}
+
+func TestLeaseReassignment(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	expr, err := repository.CreateExpression("2*3", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	two, three := 2.0, 3.0
+	task, err := repository.CreateTaskWithArgs(expr.ID, "*", &two, nil, &three, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	expr.Status = model.StatusInProgress
+	expr.FinalTaskID = task.ID
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	// Retry right away, the lease is expired an hour ahead of time.
+	defer func(p repository.RetryPolicy) { repository.Retry = p }(repository.Retry)
+	repository.Retry = repository.RetryPolicy{MaxRetries: 3}
+
+	srv := &grpcserver.CalcServer{}
+	ctx := context.Background()
+
+	first, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-a"})
+	if err != nil {
+		t.Fatalf("GetTask error: %v", err)
+	}
+	if first.Status != "OK" || first.Task.LeaseMs <= 0 {
+		t.Fatalf("GetTask = %s with lease %d ms, want OK with a lease", first.Status, first.Task.LeaseMs)
+	}
+
+	if _, err := repository.RequeueExpiredLeases(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RequeueExpiredLeases error: %v", err)
+	}
+
+	second, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-b"})
+	if err != nil {
+		t.Fatalf("GetTask error: %v", err)
+	}
+	if second.Status != "OK" || second.Task.Id != first.Task.Id {
+		t.Fatalf("expired task was not handed to agent-b: %v", second)
+	}
+
+	renew, err := srv.RenewLease(ctx, &calc.RenewLeaseRequest{Id: first.Task.Id, AgentId: "agent-a"})
+	if err != nil {
+		t.Fatalf("RenewLease error: %v", err)
+	}
+	if renew.Status != "LEASE_LOST" {
+		t.Errorf("RenewLease by agent-a = %s, want LEASE_LOST", renew.Status)
+	}
+
+	late, err := srv.PostResult(ctx, &calc.PostResultRequest{Id: first.Task.Id, Result: 6, AgentId: "agent-a"})
+	if err != nil {
+		t.Fatalf("PostResult error: %v", err)
+	}
+	if late.Status != "LEASE_LOST" {
+		t.Errorf("late PostResult by agent-a = %s, want LEASE_LOST", late.Status)
+	}
+
+	renew, err = srv.RenewLease(ctx, &calc.RenewLeaseRequest{Id: second.Task.Id, AgentId: "agent-b"})
+	if err != nil {
+		t.Fatalf("RenewLease error: %v", err)
+	}
+	if renew.Status != "OK" || renew.LeaseMs <= 0 {
+		t.Errorf("RenewLease by agent-b = %s, %d ms; want OK", renew.Status, renew.LeaseMs)
+	}
+
+	done, err := srv.PostResult(ctx, &calc.PostResultRequest{Id: second.Task.Id, Result: 6, AgentId: "agent-b"})
+	if err != nil {
+		t.Fatalf("PostResult error: %v", err)
+	}
+	if done.Status != "OK" {
+		t.Fatalf("PostResult by agent-b = %s, want OK", done.Status)
+	}
+
+	got, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID error: %v", err)
+	}
+	if got.Status != model.StatusDone || got.Result == nil || *got.Result != 6 {
+		t.Errorf("expression = %s %v, want DONE 6", got.Status, got.Result)
+	}
+}
+
+func TestAgentHeartbeats(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	registry := agents.NewRegistry()
+	srv := &grpcserver.CalcServer{Agents: registry}
+	ctx := context.Background()
+
+	hb, err := srv.Heartbeat(ctx, &calc.HeartbeatRequest{AgentId: "agent-hb"})
+	if err != nil {
+		t.Fatalf("Heartbeat error: %v", err)
+	}
+	if hb.Status != "UNKNOWN_AGENT" {
+		t.Errorf("Heartbeat before registration = %s, want UNKNOWN_AGENT", hb.Status)
+	}
+
+	reg, err := srv.RegisterAgent(ctx, &calc.RegisterAgentRequest{
+		AgentId:        "agent-hb",
+		Hostname:       "host-1",
+		Version:        "test",
+		ComputingPower: 4,
+		Operations:     []string{"+", "sqrt"},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAgent error: %v", err)
+	}
+	if reg.Status != "OK" || reg.HeartbeatIntervalMs <= 0 {
+		t.Fatalf("RegisterAgent = %s, %d ms", reg.Status, reg.HeartbeatIntervalMs)
+	}
+	a, ok := registry.Get("agent-hb")
+	if !ok || a.Hostname != "host-1" || a.ComputingPower != 4 || len(a.Operations) != 2 {
+		t.Fatalf("registry entry = %+v", a)
+	}
+
+	hb, err = srv.Heartbeat(ctx, &calc.HeartbeatRequest{AgentId: "agent-hb"})
+	if err != nil || hb.Status != "OK" {
+		t.Fatalf("Heartbeat = %v, %v; want OK", hb, err)
+	}
+
+	expr, err := repository.CreateExpression("1+1", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	one := 1.0
+	if _, err := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil); err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	got, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-hb"})
+	if err != nil || got.Status != "OK" {
+		t.Fatalf("GetTask = %v, %v", got, err)
+	}
+
+	monitorCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go scheduler.StartAgentMonitor(monitorCtx, registry, 10*time.Millisecond, 50*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		task, err := repository.GetTaskByID(int(got.Task.Id))
+		if err != nil {
+			t.Fatalf("GetTaskByID error: %v", err)
+		}
+		if task.Status == model.TaskStatusWaiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task of a dead agent stays %s", task.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if a, _ := registry.Get("agent-hb"); a.Status != agents.StatusDead {
+		t.Errorf("agent status = %s, want %s", a.Status, agents.StatusDead)
+	}
+	hb, _ = srv.Heartbeat(ctx, &calc.HeartbeatRequest{AgentId: "agent-hb"})
+	if hb.Status != "UNKNOWN_AGENT" {
+		t.Errorf("Heartbeat of a dead agent = %s, want UNKNOWN_AGENT", hb.Status)
+	}
+}
+
+func TestReplicatedVoting(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	expr, err := repository.CreateExpression("2*3", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	if err := repository.SetExpressionReplication(expr.ID, 3); err != nil {
+		t.Fatalf("SetExpressionReplication error: %v", err)
+	}
+	two, three := 2.0, 3.0
+	task, err := repository.CreateTaskWithArgs(expr.ID, "*", &two, nil, &three, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	expr.Status = model.StatusInProgress
+	expr.FinalTaskID = task.ID
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	registry := agents.NewRegistry()
+	srv := &grpcserver.CalcServer{Agents: registry}
+	ctx := context.Background()
+
+	// One agent cannot vote alone.
+	registry.Register(agents.Agent{ID: "honest-1"}, time.Now())
+	if err := scheduler.CheckRouting(registry); err != nil {
+		t.Fatalf("CheckRouting error: %v", err)
+	}
+	want := "replication needs 3 distinct agents, only 1 live agent(s) can execute *"
+	if e, _ := repository.GetExpressionByID(testUserID, expr.ID); e.Unroutable != want {
+		t.Errorf("unroutable = %q, want %q", e.Unroutable, want)
+	}
+
+	answers := map[string]float64{"honest-1": 6, "faulty": 7, "honest-2": 6}
+	for _, agentID := range []string{"honest-1", "faulty", "honest-2"} {
+		registry.Register(agents.Agent{ID: agentID}, time.Now())
+
+		got, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: agentID})
+		if err != nil || got.Status != "OK" {
+			t.Fatalf("GetTask(%s) = %v, %v", agentID, got, err)
+		}
+		if again, _ := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: agentID}); again.Status != "NO_TASK" {
+			t.Fatalf("task leased to %s is given out twice", agentID)
+		}
+
+		resp, err := srv.PostResult(ctx, &calc.PostResultRequest{Id: got.Task.Id, Result: answers[agentID], AgentId: agentID})
+		if err != nil || resp.Status != "OK" {
+			t.Fatalf("PostResult(%s) = %v, %v", agentID, resp, err)
+		}
+		if again, _ := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: agentID}); again.Status != "NO_TASK" {
+			t.Fatalf("%s got the task it already computed", agentID)
+		}
+	}
+
+	stored, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID error: %v", err)
+	}
+	if stored.Status != model.StatusDone || stored.Result == nil || *stored.Result != 6 {
+		t.Fatalf("expression = %s %v, want DONE 6", stored.Status, stored.Result)
+	}
+
+	faulty, _ := registry.Get("faulty")
+	if faulty.Reputation != agents.InitialReputation-agents.ReputationPenalty || faulty.VotesLost != 1 {
+		t.Errorf("faulty agent = %+v, want one lost vote", faulty)
+	}
+	honest, _ := registry.Get("honest-1")
+	if honest.Reputation != agents.InitialReputation || honest.VotesWon != 1 {
+		t.Errorf("honest agent = %+v, want one won vote", honest)
+	}
+}
+
+func TestCancelledTask(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	expr, err := repository.CreateExpression("1+1", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	one := 1.0
+	if _, err := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil); err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	expr.Status = model.StatusInProgress
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	srv := &grpcserver.CalcServer{Agents: agents.NewRegistry()}
+	ctx := context.Background()
+	got, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "agent-a"})
+	if err != nil || got.Status != "OK" {
+		t.Fatalf("GetTask = %v, %v", got, err)
+	}
+
+	if _, err := repository.CancelExpression(testUserID, expr.ID); err != nil {
+		t.Fatalf("CancelExpression error: %v", err)
+	}
+
+	renew, err := srv.RenewLease(ctx, &calc.RenewLeaseRequest{Id: got.Task.Id, AgentId: "agent-a"})
+	if err != nil || renew.Status != "CANCELLED" {
+		t.Errorf("RenewLease = %v, %v; want CANCELLED", renew, err)
+	}
+	post, err := srv.PostResult(ctx, &calc.PostResultRequest{Id: got.Task.Id, Result: 2, AgentId: "agent-a"})
+	if err != nil || post.Status != "CANCELLED" {
+		t.Errorf("PostResult = %v, %v; want CANCELLED", post, err)
+	}
+	report, err := srv.ReportError(ctx, &calc.ReportErrorRequest{Id: got.Task.Id, Error: "boom", AgentId: "agent-a"})
+	if err != nil || report.Status != "CANCELLED" {
+		t.Errorf("ReportError = %v, %v; want CANCELLED", report, err)
+	}
+
+	stored, _ := repository.GetExpressionByID(testUserID, expr.ID)
+	if stored.Status != model.StatusCancelled || stored.Result != nil {
+		t.Errorf("expression = %s %v, want CANCELLED without result", stored.Status, stored.Result)
+	}
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	four := 4.0
+	root, err := repository.CreateExpression("sqrt(4)", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	if _, err := repository.CreateTask(root.ID, "sqrt", []model.TaskArg{{Value: &four}}); err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+	precise, err := repository.CreateExpression("4+4", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	if err := repository.SetExpressionTags(precise.ID, []string{"high-precision"}); err != nil {
+		t.Fatalf("SetExpressionTags error: %v", err)
+	}
+	if _, err := repository.CreateTaskWithArgs(precise.ID, "+", &four, nil, &four, nil); err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+
+	other, err := repository.CreateExpression("sqrt(4)", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	if _, err := repository.CreateTask(other.ID, "sqrt", []model.TaskArg{{Value: &four}}); err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+
+	registry := agents.NewRegistry()
+	srv := &grpcserver.CalcServer{Agents: registry}
+	ctx := context.Background()
+
+	// Agents polling without registering may compute anything.
+	if err := scheduler.CheckRouting(registry); err != nil {
+		t.Fatalf("CheckRouting error: %v", err)
+	}
+	if e, _ := repository.GetExpressionByID(testUserID, root.ID); e.Unroutable != "" {
+		t.Errorf("flagged without registered agents: %q", e.Unroutable)
+	}
+
+	adder := &calc.RegisterAgentRequest{AgentId: "adder", Operations: []string{"+", "-"}}
+	if _, err := srv.RegisterAgent(ctx, adder); err != nil {
+		t.Fatalf("RegisterAgent error: %v", err)
+	}
+
+	got, err := srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "adder", Operations: adder.Operations})
+	if err != nil || got.Status != "NO_TASK" {
+		t.Fatalf("adder without tags: GetTask = %v, %v; want NO_TASK", got, err)
+	}
+
+	if err := scheduler.CheckRouting(registry); err != nil {
+		t.Fatalf("CheckRouting error: %v", err)
+	}
+	for _, id := range []string{root.ID, other.ID} {
+		if e, _ := repository.GetExpressionByID(testUserID, id); e.Unroutable != "no live agent can execute sqrt" {
+			t.Errorf("sqrt expression %s unroutable = %q", id, e.Unroutable)
+		}
+	}
+	stuck, _ := repository.GetExpressionByID(testUserID, precise.ID)
+	if stuck.Unroutable != "no live agent can execute + with tags high-precision" {
+		t.Errorf("tagged expression unroutable = %q", stuck.Unroutable)
+	}
+
+	precision := &calc.RegisterAgentRequest{AgentId: "precision", Tags: []string{"high-precision"}}
+	if _, err := srv.RegisterAgent(ctx, precision); err != nil {
+		t.Fatalf("RegisterAgent error: %v", err)
+	}
+	if err := scheduler.CheckRouting(registry); err != nil {
+		t.Fatalf("CheckRouting error: %v", err)
+	}
+	for _, id := range []string{root.ID, other.ID, precise.ID} {
+		if e, _ := repository.GetExpressionByID(testUserID, id); e.Unroutable != "" {
+			t.Errorf("expression %s still unroutable: %q", id, e.Unroutable)
+		}
+	}
+
+	got, err = srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "precision", Operations: []string{"+"}, Tags: precision.Tags})
+	if err != nil || got.Status != "OK" || got.Task.Operation != "+" {
+		t.Fatalf("precision agent: GetTask = %v, %v; want the + task", got, err)
+	}
+	got, err = srv.GetTask(ctx, &calc.GetTaskRequest{AgentId: "precision", Tags: precision.Tags})
+	if err != nil || got.Status != "OK" || got.Task.Operation != "sqrt" {
+		t.Fatalf("precision agent: GetTask = %v, %v; want the sqrt task", got, err)
+	}
+}
@@ -0,0 +1,232 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+	calc "github.com/TuHeKocmoc/yalyceumfinal2/internal/proto"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// streamPollInterval is a safety net for readiness changes that are not
+// broadcast, e.g. made by another process sharing the database.
+const streamPollInterval = time.Second
+
+type workStream struct {
+	srv      *CalcServer
+	stream   calc.CalcService_WorkStreamServer
+	agentID  string
+	capacity int
+	caps     model.Capabilities
+
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	inflight map[int32]bool
+	freed    chan struct{}
+}
+
+// WorkStream pushes ready tasks to the agent as long as it has fewer than
+// its declared capacity in flight, and accepts results on the same stream.
+// Tasks still in flight when the stream ends are returned to the queue.
+func (s *CalcServer) WorkStream(stream calc.CalcService_WorkStreamServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := first.GetHello()
+	if hello == nil {
+		return status.Error(codes.InvalidArgument, "first message must be hello")
+	}
+
+	ws := &workStream{
+		srv:      s,
+		stream:   stream,
+		agentID:  hello.AgentId,
+		capacity: int(hello.Capacity),
+		caps:     model.Capabilities{Operations: hello.Operations, Tags: hello.Tags},
+		inflight: make(map[int32]bool),
+		freed:    make(chan struct{}, 1),
+	}
+	if ws.capacity < 1 {
+		ws.capacity = 1
+	}
+	log.Printf("[STREAM] agent %q connected, capacity=%d", ws.agentID, ws.capacity)
+
+	ctx := stream.Context()
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- ws.receive(ctx)
+	}()
+
+	err = ws.dispatch(ctx, recvErr)
+	ws.releaseAll()
+	log.Printf("[STREAM] agent %q disconnected", ws.agentID)
+	return err
+}
+
+func (ws *workStream) dispatch(ctx context.Context, recvErr <-chan error) error {
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var ready <-chan struct{}
+		if ws.free() {
+			ready = notify.TasksReady.Wait()
+
+			task, err := repository.ClaimNextTaskFor(ws.agentID, ws.caps, config.LeaseDuration)
+			if err != nil {
+				log.Printf("ClaimNextTask error: %v", err)
+				return status.Errorf(codes.Internal, "cannot claim task: %v", err)
+			}
+			if task != nil {
+				ws.track(int32(task.ID))
+				msg := &calc.ServerMessage{
+					Payload: &calc.ServerMessage_Task{Task: newTaskData(task, config.LeaseDuration(task.Op))},
+				}
+				if err := ws.send(msg); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-recvErr:
+			return err
+		case <-ws.freed:
+		case <-ready:
+		case <-ticker.C:
+			ws.prune()
+		}
+	}
+}
+
+func (ws *workStream) receive(ctx context.Context) error {
+	for {
+		msg, err := ws.stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var id int32
+		var st string
+		switch p := msg.Payload.(type) {
+		case *calc.AgentMessage_Result:
+			p.Result.AgentId = ws.agentID
+			id = p.Result.Id
+			resp, err := ws.srv.PostResult(ctx, p.Result)
+			st = resp.GetStatus()
+			if err != nil {
+				st = "ERROR"
+			}
+			ws.finish(id)
+		case *calc.AgentMessage_Error:
+			p.Error.AgentId = ws.agentID
+			id = p.Error.Id
+			resp, err := ws.srv.ReportError(ctx, p.Error)
+			st = resp.GetStatus()
+			if err != nil {
+				st = "ERROR"
+			}
+			ws.finish(id)
+		case *calc.AgentMessage_Renew:
+			p.Renew.AgentId = ws.agentID
+			id = p.Renew.Id
+			resp, err := ws.srv.RenewLease(ctx, p.Renew)
+			st = resp.GetStatus()
+			if err != nil {
+				st = "ERROR"
+			}
+			if st == "CANCELLED" || st == "NOT_FOUND" {
+				// The agent drops the task, so it no longer takes a slot.
+				ws.finish(id)
+			}
+		default:
+			continue
+		}
+
+		ack := &calc.ServerMessage{Payload: &calc.ServerMessage_Ack{Ack: &calc.TaskAck{Id: id, Status: st}}}
+		if err := ws.send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+func (ws *workStream) send(msg *calc.ServerMessage) error {
+	ws.sendMu.Lock()
+	defer ws.sendMu.Unlock()
+	return ws.stream.Send(msg)
+}
+
+func (ws *workStream) free() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.inflight) < ws.capacity
+}
+
+func (ws *workStream) track(id int32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.inflight[id] = true
+}
+
+func (ws *workStream) finish(id int32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.inflight[id] {
+		return
+	}
+	delete(ws.inflight, id)
+	select {
+	case ws.freed <- struct{}{}:
+	default:
+	}
+}
+
+// prune frees the slots of tasks the agent no longer holds, e.g. cancelled
+// when their expression timed out while the agent abandoned them.
+func (ws *workStream) prune() {
+	ws.mu.Lock()
+	ids := make([]int32, 0, len(ws.inflight))
+	for id := range ws.inflight {
+		ids = append(ids, id)
+	}
+	ws.mu.Unlock()
+
+	for _, id := range ids {
+		task, err := repository.GetTaskByID(int(id))
+		if err != nil {
+			log.Printf("GetTaskByID error: %v", err)
+			continue
+		}
+		if task == nil || task.Status != model.TaskStatusInProgress || task.LeaseOwner != ws.agentID {
+			ws.finish(id)
+		}
+	}
+}
+
+func (ws *workStream) releaseAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for id := range ws.inflight {
+		if _, err := repository.ReleaseTask(int(id), ws.agentID); err != nil {
+			log.Printf("ReleaseTask error: %v", err)
+		}
+		delete(ws.inflight, id)
+	}
+}
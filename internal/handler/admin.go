@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+type responseTaskList struct {
+	Tasks []*model.Task `json:"tasks"`
+}
+
+type responseSingleTask struct {
+	Task *model.Task `json:"task"`
+}
+
+// HandleAdmin serves the endpoints available to admins only:
+// GET /api/v1/admin/tasks/dead and POST /api/v1/admin/tasks/{id}/requeue.
+func HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	role, err := userRole(userID)
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		return
+	}
+	if role != model.RoleAdmin {
+		http.Error(w, "admin role required", http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/api/v1/admin/tasks/dead":
+		handleGetDeadTasks(w, r)
+	case strings.HasPrefix(path, "/api/v1/admin/tasks/") && strings.HasSuffix(path, "/requeue"):
+		handleRequeueTask(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleGetDeadTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks, err := repository.GetDeadTasks()
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] GetDeadTasks error: %v", err)
+		return
+	}
+	if tasks == nil {
+		tasks = []*model.Task{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(responseTaskList{Tasks: tasks})
+}
+
+func handleRequeueTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /api/v1/admin/tasks/{id}/requeue
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 7 {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	taskID, err := strconv.Atoi(parts[5])
+	if err != nil {
+		http.Error(w, "id must be an integer", http.StatusBadRequest)
+		return
+	}
+
+	task, requeued, err := repository.RequeueDeadTask(taskID)
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] RequeueDeadTask error: %v", err)
+		return
+	}
+	if task == nil {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if !requeued {
+		http.Error(w, "task is not dead", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(responseSingleTask{Task: task})
+}
@@ -106,6 +106,18 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Browsers keep the token in a cookie scripts cannot read, so the pages
+	// and EventSource are authorized without putting it in URLs.
+	http.SetCookie(w, &http.Cookie{
+		Name:     AccessTokenCookie,
+		Value:    tokenStr,
+		Path:     "/",
+		MaxAge:   int(tokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
 	resp := loginResponse{Token: tokenStr}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
@@ -116,7 +128,7 @@ func generateJWT(u *model.User) (string, error) {
 		UserID: u.ID,
 		Login:  u.Login,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -125,13 +137,26 @@ func generateJWT(u *model.User) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// tokenTTL is how long a token issued on login is valid.
+const tokenTTL = 24 * time.Hour
+
+// AccessTokenCookie is the cookie holding the token of a browser.
+const AccessTokenCookie = "access_token"
+
 type contextKey string
 
 const UserIDCtxKey contextKey = "userID"
 
+// AuthMiddleware accepts the JWT in the Authorization header or, for
+// browsers, in the cookie set on login.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		header := r.Header.Get("Authorization")
+		if header == "" {
+			if c, err := r.Cookie(AccessTokenCookie); err == nil && c.Value != "" {
+				header = "Bearer " + c.Value
+			}
+		}
 		if header == "" {
 			http.Error(w, "missing Authorization header", http.StatusUnauthorized)
 			return
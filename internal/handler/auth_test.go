@@ -114,6 +114,37 @@ func TestGetExpression_AnotherUser_NotFound(t *testing.T) {
 	if respExprB.StatusCode != http.StatusNotFound {
 		t.Fatalf("expected 404, got %d", respExprB.StatusCode)
 	}
+
+	// Tokens in URLs end up in logs and browser history.
+	respQuery, err := http.Get(urlExpr + "?access_token=" + tokenA.Token)
+	if err != nil {
+		t.Fatalf("userA GET expression error: %v", err)
+	}
+	respQuery.Body.Close()
+	if respQuery.StatusCode != http.StatusUnauthorized {
+		t.Errorf("access_token query: expected 401, got %d", respQuery.StatusCode)
+	}
+
+	// Browsers send the cookie set on login instead.
+	var cookie *http.Cookie
+	for _, c := range respLoginA.Cookies() {
+		if c.Name == handler.AccessTokenCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != tokenA.Token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("login cookie = %+v, want an HttpOnly SameSite=Strict cookie with the token", cookie)
+	}
+	reqCookie, _ := http.NewRequest(http.MethodGet, urlExpr, nil)
+	reqCookie.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	respExprA, err := client.Do(reqCookie)
+	if err != nil {
+		t.Fatalf("userA GET expression error: %v", err)
+	}
+	defer respExprA.Body.Close()
+	if respExprA.StatusCode != http.StatusOK {
+		t.Fatalf("cookie: expected 200, got %d", respExprA.StatusCode)
+	}
 }
 
 func TestNoToken_AuthEndpoint(t *testing.T) {
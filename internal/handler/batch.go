@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// maxLabelLength bounds the client-side label of a batch item, in bytes.
+const maxLabelLength = 200
+
+// Codes of the batch item errors that are not about the expression itself.
+const (
+	errCodeInvalidRequest = "INVALID_REQUEST"
+	errCodeForbidden      = "FORBIDDEN"
+)
+
+type requestBatchItem struct {
+	requestExpression
+	// Label is chosen by the client to recognize the item.
+	Label string `json:"label"`
+}
+
+type requestBatch struct {
+	Expressions []requestBatchItem `json:"expressions"`
+}
+
+type responseBatchItem struct {
+	Label string `json:"label,omitempty"`
+	ID    string `json:"id,omitempty"`
+	// Error tells why the item was rejected: the *parser.Error of an
+	// invalid expression or a *batchItemError.
+	Error error `json:"error,omitempty"`
+}
+
+type responseCreateBatch struct {
+	// BatchID is empty when every item was rejected.
+	BatchID  string              `json:"batch_id,omitempty"`
+	Accepted int                 `json:"accepted"`
+	Rejected int                 `json:"rejected"`
+	Items    []responseBatchItem `json:"items"`
+}
+
+type responseBatch struct {
+	Batch *model.Batch `json:"batch"`
+}
+
+// batchItemError rejects a batch item for a reason other than its
+// expression, with one of the errCode* codes. Unlike a parser.Error it has
+// no position.
+type batchItemError struct {
+	Code string `json:"code"`
+	Msg  string `json:"message"`
+}
+
+func (e *batchItemError) Error() string {
+	return e.Msg
+}
+
+// itemError describes a rejected batch item.
+func itemError(err error) error {
+	var perr *parser.Error
+	if errors.As(err, &perr) {
+		return perr
+	}
+	var rerr *requestError
+	if errors.As(err, &rerr) && rerr.status == http.StatusForbidden {
+		return &batchItemError{Code: errCodeForbidden, Msg: rerr.msg}
+	}
+	return &batchItemError{Code: errCodeInvalidRequest, Msg: err.Error()}
+}
+
+// HandleCreateBatch accepts many expressions at once: POST
+// /api/v1/calculate/batch. The valid ones are stored and planned in a single
+// transaction, the others are reported item by item.
+func HandleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req requestBatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Expressions) == 0 {
+		http.Error(w, "batch has no expressions", http.StatusBadRequest)
+		return
+	}
+	if limit := config.MaxBatchSize(); len(req.Expressions) > limit {
+		http.Error(w, fmt.Sprintf("batch must not have more than %d expressions", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The role is looked up once and before the batch takes the database
+	// connection.
+	var role string
+	var roleErr error
+	roleOf := func() (string, error) {
+		if role == "" && roleErr == nil {
+			role, roleErr = userRole(userID)
+		}
+		return role, roleErr
+	}
+
+	now := time.Now()
+	resp := responseCreateBatch{Items: make([]responseBatchItem, len(req.Expressions))}
+	valid := make([]*validExpression, len(req.Expressions))
+	for i := range req.Expressions {
+		item := &req.Expressions[i]
+		resp.Items[i].Label = item.Label
+
+		var err error
+		if len(item.Label) > maxLabelLength {
+			err = badRequest("label must not be longer than %d bytes", maxLabelLength)
+		} else {
+			valid[i], err = item.validate(now, roleOf)
+		}
+		if err == nil {
+			resp.Accepted++
+			continue
+		}
+		var rerr *requestError
+		var perr *parser.Error
+		if !errors.As(err, &rerr) && !errors.As(err, &perr) {
+			writeRequestError(w, err)
+			return
+		}
+		resp.Items[i].Error = itemError(err)
+		resp.Rejected++
+	}
+
+	if resp.Accepted == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	batchID, err := createBatch(userID, req.Expressions, valid, resp.Items)
+	if err != nil {
+		http.Error(w, "cannot create batch", http.StatusInternalServerError)
+		log.Printf("[DEBUG] createBatch error: %v", err)
+		return
+	}
+	resp.BatchID = batchID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// createBatch stores and plans the valid items in one transaction and fills
+// in their IDs.
+func createBatch(userID int64, items []requestBatchItem, valid []*validExpression, out []responseBatchItem) (string, error) {
+	b, err := repository.BeginBatch(userID)
+	if err != nil {
+		return "", err
+	}
+	defer b.Rollback()
+
+	for i, v := range valid {
+		if v == nil {
+			continue
+		}
+		expr, err := createExpressionTx(b, &items[i].requestExpression, items[i].Label, v)
+		if err != nil {
+			return "", err
+		}
+		out[i].ID = expr.ID
+	}
+
+	if err := b.Commit(); err != nil {
+		return "", err
+	}
+	return b.ID, nil
+}
+
+// HandleGetBatch returns the aggregate status of a batch together with its
+// expressions: GET /api/v1/batches/{id}.
+func HandleGetBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /api/v1/batches/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	batch, err := repository.GetBatch(userID, parts[4])
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] GetBatch error: %v", err)
+		return
+	}
+	if batch == nil {
+		http.Error(w, "batch not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(responseBatch{Batch: batch})
+}
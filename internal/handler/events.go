@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// sseKeepAlive is how often an idle stream sends a comment, so that proxies
+// do not take it for a dead connection.
+const sseKeepAlive = 15 * time.Second
+
+// Names of the Server-Sent Events.
+const (
+	sseTask       = "task"
+	sseExpression = "expression"
+	sseResult     = "result"
+	sseDeleted    = "deleted"
+)
+
+type responseTaskEvent struct {
+	Task     *model.Task     `json:"task"`
+	Progress *model.Progress `json:"progress,omitempty"`
+}
+
+type responseDeletedEvent struct {
+	ID string `json:"id"`
+}
+
+// isLast reports whether e is the last event of its expression: the final
+// result or the deletion.
+func isLast(e notify.Event) bool {
+	return e.Type == notify.EventDeleted || e.Type == notify.EventExpression && e.Expression.Finished()
+}
+
+// HandleExpressionEvents streams the changes of one expression as
+// Server-Sent Events: GET /api/v1/expressions/{id}/events. The current state
+// comes first; the stream ends after the final result.
+func HandleExpressionEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /api/v1/expressions/{id}/events
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 6 || parts[4] == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	exprID := parts[4]
+
+	// Subscribe before reading the expression, so that nothing happening in
+	// between is missed.
+	events, unsubscribe := notify.Events.Subscribe(userID)
+	defer unsubscribe()
+
+	expr, err := repository.GetExpressionByID(userID, exprID)
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] GetExpressionByID error: %v", err)
+		return
+	}
+	if expr == nil {
+		http.Error(w, "expression not found", http.StatusNotFound)
+		return
+	}
+
+	if !startStream(w) {
+		return
+	}
+	if !writeEvent(w, notify.Event{Type: notify.EventExpression, ExpressionID: expr.ID, Expression: expr}) {
+		return
+	}
+	if expr.Finished() {
+		return
+	}
+	streamEvents(w, r, events, exprID)
+}
+
+// HandleEvents streams the changes of all expressions of the user as
+// Server-Sent Events: GET /api/v1/expressions/events.
+func HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	events, unsubscribe := notify.Events.Subscribe(userID)
+	defer unsubscribe()
+
+	if !startStream(w) {
+		return
+	}
+	streamEvents(w, r, events, "")
+}
+
+func startStream(w http.ResponseWriter) bool {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	return true
+}
+
+// streamEvents writes the events of exprID, or of any expression if it is
+// empty, until the client leaves or the last event of exprID is sent. It
+// also returns when the subscription is dropped for falling behind; the
+// client reconnects then and starts over from the current state.
+func streamEvents(w http.ResponseWriter, r *http.Request, events <-chan notify.Event, exprID string) {
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if exprID != "" && e.ExpressionID != exprID {
+				continue
+			}
+			if !writeEvent(w, e) {
+				return
+			}
+			if exprID != "" && isLast(e) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent sends e with the current progress of its expression. It
+// returns false once the client is gone.
+func writeEvent(w http.ResponseWriter, e notify.Event) bool {
+	if e.Type == notify.EventDeleted {
+		return sendEvent(w, sseDeleted, responseDeletedEvent{ID: e.ExpressionID})
+	}
+
+	progress, err := repository.GetExpressionProgress(e.ExpressionID)
+	if err != nil {
+		log.Printf("[DEBUG] GetExpressionProgress error: %v", err)
+		progress = nil
+	}
+
+	var name string
+	var payload interface{}
+	switch e.Type {
+	case notify.EventTask:
+		name = sseTask
+		payload = responseTaskEvent{Task: e.Task, Progress: progress}
+	case notify.EventExpression:
+		// The published expression is shared by all subscribers.
+		expr := *e.Expression
+		expr.Progress = progress
+		name = sseExpression
+		if expr.Finished() {
+			name = sseResult
+		}
+		payload = responseSingleExpression{Expression: &expr}
+	default:
+		return true
+	}
+	return sendEvent(w, name, payload)
+}
+
+// sendEvent writes one event named name. It returns false once the client
+// is gone.
+func sendEvent(w http.ResponseWriter, name string, payload interface{}) bool {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[DEBUG] event marshal error: %v", err)
+		return true
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return false
+	}
+	w.(http.Flusher).Flush()
+	return true
+}
+
+// parseWait reads the wait query parameter: a duration such as "30s" or a
+// number of seconds. Longer waits than config.MaxWait are shortened to it.
+func parseWait(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, convErr := strconv.Atoi(s)
+		if convErr != nil {
+			return 0, errors.New("wait must be a duration such as 30s")
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, errors.New("wait must not be negative")
+	}
+	return min(d, config.MaxWait()), nil
+}
+
+// waitForResult blocks until the expression reaches a final status or is
+// deleted, the timeout elapses or the client leaves. No database connection
+// is held while waiting: the events of the user wake it up.
+func waitForResult(ctx context.Context, userID int64, exprID string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		done, err := func() (bool, error) {
+			events, unsubscribe := notify.Events.Subscribe(userID)
+			defer unsubscribe()
+
+			expr, err := repository.GetExpressionByID(userID, exprID)
+			if err != nil || expr == nil || expr.Finished() {
+				return true, err
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return true, nil
+				case <-timer.C:
+					return true, nil
+				case e, ok := <-events:
+					if !ok {
+						// Fell behind, look at the expression again.
+						return false, nil
+					}
+					if e.ExpressionID == exprID && isLast(e) {
+						return true, nil
+					}
+				}
+			}
+		}()
+		if done {
+			return err
+		}
+	}
+}
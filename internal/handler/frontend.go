@@ -5,8 +5,9 @@ import (
 	"net/http"
 	"path/filepath"
 
-	"github.com/TuHeKocmoc/yalyceumfinal2/internal/calc"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/planner"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
@@ -86,8 +87,12 @@ func HandleFrontAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !calc.CheckInput(expr) {
-		http.Error(w, "expression is not valid", http.StatusUnprocessableEntity)
+	root, err := parser.Parse(expr)
+	if err == nil {
+		err = parser.CheckIdentifiers(expr, root, nil)
+	}
+	if err != nil {
+		writeValidationError(w, err)
 		return
 	}
 
@@ -97,7 +102,14 @@ func HandleFrontAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	finalTaskID, err := planner.PlanTasksWithNestedParen(newExpr.ID, expr)
+	if replication := config.ReplicationFactor(); replication > 1 {
+		if err := repository.SetExpressionReplication(newExpr.ID, replication); err != nil {
+			http.Error(w, "cannot create expression", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	finalTaskID, err := planner.PlanTasks(newExpr.ID, root, nil)
 	if err != nil {
 		newExpr.Status = model.StatusError
 		_ = repository.UpdateExpression(newExpr)
@@ -1,6 +1,7 @@
 package handler_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -14,8 +15,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/handler"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
 
@@ -89,6 +93,1242 @@ func TestHandleCreateExpression(t *testing.T) {
 	if expr.Raw != "2+2*2" {
 		t.Errorf("expected raw=2+2*2, got %q", expr.Raw)
 	}
+	if expr.Status != model.StatusInProgress || expr.FinalTaskID == 0 || expr.BatchID != "" {
+		t.Errorf("expression = %s final task %d batch %q, want planned outside of a batch",
+			expr.Status, expr.FinalTaskID, expr.BatchID)
+	}
+}
+
+func TestHandleCreateExpression_Diagnostic(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	body := `{"expression":"2+3*"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = withTestUserID(req, testUserID)
+
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+
+	var out struct {
+		Error struct {
+			Code       string `json:"code"`
+			Message    string `json:"message"`
+			Offset     int    `json:"offset"`
+			Column     int    `json:"column"`
+			Token      string `json:"token"`
+			Suggestion string `json:"suggestion"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+	if out.Error.Code != "MISSING_OPERAND" {
+		t.Errorf("expected code MISSING_OPERAND, got %q", out.Error.Code)
+	}
+	if out.Error.Offset != 4 || out.Error.Column != 5 {
+		t.Errorf("expected offset 4 / column 5, got %d / %d", out.Error.Offset, out.Error.Column)
+	}
+	if out.Error.Suggestion != "missing operand after '*'" {
+		t.Errorf("unexpected suggestion %q", out.Error.Suggestion)
+	}
+
+	exprs, err := repository.GetAllExpressions(testUserID)
+	if err != nil {
+		t.Fatalf("GetAllExpressions error: %v", err)
+	}
+	if len(exprs) != 0 {
+		t.Errorf("invalid expression must not be stored, got %d expressions", len(exprs))
+	}
+}
+
+func TestHandleCreateExpression_Variables(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	body := `{"expression":"rate*principal","variables":{"rate":0.05,"principal":1000}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+	req = withTestUserID(req, testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body = `{"expression":"rate*principal","variables":{"rate":0.05}}`
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+	req = withTestUserID(req, testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for unbound variable, got %d", w.Code)
+	}
+	var out struct {
+		Error struct {
+			Code   string `json:"code"`
+			Offset int    `json:"offset"`
+			Token  string `json:"token"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+	if out.Error.Code != "UNBOUND_IDENTIFIER" || out.Error.Offset != 5 || out.Error.Token != "principal" {
+		t.Errorf("unexpected diagnostic %+v", out.Error)
+	}
+}
+
+func TestHandlePostTaskResult_Error(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1/0+2"}`))
+	req = withTestUserID(req, testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from GET /internal/task, got %d", w.Code)
+	}
+	var taskResp struct {
+		Task struct {
+			ID int `json:"id"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+		t.Fatalf("decode task error: %v", err)
+	}
+
+	body := fmt.Sprintf(`{"id":%d,"error":"division by zero"}`, taskResp.Task.ID)
+	w = httptest.NewRecorder()
+	handler.HandlePostTaskResult(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from POST /internal/task, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil)
+	req = withTestUserID(req, testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleGetExpressionByID(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from GET expression, got %d", w.Code)
+	}
+	var out struct {
+		Expression struct {
+			Status string   `json:"status"`
+			Result *float64 `json:"result"`
+			Error  string   `json:"error"`
+		} `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode expression error: %v", err)
+	}
+	if out.Expression.Status != model.StatusError {
+		t.Errorf("status = %s, want %s", out.Expression.Status, model.StatusError)
+	}
+	if out.Expression.Result != nil {
+		t.Errorf("result = %v, want nil", *out.Expression.Result)
+	}
+	if !strings.Contains(out.Expression.Error, "division by zero") {
+		t.Errorf("error = %q, want it to contain the reason", out.Expression.Error)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("dependent task must be cancelled, GET /internal/task returned %d", w.Code)
+	}
+}
+
+func TestHandleExpression_CancelAndDelete(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	create := func() string {
+		t.Helper()
+		req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2*3"}`)), testUserID)
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", w.Code)
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatalf("decode response error: %v", err)
+		}
+		return created.ID
+	}
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.HandleExpression(w, withTestUserID(httptest.NewRequest(method, path, nil), testUserID))
+		return w
+	}
+
+	id := create()
+	w := httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from GET /internal/task, got %d", w.Code)
+	}
+	var taskResp struct {
+		Task struct {
+			ID int `json:"id"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+		t.Fatalf("decode task error: %v", err)
+	}
+
+	if w := do(http.MethodGet, "/api/v1/expressions/"+id+"/cancel"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET cancel: expected 405, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/v1/expressions/missing/cancel"); w.Code != http.StatusNotFound {
+		t.Errorf("cancel missing: expected 404, got %d", w.Code)
+	}
+	w = do(http.MethodPost, "/api/v1/expressions/"+id+"/cancel")
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var out struct {
+		Expression struct {
+			Status string `json:"status"`
+		} `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode expression error: %v", err)
+	}
+	if out.Expression.Status != model.StatusCancelled {
+		t.Errorf("status = %s, want %s", out.Expression.Status, model.StatusCancelled)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("tasks of a cancelled expression must not be handed out, got %d", w.Code)
+	}
+	body := fmt.Sprintf(`{"id":%d,"result":6}`, taskResp.Task.ID)
+	w = httptest.NewRecorder()
+	handler.HandlePostTaskResult(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+	if w.Code != http.StatusGone {
+		t.Errorf("result of a cancelled task: expected 410, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/api/v1/expressions/"+id); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/v1/expressions/"+id); w.Code != http.StatusNotFound {
+		t.Errorf("deleted expression: expected 404, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/expressions/"+id); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: expected 404, got %d", w.Code)
+	}
+	tasks, err := repository.GetTasksByExpressionID(id)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID error: %v", err)
+	}
+	if len(tasks) != 0 {
+		t.Errorf("%d tasks left after delete", len(tasks))
+	}
+
+	// A finished expression cannot be cancelled.
+	id = create()
+	expr, _ := repository.GetExpressionByID(testUserID, id)
+	expr.Status = model.StatusDone
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	if w := do(http.MethodPost, "/api/v1/expressions/"+id+"/cancel"); w.Code != http.StatusConflict {
+		t.Errorf("cancel finished: expected 409, got %d", w.Code)
+	}
+}
+
+func TestHandleCreateExpression_Deadline(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	invalid := []string{
+		`{"expression": "1+2", "timeout_ms": -5}`,
+		`{"expression": "1+2", "deadline": "2000-01-01T00:00:00Z"}`,
+		`{"expression": "1+2", "timeout_ms": 1000, "deadline": "2999-01-01T00:00:00Z"}`,
+	}
+	for _, body := range invalid {
+		req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), testUserID)
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+
+	body := `{"expression": "1+2", "timeout_ms": 60000}`
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode json error: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from GET /internal/task, got %d", w.Code)
+	}
+	var taskResp struct {
+		Task struct {
+			DeadlineMs int64 `json:"deadline_ms"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+		t.Fatalf("decode task error: %v", err)
+	}
+	if taskResp.Task.DeadlineMs <= 0 || taskResp.Task.DeadlineMs > 60000 {
+		t.Errorf("deadline_ms = %d, want (0, 60000]", taskResp.Task.DeadlineMs)
+	}
+
+	if n, err := repository.ExpireDeadlines(time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Fatalf("ExpireDeadlines = %d, %v", n, err)
+	}
+	req = withTestUserID(httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleGetExpressionByID(w, req)
+	var out struct {
+		Expression struct {
+			Status   string     `json:"status"`
+			Deadline *time.Time `json:"deadline"`
+			Error    string     `json:"error"`
+			Progress struct {
+				Done  int `json:"done"`
+				Total int `json:"total"`
+			} `json:"progress"`
+		} `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode expression error: %v", err)
+	}
+	if out.Expression.Status != model.StatusTimeout || out.Expression.Deadline == nil {
+		t.Errorf("expression = %+v, want TIMEOUT with a deadline", out.Expression)
+	}
+	if out.Expression.Progress.Done != 0 || out.Expression.Progress.Total != 1 {
+		t.Errorf("progress = %+v, want 0 of 1", out.Expression.Progress)
+	}
+}
+
+func TestHandlePostTaskResult_DeadlineMiss(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	body := `{"expression": "(1+2)*3", "timeout_ms": 1500}`
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode json error: %v", err)
+	}
+
+	claim := func() int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 from GET /internal/task, got %d", w.Code)
+		}
+		var taskResp struct {
+			Task struct {
+				ID int `json:"id"`
+			} `json:"task"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+			t.Fatalf("decode task error: %v", err)
+		}
+		return taskResp.Task.ID
+	}
+	post := func(body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.HandlePostTaskResult(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 from POST /internal/task, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	post(fmt.Sprintf(`{"id":%d,"result":3}`, claim()))
+	// The multiplication takes longer than what is left of the deadline.
+	post(fmt.Sprintf(`{"id":%d,"error":"cannot finish before the deadline","transient":true}`, claim()))
+
+	req = withTestUserID(httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleGetExpressionByID(w, req)
+	var out struct {
+		Expression struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode expression error: %v", err)
+	}
+	if out.Expression.Status != model.StatusTimeout || out.Expression.Error != "deadline exceeded: 1 of 2 tasks done" {
+		t.Errorf("expression = %+v, want TIMEOUT with 1 of 2 tasks done", out.Expression)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("timed out task must not be handed out again, GET /internal/task returned %d", w.Code)
+	}
+}
+
+func TestHandleCreateExpression_Replication(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	for _, replication := range []int{-1, 100} {
+		body := fmt.Sprintf(`{"expression": "1+2", "replication": %d}`, replication)
+		req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), testUserID)
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("replication %d: expected 400, got %d", replication, w.Code)
+		}
+	}
+
+	body := `{"expression": "1+2", "replication": 3}`
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode json error: %v", err)
+	}
+
+	expr, err := repository.GetExpressionByID(testUserID, created.ID)
+	if err != nil || expr == nil {
+		t.Fatalf("GetExpressionByID = %v, %v", expr, err)
+	}
+	if expr.Replication != 3 {
+		t.Errorf("replication = %d, want 3", expr.Replication)
+	}
+
+	// Replicas go to agents that identify themselves only, each gets one.
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("agent without an ID: expected 404, got %d", w.Code)
+	}
+	for _, agent := range []string{"agent-a", "agent-b", "agent-c"} {
+		w = httptest.NewRecorder()
+		handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task?agent_id="+agent, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", agent, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task?agent_id=agent-a", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second replica for agent-a: expected 404, got %d", w.Code)
+	}
+}
+
+func TestHandleCreateExpression_Priority(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+	if err := repository.CreateUser("priority-admin", "hash"); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	if ok, err := repository.SetUserRole("priority-admin", model.RoleAdmin); err != nil || !ok {
+		t.Fatalf("SetUserRole = %v, %v", ok, err)
+	}
+	admin, err := repository.GetUserByLogin("priority-admin")
+	if err != nil || admin == nil {
+		t.Fatalf("GetUserByLogin = %v, %v", admin, err)
+	}
+
+	tests := []struct {
+		userID   int64
+		priority int
+		code     int
+	}{
+		{testUserID, -1, http.StatusBadRequest},
+		{testUserID, config.MaxPriority(model.RoleUser) + 1, http.StatusForbidden},
+		{testUserID, config.MaxPriority(model.RoleUser), http.StatusCreated},
+		{admin.ID, config.MaxPriority(model.RoleAdmin), http.StatusCreated},
+		{admin.ID, config.MaxPriority(model.RoleAdmin) + 1, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		body := fmt.Sprintf(`{"expression": "1+2", "priority": %d}`, tc.priority)
+		req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)), tc.userID)
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, req)
+		if w.Code != tc.code {
+			t.Errorf("user %d, priority %d: expected %d, got %d", tc.userID, tc.priority, tc.code, w.Code)
+			continue
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatalf("decode json error: %v", err)
+		}
+		expr, err := repository.GetExpressionByID(tc.userID, created.ID)
+		if err != nil || expr == nil {
+			t.Fatalf("GetExpressionByID = %v, %v", expr, err)
+		}
+		if expr.Priority != tc.priority {
+			t.Errorf("priority = %d, want %d", expr.Priority, tc.priority)
+		}
+	}
+}
+
+func TestHandleAdmin_DeadTasks(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+	defer func(p repository.RetryPolicy) { repository.Retry = p }(repository.Retry)
+	repository.Retry = repository.RetryPolicy{MaxRetries: 0}
+
+	if err := repository.CreateUser("dead-admin", "hash"); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	if ok, err := repository.SetUserRole("dead-admin", model.RoleAdmin); err != nil || !ok {
+		t.Fatalf("SetUserRole = %v, %v", ok, err)
+	}
+	admin, err := repository.GetUserByLogin("dead-admin")
+	if err != nil || admin == nil {
+		t.Fatalf("GetUserByLogin = %v, %v", admin, err)
+	}
+
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	var taskResp struct {
+		Task struct {
+			ID int `json:"id"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+		t.Fatalf("decode task error: %v", err)
+	}
+	taskID := taskResp.Task.ID
+
+	// A transient error is not the result of the task: it goes to the retry
+	// policy, which has no retries left here.
+	body := fmt.Sprintf(`{"id":%d,"error":"agent overloaded","transient":true}`, taskID)
+	w = httptest.NewRecorder()
+	handler.HandlePostTaskResult(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from POST /internal/task, got %d: %s", w.Code, w.Body.String())
+	}
+
+	serve := func(method, path string, userID int64) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.HandleAdmin(w, withTestUserID(httptest.NewRequest(method, path, nil), userID))
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/api/v1/admin/tasks/dead", testUserID); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: expected 403, got %d", w.Code)
+	}
+
+	w = serve(http.MethodGet, "/api/v1/admin/tasks/dead", admin.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var list struct {
+		Tasks []model.Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("decode tasks error: %v", err)
+	}
+	if len(list.Tasks) != 1 || list.Tasks[0].ID != taskID {
+		t.Fatalf("dead tasks = %+v, want task %d", list.Tasks, taskID)
+	}
+	if dead := list.Tasks[0]; dead.Status != model.TaskStatusDead || dead.Attempts != 1 || dead.LastError != "agent overloaded" {
+		t.Errorf("dead task: status=%s attempts=%d last_error=%q", dead.Status, dead.Attempts, dead.LastError)
+	}
+
+	path := fmt.Sprintf("/api/v1/admin/tasks/%d/requeue", taskID)
+	if w := serve(http.MethodPost, path, admin.ID); w.Code != http.StatusOK {
+		t.Errorf("requeue: expected 200, got %d", w.Code)
+	}
+	if w := serve(http.MethodPost, path, admin.ID); w.Code != http.StatusConflict {
+		t.Errorf("second requeue: expected 409, got %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/api/v1/admin/tasks/999999/requeue", admin.ID); w.Code != http.StatusNotFound {
+		t.Errorf("unknown task: expected 404, got %d", w.Code)
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+	if err := repository.CreateUser("webhook-user", "hash"); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	user, err := repository.GetUserByLogin("webhook-user")
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByLogin = %v, %v", user, err)
+	}
+
+	serve := func(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, withTestUserID(httptest.NewRequest(method, path, strings.NewReader(body)), user.ID))
+		return w
+	}
+
+	if w := serve(handler.HandleWebhook, http.MethodPut, "/api/v1/webhook", `{"url":"ftp://example.com"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("ftp url: expected 400, got %d", w.Code)
+	}
+	w := serve(handler.HandleWebhook, http.MethodPut, "/api/v1/webhook", `{"url":"https://example.com/hook"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var hook model.Webhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil {
+		t.Fatalf("decode webhook error: %v", err)
+	}
+	if hook.URL != "https://example.com/hook" || len(hook.Secret) != 64 {
+		t.Errorf("webhook = %+v", hook)
+	}
+
+	w = serve(handler.HandleWebhook, http.MethodGet, "/api/v1/webhook", "")
+	var again model.Webhook
+	if err := json.NewDecoder(w.Body).Decode(&again); err != nil {
+		t.Fatalf("decode webhook error: %v", err)
+	}
+	if again != hook {
+		t.Errorf("GET webhook = %+v, want %+v", again, hook)
+	}
+
+	if w := serve(handler.HandleCreateExpression, http.MethodPost, "/api/v1/calculate",
+		`{"expression":"1+2","callback_url":"not a url"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid callback_url: expected 400, got %d", w.Code)
+	}
+	w = serve(handler.HandleCreateExpression, http.MethodPost, "/api/v1/calculate",
+		`{"expression":"1+2","callback_url":"http://example.com/done"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	expr, err := repository.GetExpressionByID(user.ID, created.ID)
+	if err != nil || expr == nil || expr.CallbackURL != "http://example.com/done" {
+		t.Fatalf("GetExpressionByID = %+v, %v", expr, err)
+	}
+
+	result := 3.0
+	expr.Status, expr.Result = model.StatusDone, &result
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	w = serve(handler.HandleWebhookDeliveries, http.MethodGet, "/api/v1/webhook/deliveries?expression_id="+expr.ID, "")
+	var list struct {
+		Deliveries []model.WebhookDelivery `json:"deliveries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("decode deliveries error: %v", err)
+	}
+	if len(list.Deliveries) != 2 {
+		t.Fatalf("deliveries = %+v, want 2", list.Deliveries)
+	}
+	for _, d := range list.Deliveries {
+		if d.Status != model.DeliveryPending || d.Event != "expression.done" {
+			t.Errorf("delivery = %+v, want pending expression.done", d)
+		}
+	}
+}
+
+func TestHandleCreateBatch(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	body := `{"expressions": [
+		{"label": "sum", "expression": "1+2"},
+		{"label": "broken", "expression": "2*"},
+		{"label": "replicated", "expression": "1+1", "replication": 100},
+		{"label": "scaled", "expression": "x*2+1", "variables": {"x": 3}, "tags": ["fast"]}
+	]}`
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", strings.NewReader(body)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateBatch(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		BatchID  string `json:"batch_id"`
+		Accepted int    `json:"accepted"`
+		Rejected int    `json:"rejected"`
+		Items    []struct {
+			Label string `json:"label"`
+			ID    string `json:"id"`
+			Error *struct {
+				Code   string `json:"code"`
+				Offset *int   `json:"offset"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if resp.BatchID == "" || resp.Accepted != 2 || resp.Rejected != 2 || len(resp.Items) != 4 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if it := resp.Items[0]; it.Label != "sum" || it.ID == "" || it.Error != nil {
+		t.Errorf("item 0 = %+v, want accepted", it)
+	}
+	if it := resp.Items[1]; it.ID != "" || it.Error == nil || it.Error.Code != "MISSING_OPERAND" || it.Error.Offset == nil {
+		t.Errorf("item 1 = %+v, want MISSING_OPERAND with its position", it)
+	}
+	// Errors about the request have no position in the expression.
+	if it := resp.Items[2]; it.ID != "" || it.Error == nil || it.Error.Code != "INVALID_REQUEST" || it.Error.Offset != nil {
+		t.Errorf("item 2 = %+v, want INVALID_REQUEST without a position", it)
+	}
+
+	scaled, err := repository.GetExpressionByID(testUserID, resp.Items[3].ID)
+	if err != nil || scaled == nil {
+		t.Fatalf("GetExpressionByID = %v, %v", scaled, err)
+	}
+	if scaled.Status != model.StatusInProgress || scaled.Label != "scaled" || scaled.BatchID != resp.BatchID {
+		t.Errorf("scaled expression = %+v", scaled)
+	}
+	tasks, err := repository.GetTasksByExpressionID(scaled.ID)
+	if err != nil || len(tasks) != 2 || tasks[1].ID != scaled.FinalTaskID {
+		t.Errorf("tasks of scaled = %d, %v; want 2 ending with the final task", len(tasks), err)
+	}
+	if tags, _ := repository.GetExpressionTags(scaled.ID); len(tags) != 1 || tags[0] != "fast" {
+		t.Errorf("tags of scaled = %v", tags)
+	}
+
+	getBatch := func(userID int64) (*httptest.ResponseRecorder, *model.Batch) {
+		w := httptest.NewRecorder()
+		handler.HandleGetBatch(w, withTestUserID(httptest.NewRequest(http.MethodGet, "/api/v1/batches/"+resp.BatchID, nil), userID))
+		var out struct {
+			Batch *model.Batch `json:"batch"`
+		}
+		json.NewDecoder(w.Body).Decode(&out)
+		return w, out.Batch
+	}
+
+	w, batch := getBatch(testUserID)
+	if w.Code != http.StatusOK || batch == nil {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if batch.Status != model.BatchInProgress || batch.Total != 2 || batch.Counts[model.StatusInProgress] != 2 ||
+		batch.Expressions[0].Label != "sum" || batch.Expressions[1].Label != "scaled" {
+		t.Errorf("batch = %+v", batch)
+	}
+
+	result := 3.0
+	sum, _ := repository.GetExpressionByID(testUserID, resp.Items[0].ID)
+	sum.Status, sum.Result = model.StatusDone, &result
+	if err := repository.UpdateExpression(sum); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	scaled.Status, scaled.Error = model.StatusError, "division by zero"
+	if err := repository.UpdateExpression(scaled); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	if _, batch := getBatch(testUserID); batch == nil || batch.Status != model.BatchFailed ||
+		batch.Counts[model.StatusDone] != 1 || batch.Counts[model.StatusError] != 1 {
+		t.Errorf("finished batch = %+v, want FAILED", batch)
+	}
+
+	if w, _ := getBatch(testUserID + 1); w.Code != http.StatusNotFound {
+		t.Errorf("another user: expected 404, got %d", w.Code)
+	}
+
+	req = withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch",
+		strings.NewReader(`{"expressions": [{"expression": "("}]}`)), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleCreateBatch(w, req)
+	if w.Code != http.StatusUnprocessableEntity || strings.Contains(w.Body.String(), "batch_id") {
+		t.Errorf("all rejected: expected 422 without batch, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch",
+		strings.NewReader(`{"expressions": []}`)), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleCreateBatch(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("empty batch: expected 400, got %d", w.Code)
+	}
+}
+
+func TestHandleCreateExpression_IdempotencyKey(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	post := func(userID int64, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		req.Header.Set(handler.IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, withTestUserID(req, userID))
+		return w
+	}
+	idOf := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.ID
+	}
+
+	w := post(testUserID, "order-42", `{"expression": "2+2"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	first := idOf(w)
+
+	// The same request with other formatting is a retry.
+	w = post(testUserID, "order-42", `{ "expression":"2+2" }`)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: expected replayed 201, got %d %v", w.Code, w.Header())
+	}
+	if id := idOf(w); id != first {
+		t.Errorf("retry returned %s, want %s", id, first)
+	}
+	list, err := repository.GetAllExpressions(testUserID)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expressions after retry = %d, %v; want 1", len(list), err)
+	}
+
+	if w := post(testUserID, "order-42", `{"expression": "2+3"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other body: expected 422, got %d", w.Code)
+	}
+
+	// Keys are scoped per user.
+	w = post(testUserID+1, "order-42", `{"expression": "2+2"}`)
+	if w.Code != http.StatusCreated || idOf(w) == first {
+		t.Errorf("another user: expected a new expression, got %d", w.Code)
+	}
+
+	// A rejected request does not keep the key.
+	if w := post(testUserID, "order-43", `{"expression": "2+"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid expression: expected 422, got %d", w.Code)
+	}
+	if w := post(testUserID, "order-43", `{"expression": "2+5"}`); w.Code != http.StatusCreated {
+		t.Errorf("fixed request: expected 201, got %d", w.Code)
+	}
+
+	prev, err := repository.ReserveIdempotencyKey(testUserID, "order-44", "hash", time.Now(), time.Minute)
+	if err != nil || prev != nil {
+		t.Fatalf("ReserveIdempotencyKey = %+v, %v", prev, err)
+	}
+	if w := post(testUserID, "order-44", `{"expression": "2+2"}`); w.Code != http.StatusConflict {
+		t.Errorf("request in progress: expected 409, got %d", w.Code)
+	}
+}
+
+// readEvent reads the next Server-Sent Event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var name, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event error: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHandleExpressionEvents(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleExpression(w, withTestUserID(r, testUserID))
+	}))
+	// Closed after the streams, which the server would wait for.
+	t.Cleanup(srv.Close)
+
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+
+	open := func(path string) *bufio.Reader {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s error: %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("GET %s: status %d, content type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	single := open("/api/v1/expressions/" + created.ID + "/events")
+	all := open("/api/v1/expressions/events")
+
+	var state struct {
+		Expression model.Expression `json:"expression"`
+	}
+	name, data := readEvent(t, single)
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		t.Fatalf("decode %s event error: %v", name, err)
+	}
+	if name != "expression" || state.Expression.Status != model.StatusInProgress {
+		t.Fatalf("first event = %s %s, want the current state", name, data)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+	var taskResp struct {
+		Task struct {
+			ID int `json:"id"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&taskResp); err != nil {
+		t.Fatalf("decode task error: %v", err)
+	}
+	body := fmt.Sprintf(`{"id":%d,"result":3}`, taskResp.Task.ID)
+	w = httptest.NewRecorder()
+	handler.HandlePostTaskResult(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from POST /internal/task, got %d", w.Code)
+	}
+
+	for stream, r := range map[string]*bufio.Reader{"expression": single, "user": all} {
+		name, data := readEvent(t, r)
+		var done struct {
+			Task     model.Task     `json:"task"`
+			Progress model.Progress `json:"progress"`
+		}
+		if err := json.Unmarshal([]byte(data), &done); err != nil {
+			t.Fatalf("%s stream: decode %s event error: %v", stream, name, err)
+		}
+		if name != "task" || done.Task.ID != taskResp.Task.ID || done.Progress.Done != 1 {
+			t.Errorf("%s stream: got %s %s, want the finished task", stream, name, data)
+		}
+
+		name, data = readEvent(t, r)
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			t.Fatalf("%s stream: decode %s event error: %v", stream, name, err)
+		}
+		if name != "result" || state.Expression.Status != model.StatusDone ||
+			state.Expression.Result == nil || *state.Expression.Result != 3 {
+			t.Errorf("%s stream: got %s %s, want the result", stream, name, data)
+		}
+	}
+	if _, err := single.ReadString('\n'); err != io.EOF {
+		t.Errorf("the expression stream must end after the result, got %v", err)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/expressions/unknown/events")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown expression: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandleExpression_Wait(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	// Computes the only ready task once it is handed out.
+	computeNext := func() {
+		for {
+			w := httptest.NewRecorder()
+			handler.HandleGetTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+			if w.Code == http.StatusOK {
+				var taskResp struct {
+					Task struct {
+						ID int `json:"id"`
+					} `json:"task"`
+				}
+				json.NewDecoder(w.Body).Decode(&taskResp)
+				body := fmt.Sprintf(`{"id":%d,"result":3}`, taskResp.Task.ID)
+				handler.HandlePostTaskResult(httptest.NewRecorder(),
+					httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	get := func(path string) (int, model.Expression) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.HandleExpression(w, withTestUserID(httptest.NewRequest(http.MethodGet, path, nil), testUserID))
+		var out struct {
+			Expression model.Expression `json:"expression"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+				t.Fatalf("decode expression error: %v", err)
+			}
+		}
+		return w.Code, out.Expression
+	}
+
+	req := withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`)), testUserID)
+	w := httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+	path := "/api/v1/expressions/" + created.ID
+
+	if code, _ := get(path + "?wait=soon"); code != http.StatusBadRequest {
+		t.Errorf("invalid wait: expected 400, got %d", code)
+	}
+
+	start := time.Now()
+	if code, expr := get(path + "?wait=50ms"); code != http.StatusOK || expr.Status != model.StatusInProgress {
+		t.Errorf("wait elapsed: got %d %s, want 200 %s", code, expr.Status, model.StatusInProgress)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %v, before the wait elapsed", elapsed)
+	}
+
+	go computeNext()
+	code, expr := get(path + "?wait=10s")
+	if code != http.StatusOK || expr.Status != model.StatusDone || expr.Result == nil || *expr.Result != 3 {
+		t.Fatalf("wait for result: got %d %+v", code, expr)
+	}
+
+	go computeNext()
+	req = withTestUserID(httptest.NewRequest(http.MethodPost, "/api/v1/calculate?wait=10", strings.NewReader(`{"expression":"1+2"}`)), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleCreateExpression(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("calculate with wait: expected 201, got %d", w.Code)
+	}
+	var waited struct {
+		ID         string            `json:"id"`
+		Expression *model.Expression `json:"expression"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&waited); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+	if waited.ID == "" || waited.Expression == nil || waited.Expression.Status != model.StatusDone {
+		t.Errorf("calculate with wait: got %+v, want the final expression", waited)
+	}
+}
+
+func TestHandleExpression_DeleteEndsWaiters(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleExpression(w, withTestUserID(r, testUserID))
+	}))
+	t.Cleanup(srv.Close)
+
+	create := func() string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`))
+		req.Header.Set(handler.IdempotencyKeyHeader, "delete-me")
+		w := httptest.NewRecorder()
+		handler.HandleCreateExpression(w, withTestUserID(req, testUserID))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", w.Code)
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatalf("decode response error: %v", err)
+		}
+		return created.ID
+	}
+	id := create()
+	path := "/api/v1/expressions/" + id
+
+	resp, err := http.Get(srv.URL + path + "/events")
+	if err != nil {
+		t.Fatalf("GET events error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	stream := bufio.NewReader(resp.Body)
+	if name, _ := readEvent(t, stream); name != "expression" {
+		t.Fatalf("first event = %s, want the current state", name)
+	}
+
+	waited := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + path + "?wait=10s")
+		if err != nil {
+			waited <- 0
+			return
+		}
+		resp.Body.Close()
+		waited <- resp.StatusCode
+	}()
+	// Let the waiter subscribe before the delete.
+	time.Sleep(50 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	handler.HandleExpression(w, withTestUserID(httptest.NewRequest(http.MethodDelete, path, nil), testUserID))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", w.Code)
+	}
+
+	name, data := readEvent(t, stream)
+	var deleted struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(data), &deleted); err != nil {
+		t.Fatalf("decode %s event error: %v", name, err)
+	}
+	if name != "deleted" || deleted.ID != id {
+		t.Errorf("got %s %s, want the deleted event", name, data)
+	}
+	if _, err := stream.ReadString('\n'); err != io.EOF {
+		t.Errorf("stream still open after the deleted event: %v", err)
+	}
+
+	select {
+	case code := <-waited:
+		if code != http.StatusNotFound {
+			t.Errorf("wait on a deleted expression: expected 404, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after the delete")
+	}
+
+	var keys int
+	if err := db.GlobalDB.QueryRow(`SELECT COUNT(*) FROM idempotency_keys WHERE expression_id = ?`, id).Scan(&keys); err != nil || keys != 0 {
+		t.Errorf("idempotency keys of the deleted expression = %d, %v; want 0", keys, err)
+	}
+	if again := create(); again == id {
+		t.Errorf("the key still replays the deleted expression %s", id)
+	}
+}
+
+func TestHandleGetAgents(t *testing.T) {
+	agents.Default.Register(agents.Agent{
+		ID:             "handler-agent",
+		Hostname:       "host-1",
+		Version:        "test",
+		ComputingPower: 3,
+		Operations:     []string{"+", "-"},
+	}, time.Now())
+
+	w := httptest.NewRecorder()
+	handler.HandleGetAgents(w, httptest.NewRequest(http.MethodGet, "/api/v1/agents", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without user, got %d", w.Code)
+	}
+
+	req := withTestUserID(httptest.NewRequest(http.MethodGet, "/api/v1/agents", nil), testUserID)
+	w = httptest.NewRecorder()
+	handler.HandleGetAgents(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var out struct {
+		Agents []struct {
+			ID             string    `json:"id"`
+			Hostname       string    `json:"hostname"`
+			ComputingPower int       `json:"computing_power"`
+			Operations     []string  `json:"operations"`
+			Status         string    `json:"status"`
+			LastSeen       time.Time `json:"last_seen"`
+		} `json:"agents"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode json error: %v", err)
+	}
+	found := false
+	for _, a := range out.Agents {
+		if a.ID == "handler-agent" {
+			found = true
+			if a.Status != agents.StatusAlive || a.ComputingPower != 3 || len(a.Operations) != 2 || a.LastSeen.IsZero() {
+				t.Errorf("unexpected agent %+v", a)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("registered agent missing from %+v", out.Agents)
+	}
 }
 
 func TestHandleGetAllExpressions(t *testing.T) {
@@ -125,6 +1365,103 @@ func TestHandleGetAllExpressions(t *testing.T) {
 	}
 }
 
+func TestHandleGetAllExpressions_Pagination(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	var ids []string
+	for _, raw := range []string{"1+1", "2+2", "10%3", "3*3", "4-4"} {
+		expr, err := repository.CreateExpression(raw, testUserID)
+		if err != nil {
+			t.Fatalf("CreateExpression error: %v", err)
+		}
+		ids = append(ids, expr.ID)
+	}
+	// Finish "3*3" before "2+2".
+	for _, i := range []int{3, 1} {
+		expr, _ := repository.GetExpressionByID(testUserID, ids[i])
+		expr.Status = model.StatusDone
+		if err := repository.UpdateExpression(expr); err != nil {
+			t.Fatalf("UpdateExpression error: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	type page struct {
+		Expressions []model.Expression `json:"expressions"`
+		NextCursor  string             `json:"next_cursor"`
+	}
+	list := func(query string) (int, page) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions?"+query, nil)
+		handler.HandleGetAllExpressions(w, withTestUserID(req, testUserID))
+		var p page
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatalf("%s: decode error: %v", query, err)
+			}
+		}
+		return w.Code, p
+	}
+	idsOf := func(p page) []string {
+		var out []string
+		for _, e := range p.Expressions {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	expect := func(query string, want ...string) {
+		t.Helper()
+		code, p := list(query)
+		if got := idsOf(p); code != http.StatusOK || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %d %v, want %v", query, code, got, want)
+		}
+	}
+
+	// Without pagination parameters the whole list, oldest first.
+	expect("", ids...)
+
+	// Newest first, two per page.
+	var got []string
+	query := "order=desc&limit=2"
+	for pages := 0; ; pages++ {
+		code, p := list(query)
+		if code != http.StatusOK || pages > 3 {
+			t.Fatalf("%s: got %d after %d pages", query, code, pages)
+		}
+		got = append(got, idsOf(p)...)
+		if p.NextCursor == "" {
+			break
+		}
+		query = "order=desc&limit=2&cursor=" + p.NextCursor
+	}
+	if want := []string{ids[4], ids[3], ids[2], ids[1], ids[0]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	expect("order=asc&status=done", ids[1], ids[3])
+	expect("status=PENDING,DONE&limit=1", ids[0])
+	expect("q=%25", ids[2])
+	expect("sort=finished_at&order=asc", ids[3], ids[1])
+	expect("created_from=" + time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	// A cursor continues the listing with a page of the default size.
+	_, p := list("q=%2B&limit=1")
+	expect("q=%2B&cursor="+p.NextCursor, ids[1])
+
+	_, p = list("limit=1")
+	for _, query := range []string{
+		"status=LOST", "limit=0", "sort=raw", "created_to=yesterday",
+		"cursor=garbage", "order=desc&cursor=" + p.NextCursor,
+		"status=DONE&cursor=" + p.NextCursor, "q=1&cursor=" + p.NextCursor,
+	} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
 func TestHandleFrontAdd(t *testing.T) {
 	if err := clearDB(); err != nil {
 		t.Fatalf("clearDB error: %v", err)
@@ -156,6 +1493,36 @@ func TestHandleFrontAdd(t *testing.T) {
 	}
 }
 
+func TestHandleFrontAdd_Diagnostic(t *testing.T) {
+	if err := clearDB(); err != nil {
+		t.Fatalf("clearDB error: %v", err)
+	}
+
+	form := "expression=(1%2B2"
+	req := httptest.NewRequest(http.MethodPost, "/front/add", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = withTestUserID(req, testUserID)
+
+	w := httptest.NewRecorder()
+	handler.HandleFrontAdd(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+	var out struct {
+		Error struct {
+			Code   string `json:"code"`
+			Column int    `json:"column"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatalf("decode response error: %v", err)
+	}
+	if out.Error.Code != "UNCLOSED_PARENTHESIS" || out.Error.Column != 5 {
+		t.Errorf("unexpected diagnostic %+v", out.Error)
+	}
+}
+
 func TestHandleCreateExpression_InvalidExpression_WithAuth(t *testing.T) {
 	repository.Reset()
 	clearDB()
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// IdempotencyKeyHeader lets a client retry POST /api/v1/calculate without
+// creating the expression twice.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader marks an answer repeated for a known key.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+const maxIdempotencyKeyLength = 255
+
+// requestHash identifies the body of a request independently of its
+// formatting.
+func requestHash(req *requestExpression) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey reserves key for the request. It returns false if the
+// key is already taken and the request has been answered: with the
+// original outcome, or with an error when the first request is still in
+// progress or had another body.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, userID int64, key string, req *requestExpression, wait time.Duration) bool {
+	hash := requestHash(req)
+	prev, err := repository.ReserveIdempotencyKey(userID, key, hash, time.Now(), config.IdempotencyTTL())
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] ReserveIdempotencyKey error: %v", err)
+		return false
+	}
+
+	switch {
+	case prev == nil:
+		return true
+	case prev.ExpressionID == "":
+		http.Error(w, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+	case prev.RequestHash != hash:
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+	default:
+		w.Header().Set(idempotentReplayedHeader, "true")
+		respondCreated(w, r, userID, prev.ExpressionID, prev.StatusCode, wait)
+	}
+	return false
+}
+
+// respondCreated answers with the ID of a created expression and, if the
+// client waits for it, the expression itself.
+func respondCreated(w http.ResponseWriter, r *http.Request, userID int64, exprID string, code int, wait time.Duration) {
+	resp := responseCreateExpression{ID: exprID}
+	if wait > 0 {
+		if err := waitForResult(r.Context(), userID, exprID, wait); err != nil {
+			http.Error(w, "error in repository", http.StatusInternalServerError)
+			log.Printf("[DEBUG] waitForResult error: %v", err)
+			return
+		}
+		var err error
+		resp.Expression, err = loadExpression(userID, exprID)
+		if err != nil {
+			http.Error(w, "error in repository", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -2,53 +2,148 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"github.com/TuHeKocmoc/yalyceumfinal2/internal/calc"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/config"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/planner"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
 
-var (
-	additionTime       int
-	subtractionTime    int
-	multiplicationTime int
-	divisionTime       int
-	fullTime           int
-)
+type requestExpression struct {
+	Expression string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables"`
+	// Replication overrides REPLICATION_FACTOR for this expression.
+	Replication int `json:"replication"`
+	// TimeoutMs or Deadline (RFC 3339) limit the computation time.
+	TimeoutMs int64      `json:"timeout_ms"`
+	Deadline  *time.Time `json:"deadline"`
+	// Priority is bounded by the role of the user, see config.MaxPriority.
+	Priority int `json:"priority"`
+	// Tags an agent must have to compute the expression.
+	Tags []string `json:"tags"`
+	// CallbackURL receives a signed webhook once the expression finished.
+	CallbackURL string `json:"callback_url"`
+}
+
+// deadline returns the deadline requested by the client, nil if none.
+func (req *requestExpression) deadline(now time.Time) (*time.Time, error) {
+	switch {
+	case req.TimeoutMs != 0 && req.Deadline != nil:
+		return nil, errors.New("timeout_ms and deadline are mutually exclusive")
+	case req.TimeoutMs < 0:
+		return nil, errors.New("timeout_ms must be positive")
+	case req.TimeoutMs > 0:
+		d := now.Add(time.Duration(req.TimeoutMs) * time.Millisecond)
+		return &d, nil
+	case req.Deadline != nil && !req.Deadline.After(now):
+		return nil, errors.New("deadline is in the past")
+	}
+	return req.Deadline, nil
+}
+
+// requestError is a mistake of the client, answered with status.
+type requestError struct {
+	status int
+	msg    string
+}
 
-func init() {
-	additionTime = getEnvAsInt("TIME_ADDITION_MS", 1000)
-	subtractionTime = getEnvAsInt("TIME_SUBTRACTION_MS", 1200)
-	multiplicationTime = getEnvAsInt("TIME_MULTIPLICATIONS_MS", 2000)
-	divisionTime = getEnvAsInt("TIME_DIVISIONS_MS", 2500)
-	fullTime = getEnvAsInt("TIME_FULL_MS", 3000)
+func (e *requestError) Error() string {
+	return e.msg
 }
 
-func getEnvAsInt(name string, defaultVal int) int {
-	val := os.Getenv(name)
-	if val == "" {
-		return defaultVal
+func badRequest(format string, args ...interface{}) *requestError {
+	return &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+// validExpression is a request that passed validation.
+type validExpression struct {
+	root        parser.Node
+	replication int
+	deadline    *time.Time
+}
+
+// validate checks the request. Mistakes of the client come back as a
+// *requestError or a *parser.Error. role returns the role of the user; it
+// is only called for expressions with a priority.
+func (req *requestExpression) validate(now time.Time, role func() (string, error)) (*validExpression, error) {
+	replication := req.Replication
+	if replication == 0 {
+		replication = config.ReplicationFactor()
+	}
+	if replication < 1 || replication > config.MaxReplication {
+		return nil, badRequest("replication must be between 1 and %d", config.MaxReplication)
 	}
-	parsed, err := strconv.Atoi(val)
+
+	deadline, err := req.deadline(now)
 	if err != nil {
-		return defaultVal
+		return nil, badRequest("%s", err)
+	}
+
+	if req.Priority < 0 {
+		return nil, badRequest("priority must not be negative")
+	}
+	if req.Priority > 0 {
+		r, err := role()
+		if err != nil {
+			return nil, fmt.Errorf("userRole error: %w", err)
+		}
+		if limit := config.MaxPriority(r); req.Priority > limit {
+			return nil, &requestError{
+				status: http.StatusForbidden,
+				msg:    fmt.Sprintf("priority of role %s must not exceed %d", r, limit),
+			}
+		}
+	}
+
+	for _, tag := range req.Tags {
+		if tag == "" || strings.ContainsAny(tag, ", \t\n") {
+			return nil, badRequest("invalid tag %q", tag)
+		}
+	}
+
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return nil, badRequest("%s", err)
+		}
 	}
-	return parsed
+
+	root, err := parser.Parse(req.Expression)
+	if err == nil {
+		err = parser.CheckIdentifiers(req.Expression, root, req.Variables)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &validExpression{root: root, replication: replication, deadline: deadline}, nil
 }
 
-type requestExpression struct {
-	Expression string `json:"expression"`
+// writeRequestError answers a request that failed validation.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var rerr *requestError
+	var perr *parser.Error
+	switch {
+	case errors.As(err, &rerr):
+		http.Error(w, rerr.msg, rerr.status)
+	case errors.As(err, &perr):
+		writeValidationError(w, err)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Printf("[DEBUG] validate error: %v", err)
+	}
 }
 
 type responseCreateExpression struct {
 	ID string `json:"id"`
+	// Expression is only set when the client waited for the result.
+	Expression *model.Expression `json:"expression,omitempty"`
 }
 
 func HandleCreateExpression(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +158,18 @@ func HandleCreateExpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wait, err := parseWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return
+	}
+
 	var req requestExpression
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
@@ -71,39 +178,129 @@ func HandleCreateExpression(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[DEBUG] expression = %q", req.Expression)
 
-	if !calc.CheckInput(req.Expression) {
-		http.Error(w, "expression is not valid", http.StatusUnprocessableEntity)
+	if key != "" {
+		if !claimIdempotencyKey(w, r, userID, key, &req, wait) {
+			return
+		}
+	}
+	created := false
+	defer func() {
+		// Unless the expression got created, the key is free again.
+		if key == "" || created {
+			return
+		}
+		if err := repository.ReleaseIdempotencyKey(userID, key); err != nil {
+			log.Printf("[DEBUG] ReleaseIdempotencyKey error: %v", err)
+		}
+	}()
+
+	valid, err := req.validate(time.Now(), func() (string, error) { return userRole(userID) })
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
-	expr, err := repository.CreateExpression(req.Expression, userID)
+	expr, err := createExpression(userID, &req, valid, key)
 	if err != nil {
 		http.Error(w, "cannot create expression", http.StatusInternalServerError)
+		log.Printf("[DEBUG] createExpression error: %v", err)
 		return
 	}
+	created = true
+	respondCreated(w, r, userID, expr.ID, http.StatusCreated, wait)
+}
 
-	if expr.Raw != "" {
-		finalTaskID, err := planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
-		if err != nil {
-			expr.Status = model.StatusError
-			_ = repository.UpdateExpression(expr)
-			http.Error(w, "cannot plan tasks: "+err.Error(), http.StatusUnprocessableEntity)
-			log.Printf("[DEBUG] PlanTasksWithNestedParen error: %v", err)
-			return
+// createExpression stores and plans the validated request in one
+// transaction, like an item of a batch. The Idempotency-Key of the request,
+// if any, is completed in the same transaction.
+func createExpression(userID int64, req *requestExpression, v *validExpression, key string) (*model.Expression, error) {
+	b, err := repository.BeginExpression(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Rollback()
+
+	expr, err := createExpressionTx(b, req, "", v)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if err := b.CompleteIdempotencyKey(key, expr.ID, http.StatusCreated); err != nil {
+			return nil, err
 		}
+	}
+	if err := b.Commit(); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
 
-		expr.Status = model.StatusInProgress
-		expr.FinalTaskID = finalTaskID
-		_ = repository.UpdateExpression(expr)
+// createExpressionTx stores the validated request in b and plans its
+// tasks. Single expressions and batch items are created alike.
+func createExpressionTx(b *repository.BatchTx, req *requestExpression, label string, v *validExpression) (*model.Expression, error) {
+	expr := &model.Expression{
+		Raw:         req.Expression,
+		Replication: v.replication,
+		Deadline:    v.deadline,
+		Priority:    req.Priority,
+		CallbackURL: req.CallbackURL,
+		Label:       label,
+	}
+	if err := b.CreateExpression(expr, req.Tags); err != nil {
+		return nil, err
+	}
+	finalTaskID, err := planner.PlanTasksIn(b, expr.ID, v.root, req.Variables)
+	if err != nil {
+		return nil, err
 	}
+	if err := b.StartExpression(expr, finalTaskID); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
 
-	resp := responseCreateExpression{ID: expr.ID}
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(resp)
+// splitList parses a comma-separated list, skipping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// userRole returns the role of the user; unknown users are plain users.
+func userRole(userID int64) (string, error) {
+	u, err := repository.GetUserByID(userID)
+	if err != nil {
+		return "", err
+	}
+	if u == nil || u.Role == "" {
+		return model.RoleUser, nil
+	}
+	return u.Role, nil
+}
+
+type responseValidationError struct {
+	Error *parser.Error `json:"error"`
+}
+
+func writeValidationError(w http.ResponseWriter, err error) {
+	var perr *parser.Error
+	if !errors.As(err, &perr) {
+		http.Error(w, "expression is not valid", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(responseValidationError{Error: perr})
 }
 
 type responseExpressionsList struct {
 	Expressions []*model.Expression `json:"expressions"`
+	// NextCursor fetches the next page with ?cursor=, empty on the last one.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 func HandleGetAllExpressions(w http.ResponseWriter, r *http.Request) {
@@ -118,14 +315,26 @@ func HandleGetAllExpressions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exprs, err := repository.GetAllExpressions(userID)
+	filter, err := parseExpressionFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exprs, next, err := repository.ListExpressions(userID, filter)
 	if err != nil {
 		http.Error(w, "failed to get expressions", http.StatusInternalServerError)
-		log.Printf("[DEBUG] GetAllExpressions error: %v", err)
+		log.Printf("[DEBUG] ListExpressions error: %v", err)
 		return
 	}
+	if exprs == nil {
+		exprs = []*model.Expression{}
+	}
 
 	resp := responseExpressionsList{Expressions: exprs}
+	if next != nil {
+		resp.NextCursor = encodeCursor(filter, next)
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
@@ -146,28 +355,148 @@ func HandleGetExpressionByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /api/v1/expressions/{id}
 	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
+	if len(parts) < 5 || parts[4] == "" {
 		http.Error(w, "invalid url", http.StatusBadRequest)
 		return
 	}
-	id := parts[3]
+	id := parts[4]
+
+	wait, err := parseWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := waitForResult(r.Context(), userID, id, wait); err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] waitForResult error: %v", err)
+		return
+	}
+
+	expr, err := loadExpression(userID, id)
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		return
+	}
+	if expr == nil {
+		http.Error(w, "expression not found", http.StatusNotFound)
+		return
+	}
+
+	resp := responseSingleExpression{Expression: expr}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
 
+// loadExpression returns the expression of userID with its progress and
+// tags, nil if there is no such expression.
+func loadExpression(userID int64, id string) (*model.Expression, error) {
 	expr, err := repository.GetExpressionByID(userID, id)
+	if err != nil || expr == nil {
+		return nil, err
+	}
+	expr.Progress, err = repository.GetExpressionProgress(expr.ID)
+	if err != nil {
+		return nil, err
+	}
+	expr.Tags, err = repository.GetExpressionTags(expr.ID)
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// HandleExpression routes /api/v1/expressions/{id} by method and
+// /api/v1/expressions/{id}/cancel.
+func HandleExpression(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	switch {
+	case len(parts) == 5 && parts[4] == "events":
+		HandleEvents(w, r)
+	case len(parts) == 6 && parts[5] == "events":
+		HandleExpressionEvents(w, r)
+	case len(parts) == 6 && parts[5] == "cancel":
+		HandleCancelExpression(w, r)
+	case r.Method == http.MethodDelete:
+		HandleDeleteExpression(w, r)
+	default:
+		HandleGetExpressionByID(w, r)
+	}
+}
+
+func HandleCancelExpression(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /api/v1/expressions/{id}/cancel
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 6 || parts[4] == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	expr, err := repository.CancelExpression(userID, parts[4])
 	if err != nil {
 		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] CancelExpression error: %v", err)
 		return
 	}
 	if expr == nil {
 		http.Error(w, "expression not found", http.StatusNotFound)
 		return
 	}
+	if expr.Status != model.StatusCancelled {
+		http.Error(w, "expression is already finished", http.StatusConflict)
+		return
+	}
 
 	resp := responseSingleExpression{Expression: expr}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
 
+func HandleDeleteExpression(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /api/v1/expressions/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 5 || parts[4] == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := repository.DeleteExpression(userID, parts[4])
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] DeleteExpression error: %v", err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "expression not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type responseTask struct {
 	Task struct {
 		ID            int         `json:"id"`
@@ -175,6 +504,9 @@ type responseTask struct {
 		Arg2          interface{} `json:"arg2"`
 		Operation     string      `json:"operation"`
 		OperationTime int         `json:"operation_time"`
+		Args          []float64   `json:"args,omitempty"`
+		LeaseMs       int64       `json:"lease_ms"`
+		DeadlineMs    int64       `json:"deadline_ms,omitempty"`
 	} `json:"task"`
 }
 
@@ -184,7 +516,11 @@ func HandleGetTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := repository.GetNextWaitingTask()
+	// ?operations=+,-,sqrt&tags=gpu-free restrict the task to the agent's
+	// capabilities.
+	q := r.URL.Query()
+	caps := model.Capabilities{Operations: splitList(q.Get("operations")), Tags: splitList(q.Get("tags"))}
+	task, err := repository.ClaimNextTaskFor(q.Get("agent_id"), caps, config.LeaseDuration)
 	if err != nil {
 		http.Error(w, "failed to get task", http.StatusInternalServerError)
 		return
@@ -193,16 +529,12 @@ func HandleGetTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no task available", http.StatusNotFound)
 		return
 	}
+	lease := config.LeaseDuration(task.Op)
 
-	task.Status = model.TaskStatusInProgress
-	if err := repository.UpdateTask(task); err != nil {
-		http.Error(w, "failed to update task", http.StatusInternalServerError)
-		return
-	}
-
-	operationTime := getOperationTime(task.Op)
+	operationTime := config.OperationTime(task.Op)
 
 	var arg1, arg2 interface{}
+	var args []float64
 	if task.Op == "FULL" {
 		expr, err := repository.GetExpressionByIDForTask(task.ExpressionID)
 		if err != nil {
@@ -218,6 +550,9 @@ func HandleGetTask(w http.ResponseWriter, r *http.Request) {
 	} else {
 		arg1 = fetchArgumentValue(task.Arg1Value, task.Arg1TaskID)
 		arg2 = fetchArgumentValue(task.Arg2Value, task.Arg2TaskID)
+		for _, arg := range task.Args() {
+			args = append(args, fetchArgumentValue(arg.Value, arg.TaskID).(float64))
+		}
 	}
 
 	var resp responseTask
@@ -226,6 +561,11 @@ func HandleGetTask(w http.ResponseWriter, r *http.Request) {
 	resp.Task.Arg2 = arg2
 	resp.Task.Operation = task.Op
 	resp.Task.OperationTime = operationTime
+	resp.Task.Args = args
+	resp.Task.LeaseMs = lease.Milliseconds()
+	if task.Deadline != nil {
+		resp.Task.DeadlineMs = max(time.Until(*task.Deadline).Milliseconds(), 1)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
@@ -247,6 +587,12 @@ func fetchArgumentValue(argValue *float64, argTaskID *int) interface{} {
 type rawTaskResult struct {
 	ID     json.Number `json:"id"`
 	Result json.Number `json:"result"`
+	// Error is set instead of Result when the agent failed to compute the task.
+	Error   string `json:"error"`
+	AgentID string `json:"agent_id"`
+	// Transient errors requeue the task under the retry policy instead of
+	// failing it.
+	Transient bool `json:"transient"`
 }
 
 func HandlePostTaskResult(w http.ResponseWriter, r *http.Request) {
@@ -266,10 +612,13 @@ func HandlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "id must be an integer", http.StatusUnprocessableEntity)
 		return
 	}
-	resultFloat64, err := raw.Result.Float64()
-	if err != nil {
-		http.Error(w, "result must be a float", http.StatusUnprocessableEntity)
-		return
+	var resultFloat64 float64
+	if raw.Error == "" {
+		resultFloat64, err = raw.Result.Float64()
+		if err != nil {
+			http.Error(w, "result must be a float", http.StatusUnprocessableEntity)
+			return
+		}
 	}
 	taskID := int(idInt64)
 
@@ -282,86 +631,44 @@ func HandlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "task not found", http.StatusNotFound)
 		return
 	}
+	if task.Status == model.TaskStatusCancelled {
+		http.Error(w, "task cancelled", http.StatusGone)
+		return
+	}
 	if task.Status != model.TaskStatusInProgress {
 		http.Error(w, "task not in progress", http.StatusBadRequest)
 		return
 	}
-
-	task.Status = model.TaskStatusDone
-	task.Result = &resultFloat64
-	if err := repository.UpdateTask(task); err != nil {
-		http.Error(w, "failed to update task", http.StatusInternalServerError)
+	if task.LeaseOwner != raw.AgentID {
+		http.Error(w, "lease lost: task is assigned to another agent", http.StatusConflict)
 		return
 	}
 
-	expr, err := repository.GetExpressionByIDForTask(task.ExpressionID)
-	if err != nil || expr == nil {
-		http.Error(w, "expression not found", http.StatusInternalServerError)
-		return
-	}
-
-	if task.Op == "FULL" {
-		expr.Result = &resultFloat64
-		expr.Status = model.StatusDone
-		_ = repository.UpdateExpression(expr)
-	} else {
-		done, lastTaskResult, err := checkAllTasksDone(expr.ID)
-		if err != nil {
-			http.Error(w, "cannot check tasks", http.StatusInternalServerError)
+	if raw.Error != "" && raw.Transient {
+		if _, err := repository.RetryOrExpireTask(task.ID, raw.AgentID, raw.Error, time.Duration(config.OperationTime(task.Op))*time.Millisecond); err != nil {
+			http.Error(w, "failed to update task", http.StatusInternalServerError)
 			return
 		}
-		if done {
-			expr.Result = lastTaskResult
-			expr.Status = model.StatusDone
-			if err := repository.UpdateExpression(expr); err != nil {
-				http.Error(w, "failed to update expression", http.StatusInternalServerError)
-				return
-			}
-		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status":"ok"}`)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"ok"}`)
-}
-
-func checkAllTasksDone(exprID string) (bool, *float64, error) {
-	tasks, err := repository.GetTasksByExpressionID(exprID)
-	if err != nil {
-		return false, nil, err
+	var result *float64
+	if raw.Error == "" {
+		result = &resultFloat64
 	}
-	if len(tasks) == 0 {
-		return true, nil, nil
+	held, err := agents.Default.RecordRun(task, raw.AgentID, result, raw.Error)
+	if err != nil {
+		log.Printf("[DEBUG] RecordRun error: %v", err)
+		http.Error(w, "failed to update task", http.StatusInternalServerError)
+		return
 	}
-
-	allDone := true
-	var lastResult *float64
-	var lastTaskID int
-
-	for _, t := range tasks {
-		if t.Status != model.TaskStatusDone {
-			allDone = false
-		}
-		if t.ID > lastTaskID && t.Result != nil {
-			lastTaskID = t.ID
-			lastResult = t.Result
-		}
+	if !held {
+		http.Error(w, "lease lost: task is assigned to another agent", http.StatusConflict)
+		return
 	}
-	return allDone, lastResult, nil
-}
 
-func getOperationTime(op string) int {
-	switch op {
-	case "+", "ADD":
-		return additionTime
-	case "-", "SUB":
-		return subtractionTime
-	case "*", "MUL":
-		return multiplicationTime
-	case "/", "DIV":
-		return divisionTime
-	case "FULL":
-		return fullTime
-	default:
-		return additionTime
-	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"status":"ok"}`)
 }
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// Page sizes of GET /api/v1/expressions.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var expressionStatuses = map[string]bool{
+	model.StatusPending:    true,
+	model.StatusInProgress: true,
+	model.StatusDone:       true,
+	model.StatusError:      true,
+	model.StatusCancelled:  true,
+	model.StatusTimeout:    true,
+}
+
+// parseExpressionFilter reads the query of GET /api/v1/expressions: limit,
+// status (comma-separated), created_from and created_to (RFC 3339), q,
+// sort (created_at or finished_at), order (asc or desc) and cursor. Without
+// limit and cursor the whole list is returned, as it was before pagination.
+func parseExpressionFilter(r *http.Request) (repository.ExpressionFilter, error) {
+	q := r.URL.Query()
+	f := repository.ExpressionFilter{Search: q.Get("q")}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		f.Limit = n
+	} else if q.Get("cursor") != "" {
+		f.Limit = defaultPageSize
+	}
+
+	for _, status := range splitList(strings.ToUpper(q.Get("status"))) {
+		if !expressionStatuses[status] {
+			return f, fmt.Errorf("unknown status %q", status)
+		}
+		f.Statuses = append(f.Statuses, status)
+	}
+
+	var err error
+	if f.CreatedFrom, err = parseTimeParam(r, "created_from"); err != nil {
+		return f, err
+	}
+	if f.CreatedTo, err = parseTimeParam(r, "created_to"); err != nil {
+		return f, err
+	}
+
+	switch f.Sort = q.Get("sort"); f.Sort {
+	case "":
+		f.Sort = repository.SortCreated
+	case repository.SortCreated, repository.SortFinished:
+	default:
+		return f, errors.New("sort must be created_at or finished_at")
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		f.Desc = true
+	default:
+		return f, errors.New("order must be asc or desc")
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeCursor(f, s)
+		if err != nil {
+			return f, err
+		}
+		f.After = c
+	}
+	return f, nil
+}
+
+// parseTimeParam reads an optional RFC 3339 query parameter.
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return &t, nil
+}
+
+// encodeCursor makes an opaque cursor that is only valid for the same sort
+// order and filters.
+func encodeCursor(f repository.ExpressionFilter, c *repository.ExpressionCursor) string {
+	raw := fmt.Sprintf("%s:%t:%s:%d:%d", f.Sort, f.Desc, filterFingerprint(f), c.Key, c.Row)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// filterFingerprint hashes the filters of f that select the expressions.
+func filterFingerprint(f repository.ExpressionFilter) string {
+	millis := func(t *time.Time) int64 {
+		if t == nil {
+			return -1
+		}
+		return t.UnixMilli()
+	}
+	statuses := slices.Clone(f.Statuses)
+	slices.Sort(statuses)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d",
+		strings.Join(statuses, ","), f.Search, millis(f.CreatedFrom), millis(f.CreatedTo))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func decodeCursor(f repository.ExpressionFilter, s string) (*repository.ExpressionCursor, error) {
+	errInvalid := errors.New("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 5 {
+		return nil, errInvalid
+	}
+	if parts[0] != f.Sort || parts[1] != strconv.FormatBool(f.Desc) {
+		return nil, errors.New("cursor belongs to another sort order")
+	}
+	if parts[2] != filterFingerprint(f) {
+		return nil, errors.New("cursor belongs to other filters")
+	}
+	var c repository.ExpressionCursor
+	if c.Key, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return nil, errInvalid
+	}
+	if c.Row, err = strconv.ParseInt(parts[4], 10, 64); err != nil {
+		return nil, errInvalid
+	}
+	return &c, nil
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+type requestWebhook struct {
+	URL string `json:"url"`
+}
+
+type responseDeliveries struct {
+	Deliveries []*model.WebhookDelivery `json:"deliveries"`
+}
+
+// validateCallbackURL accepts absolute http and https URLs.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback url must be an absolute http or https url")
+	}
+	return nil
+}
+
+// HandleWebhook shows (GET) or sets (PUT) the account-wide webhook of the
+// user together with the secret signing its payloads.
+func HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var hook *model.Webhook
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		hook, err = repository.GetWebhook(userID)
+	case http.MethodPut:
+		var req requestWebhook
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.URL != "" {
+			if err := validateCallbackURL(req.URL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		hook, err = repository.SetWebhook(userID, req.URL)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] webhook error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// HandleWebhookDeliveries lists the latest webhook deliveries of the user,
+// only those of one expression with ?expression_id=.
+func HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	list, err := repository.GetWebhookDeliveries(userID, r.URL.Query().Get("expression_id"))
+	if err != nil {
+		http.Error(w, "error in repository", http.StatusInternalServerError)
+		log.Printf("[DEBUG] GetWebhookDeliveries error: %v", err)
+		return
+	}
+	if list == nil {
+		list = []*model.WebhookDelivery{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(responseDeliveries{Deliveries: list})
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// Aggregate statuses of a batch.
+const (
+	BatchInProgress = "IN_PROGRESS"
+	BatchDone       = "DONE"
+	// BatchFailed means all expressions finished, some of them not DONE.
+	BatchFailed = "FAILED"
+)
+
+// Batch is a group of expressions submitted by one request.
+type Batch struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	Total     int       `json:"total"`
+	// Counts maps the statuses of the expressions to how many have each.
+	Counts      map[string]int `json:"counts"`
+	Expressions []*Expression  `json:"expressions"`
+}
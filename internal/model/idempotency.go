@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// IdempotencyKey remembers the outcome of a request sent with an
+// Idempotency-Key header. ExpressionID is empty while the first request is
+// still being processed.
+type IdempotencyKey struct {
+	Key          string
+	RequestHash  string
+	ExpressionID string
+	StatusCode   int
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
@@ -1,10 +1,14 @@
 package model
 
+import "time"
+
 const (
 	StatusPending    = "PENDING"
 	StatusInProgress = "IN_PROGRESS"
 	StatusDone       = "DONE"
 	StatusError      = "ERROR"
+	StatusCancelled  = "CANCELLED"
+	StatusTimeout    = "TIMEOUT"
 )
 
 const (
@@ -12,6 +16,13 @@ const (
 	TaskStatusInProgress = "IN_PROGRESS"
 	TaskStatusDone       = "DONE"
 	TaskStatusError      = "ERROR"
+	TaskStatusCancelled  = "CANCELLED"
+	// TaskStatusDead is terminal for a task that failed transiently more
+	// often than the retry policy allows; only an operator requeues it.
+	TaskStatusDead = "DEAD"
+	// TaskStatusReplicated is the status of a task computed by replicas
+	// until their vote decides it.
+	TaskStatusReplicated = "REPLICATED"
 )
 
 type Expression struct {
@@ -22,19 +33,117 @@ type Expression struct {
 	Tasks       []int    `json:"tasks"`
 	FinalTaskID int      `json:"final_task_id,omitempty"`
 	UserID      int64    `json:"user_id"`
+	Error       string   `json:"error,omitempty"`
+	// Replication is how many distinct agents compute every task of the
+	// expression before their results are compared.
+	Replication int `json:"replication,omitempty"`
+	// Deadline stops the computation; unfinished expressions time out.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Priority orders the expressions of all users; tasks of a higher
+	// priority are handed out first.
+	Priority int `json:"priority,omitempty"`
+	// Tags an agent must have to compute the tasks of the expression.
+	Tags []string `json:"tags,omitempty"`
+	// Unroutable explains why no live agent can compute the ready tasks.
+	Unroutable string `json:"unroutable,omitempty"`
+	// CallbackURL receives a webhook once the expression finished.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// CreatedAt and FinishedAt are when the expression was submitted and
+	// when it reached a final status.
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// BatchID and Label are set for expressions submitted in a batch.
+	BatchID  string    `json:"batch_id,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Progress counts the finished tasks of an expression.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	// Dead tasks wait for an operator to requeue them.
+	Dead int `json:"dead,omitempty"`
+}
+
+// Finished reports whether the expression reached a final status.
+func (e *Expression) Finished() bool {
+	return e.Status != StatusPending && e.Status != StatusInProgress
 }
 
 type Task struct {
 	ID           int    `json:"id"`
 	ExpressionID string `json:"expression_id"`
+	// ReplicaOf is the task this one is a replica of, see
+	// TaskStatusReplicated.
+	ReplicaOf int `json:"replica_of,omitempty"`
 
 	Arg1Value  *float64 `json:"arg1_value,omitempty"`
 	Arg1TaskID *int     `json:"arg1_task_id,omitempty"`
 
 	Arg2Value  *float64 `json:"arg2_value,omitempty"`
 	Arg2TaskID *int     `json:"arg2_task_id,omitempty"`
-	Op         string   `json:"op"`
-	Result     *float64 `json:"result"`
+	// ExtraArgs holds the arguments after the second one for n-ary functions.
+	ExtraArgs []TaskArg `json:"extra_args,omitempty"`
+
+	Op     string   `json:"op"`
+	Result *float64 `json:"result"`
 
 	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// LeaseOwner is the agent computing the task; the lease is valid until
+	// LeaseExpiresAt unless renewed.
+	LeaseOwner     string     `json:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	// Deadline of the expression, only loaded when the task is claimed.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// Attempts counts the transient failures of the task: expired leases,
+	// lost agents and errors agents reported as transient. LastError is
+	// the latest of them and RetryAt delays the next attempt.
+	Attempts  int        `json:"attempts,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+// Capabilities describe the tasks an agent can compute. An empty Operations
+// list means any operation.
+type Capabilities struct {
+	Operations []string
+	Tags       []string
+}
+
+// Outcomes of a task run once its vote is decided.
+const (
+	VoteAgreed   = "AGREED"
+	VoteOutvoted = "OUTVOTED"
+)
+
+// TaskRun is the answer of one agent for a replicated task: either Result or
+// Error is set.
+type TaskRun struct {
+	ID        int       `json:"id"`
+	TaskID    int       `json:"task_id"`
+	AgentID   string    `json:"agent_id"`
+	Result    *float64  `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Vote      string    `json:"vote,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TaskArg is either a literal value or a reference to the task computing it.
+type TaskArg struct {
+	Value  *float64 `json:"value,omitempty"`
+	TaskID *int     `json:"task_id,omitempty"`
+}
+
+// Args returns all arguments of the task in order. The second argument is
+// omitted when it is not set, as for unary functions.
+func (t *Task) Args() []TaskArg {
+	args := []TaskArg{{Value: t.Arg1Value, TaskID: t.Arg1TaskID}}
+	if t.Arg2Value != nil || t.Arg2TaskID != nil || len(t.ExtraArgs) > 0 {
+		args = append(args, TaskArg{Value: t.Arg2Value, TaskID: t.Arg2TaskID})
+	}
+	return append(args, t.ExtraArgs...)
 }
@@ -1,7 +1,14 @@
 package model
 
+// Roles bound the priority a user may give to expressions.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID           int64
 	Login        string
 	PasswordHash string
+	Role         string
 }
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Statuses of a webhook delivery.
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED"
+)
+
+// Webhook is where the finished expressions of a user are reported. Secret
+// signs the payloads.
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// WebhookDelivery is a payload POSTed to a callback URL once an expression
+// finished, retried until the receiver accepts it or the retries run out.
+type WebhookDelivery struct {
+	ID           int64           `json:"id"`
+	UserID       int64           `json:"-"`
+	ExpressionID string          `json:"expression_id"`
+	URL          string          `json:"url"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	// ResponseCode and LastError describe the latest failed attempt.
+	ResponseCode  int        `json:"response_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	// Secret of the user, loaded only for sending.
+	Secret string `json:"-"`
+}
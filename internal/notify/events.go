@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"sync"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+)
+
+// Event types published to Events.
+const (
+	// EventTask is published when a task finished, Task holds it.
+	EventTask = "task"
+	// EventExpression is published when an expression changed its status,
+	// Expression holds it.
+	EventExpression = "expression"
+	// EventDeleted is published when an expression was deleted; no more
+	// events of it follow.
+	EventDeleted = "deleted"
+)
+
+// Event is a change of an expression of UserID.
+type Event struct {
+	Type         string
+	UserID       int64
+	ExpressionID string
+	Task         *model.Task
+	Expression   *model.Expression
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped.
+const subscriberBuffer = 64
+
+// Hub delivers published events to the subscribers of their user. Publish
+// never blocks: a subscriber that does not keep up loses its subscription
+// and finds its channel closed.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan Event]int64
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan Event]int64)}
+}
+
+// Subscribe returns a channel receiving the events of userID and a function
+// ending the subscription.
+func (h *Hub) Subscribe(userID int64) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	h.mu.Lock()
+	h.subs[ch] = userID
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.drop(ch)
+	}
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, userID := range h.subs {
+		if userID != e.UserID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			h.drop(ch)
+		}
+	}
+}
+
+func (h *Hub) drop(ch chan Event) {
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Events carries task completions and expression status changes to the
+// streams of their users.
+var Events = NewHub()
@@ -0,0 +1,36 @@
+package notify
+
+import "sync"
+
+// Broadcaster wakes up every goroutine waiting for an event. A waiter takes
+// the channel from Wait before checking its condition, so an event that
+// happens in between is not lost.
+type Broadcaster struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed on the next Broadcast.
+func (b *Broadcaster) Wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ch
+}
+
+func (b *Broadcaster) Broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// TasksReady fires whenever a task may have become ready to be claimed:
+// a task was created, finished or returned to the queue.
+var TasksReady = NewBroadcaster()
+
+// WebhooksQueued fires when webhook deliveries were queued.
+var WebhooksQueued = NewBroadcaster()
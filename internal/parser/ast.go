@@ -0,0 +1,45 @@
+package parser
+
+// Node is an element of the expression tree. Pos returns the byte offset
+// of the first character of the node in the source expression.
+type Node interface {
+	Pos() int
+}
+
+type Number struct {
+	Value    float64
+	Raw      string
+	ValuePos int
+}
+
+type Unary struct {
+	Op    string
+	X     Node
+	OpPos int
+}
+
+type Binary struct {
+	Op    string
+	X     Node
+	Y     Node
+	OpPos int
+}
+
+// Ident is a reference to a built-in constant or a user-supplied variable.
+type Ident struct {
+	Name    string
+	NamePos int
+}
+
+// Call is a call of one of the built-in Functions.
+type Call struct {
+	Name    string
+	Args    []Node
+	NamePos int
+}
+
+func (n *Number) Pos() int { return n.ValuePos }
+func (n *Ident) Pos() int  { return n.NamePos }
+func (n *Call) Pos() int   { return n.NamePos }
+func (n *Unary) Pos() int  { return n.OpPos }
+func (n *Binary) Pos() int { return n.X.Pos() }
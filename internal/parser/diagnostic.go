@@ -0,0 +1,44 @@
+package parser
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	ErrEmptyExpression     = "EMPTY_EXPRESSION"
+	ErrUnexpectedCharacter = "UNEXPECTED_CHARACTER"
+	ErrMalformedNumber     = "MALFORMED_NUMBER"
+	ErrMissingOperand      = "MISSING_OPERAND"
+	ErrMissingOperator     = "MISSING_OPERATOR"
+	ErrUnexpectedToken     = "UNEXPECTED_TOKEN"
+	ErrUnclosedParen       = "UNCLOSED_PARENTHESIS"
+	ErrUnmatchedParen      = "UNMATCHED_PARENTHESIS"
+	ErrUnknownFunction     = "UNKNOWN_FUNCTION"
+	ErrArgumentCount       = "ARGUMENT_COUNT"
+	ErrUnboundIdentifier   = "UNBOUND_IDENTIFIER"
+	ErrReservedName        = "RESERVED_NAME"
+)
+
+// Error describes why an expression was rejected. Pos is a byte offset into
+// the source, Column is the 1-based character column of the same place.
+type Error struct {
+	Code       string `json:"code"`
+	Msg        string `json:"message"`
+	Pos        int    `json:"offset"`
+	Column     int    `json:"column"`
+	Token      string `json:"token"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+func (e *Error) locate(src string) *Error {
+	if e.Pos > len(src) {
+		e.Pos = len(src)
+	}
+	e.Column = utf8.RuneCountInString(src[:e.Pos]) + 1
+	return e
+}
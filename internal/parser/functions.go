@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Arity is the number of arguments a function accepts. Max < 0 means the
+// function is variadic.
+type Arity struct {
+	Min int
+	Max int
+}
+
+func (a Arity) accepts(n int) bool {
+	return n >= a.Min && (a.Max < 0 || n <= a.Max)
+}
+
+// Functions lists the built-in functions of the expression language.
+var Functions = map[string]Arity{
+	"sqrt":  {Min: 1, Max: 1},
+	"abs":   {Min: 1, Max: 1},
+	"sin":   {Min: 1, Max: 1},
+	"cos":   {Min: 1, Max: 1},
+	"tan":   {Min: 1, Max: 1},
+	"exp":   {Min: 1, Max: 1},
+	"ln":    {Min: 1, Max: 1},
+	"log10": {Min: 1, Max: 1},
+	"log":   {Min: 1, Max: 2},
+	"round": {Min: 1, Max: 1},
+	"min":   {Min: 1, Max: -1},
+	"max":   {Min: 1, Max: -1},
+}
+
+func (a Arity) String() string {
+	switch {
+	case a.Max < 0:
+		return fmt.Sprintf("at least %d argument(s)", a.Min)
+	case a.Min == a.Max:
+		return fmt.Sprintf("%d argument(s)", a.Min)
+	default:
+		return fmt.Sprintf("%d to %d arguments", a.Min, a.Max)
+	}
+}
+
+func functionList() string {
+	names := make([]string, 0, len(Functions))
+	for name := range Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func IsFunction(name string) bool {
+	_, ok := Functions[name]
+	return ok
+}
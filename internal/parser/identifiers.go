@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+)
+
+// Constants are the names that are always bound.
+var Constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// Lookup returns the value bound to name, either a constant or a variable.
+func Lookup(name string, vars map[string]float64) (float64, bool) {
+	if v, ok := Constants[name]; ok {
+		return v, true
+	}
+	v, ok := vars[name]
+	return v, ok
+}
+
+// CheckIdentifiers reports the first identifier of root that is neither a
+// constant nor one of vars. Variables may not shadow constants or functions.
+func CheckIdentifiers(src string, root Node, vars map[string]float64) error {
+	for name := range vars {
+		if _, ok := Constants[name]; ok || IsFunction(name) {
+			return (&Error{
+				Code:       ErrReservedName,
+				Msg:        fmt.Sprintf("variable %q shadows a built-in name", name),
+				Token:      name,
+				Suggestion: "rename the variable",
+			}).locate(src)
+		}
+	}
+
+	var unbound *Ident
+	walk(root, func(n Node) bool {
+		id, ok := n.(*Ident)
+		if !ok {
+			return true
+		}
+		if _, bound := Lookup(id.Name, vars); !bound {
+			unbound = id
+			return false
+		}
+		return true
+	})
+	if unbound == nil {
+		return nil
+	}
+	return (&Error{
+		Code:       ErrUnboundIdentifier,
+		Msg:        fmt.Sprintf("unknown identifier %q", unbound.Name),
+		Pos:        unbound.NamePos,
+		Token:      unbound.Name,
+		Suggestion: fmt.Sprintf("pass a value for %q in \"variables\"", unbound.Name),
+	}).locate(src)
+}
+
+// walk visits the nodes of the tree in source order until visit returns false.
+func walk(n Node, visit func(Node) bool) bool {
+	if !visit(n) {
+		return false
+	}
+	switch n := n.(type) {
+	case *Unary:
+		return walk(n.X, visit)
+	case *Binary:
+		return walk(n.X, visit) && walk(n.Y, visit)
+	case *Call:
+		for _, arg := range n.Args {
+			if !walk(arg, visit) {
+				return false
+			}
+		}
+	}
+	return true
+}
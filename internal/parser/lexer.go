@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNumber
+	TokenIdent
+	TokenComma
+	TokenPlus
+	TokenMinus
+	TokenStar
+	TokenSlash
+	TokenDoubleSlash
+	TokenPercent
+	TokenCaret
+	TokenLParen
+	TokenRParen
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
+		return "end of expression"
+	case TokenNumber:
+		return "number"
+	case TokenIdent:
+		return "identifier"
+	case TokenComma:
+		return "','"
+	case TokenPlus:
+		return "'+'"
+	case TokenMinus:
+		return "'-'"
+	case TokenStar:
+		return "'*'"
+	case TokenSlash:
+		return "'/'"
+	case TokenDoubleSlash:
+		return "'//'"
+	case TokenPercent:
+		return "'%'"
+	case TokenCaret:
+		return "'^'"
+	case TokenLParen:
+		return "'('"
+	case TokenRParen:
+		return "')'"
+	default:
+		return fmt.Sprintf("token(%d)", int(k))
+	}
+}
+
+// Token is a lexeme of the expression. Pos is a byte offset into the source.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+}
+
+func Tokenize(src string) ([]Token, error) {
+	var tokens []Token
+	i := 0
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case isDigit(src[i]) || src[i] == '.':
+			start := i
+			end, err := scanNumber(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: src[start:end], Pos: start})
+			i = end
+			continue
+		case isIdentStart(src[i]):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: TokenIdent, Text: src[start:i], Pos: start})
+			continue
+		}
+
+		if strings.HasPrefix(src[i:], "//") {
+			tokens = append(tokens, Token{Kind: TokenDoubleSlash, Text: "//", Pos: i})
+			i += 2
+			continue
+		}
+
+		kind, ok := singleCharTokens[src[i]]
+		if !ok {
+			return nil, &Error{
+				Code:       ErrUnexpectedCharacter,
+				Msg:        fmt.Sprintf("unexpected character %q", r),
+				Pos:        i,
+				Token:      string(r),
+				Suggestion: "only numbers, functions, + - * / // % ^, commas and parentheses are allowed",
+			}
+		}
+		tokens = append(tokens, Token{Kind: kind, Text: src[i : i+1], Pos: i})
+		i++
+	}
+	tokens = append(tokens, Token{Kind: TokenEOF, Pos: len(src)})
+	return tokens, nil
+}
+
+func (k TokenKind) isOperator() bool {
+	switch k {
+	case TokenPlus, TokenMinus, TokenStar, TokenSlash, TokenDoubleSlash, TokenPercent, TokenCaret:
+		return true
+	}
+	return false
+}
+
+var singleCharTokens = map[byte]TokenKind{
+	'+': TokenPlus,
+	'-': TokenMinus,
+	'*': TokenStar,
+	'/': TokenSlash,
+	'%': TokenPercent,
+	'^': TokenCaret,
+	',': TokenComma,
+	'(': TokenLParen,
+	')': TokenRParen,
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
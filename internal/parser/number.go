@@ -0,0 +1,178 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// scanNumber returns the end offset of the numeric literal starting at
+// start. Accepted forms are decimals ("12", "1.5", "1.", ".5") with an
+// optional exponent ("1e-9", "2.5E3"), hexadecimal ("0xFF") and binary
+// ("0b1010") integers. Digits of any form may be grouped with single
+// underscores ("1_000_000").
+func scanNumber(src string, start int) (int, error) {
+	if start+1 < len(src) && src[start] == '0' {
+		switch src[start+1] {
+		case 'x', 'X':
+			return scanPrefixed(src, start, "hexadecimal", isHexDigit)
+		case 'b', 'B':
+			return scanPrefixed(src, start, "binary", isBinaryDigit)
+		}
+	}
+
+	i, digits, err := scanDigits(src, start, isDigit)
+	if err != nil {
+		return 0, err
+	}
+	if i < len(src) && src[i] == '.' {
+		var frac int
+		i, frac, err = scanDigits(src, i+1, isDigit)
+		if err != nil {
+			return 0, err
+		}
+		digits += frac
+		if i < len(src) && src[i] == '.' {
+			return 0, &Error{
+				Code:       ErrMalformedNumber,
+				Msg:        "unexpected second decimal point",
+				Pos:        i,
+				Token:      src[start : i+1],
+				Suggestion: "a number can contain only one '.'",
+			}
+		}
+	}
+	if digits == 0 {
+		return 0, &Error{
+			Code:  ErrMalformedNumber,
+			Msg:   "malformed number",
+			Pos:   start,
+			Token: src[start:i],
+		}
+	}
+	if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+		j := i + 1
+		if j < len(src) && (src[j] == '+' || src[j] == '-') {
+			j++
+		}
+		end, exp, err := scanDigits(src, j, isDigit)
+		if err != nil {
+			return 0, err
+		}
+		if exp == 0 {
+			return 0, &Error{
+				Code:       ErrMalformedNumber,
+				Msg:        "exponent has no digits",
+				Pos:        i,
+				Token:      src[start:j],
+				Suggestion: "write the exponent as e.g. 1e-9 or 2.5E3",
+			}
+		}
+		i = end
+	}
+	return i, checkLiteralEnd(src, start, i, "decimal")
+}
+
+func scanPrefixed(src string, start int, base string, valid func(byte) bool) (int, error) {
+	i, digits, err := scanDigits(src, start+2, valid)
+	if err != nil {
+		return 0, err
+	}
+	if digits == 0 {
+		return 0, &Error{
+			Code:       ErrMalformedNumber,
+			Msg:        fmt.Sprintf("%s literal has no digits", base),
+			Pos:        start,
+			Token:      src[start : start+2],
+			Suggestion: "write e.g. 0xFF or 0b1010",
+		}
+	}
+	return i, checkLiteralEnd(src, start, i, base)
+}
+
+// scanDigits consumes digits accepted by valid, allowing a single '_'
+// between two of them. It returns the end offset and the digit count.
+func scanDigits(src string, i int, valid func(byte) bool) (int, int, error) {
+	digits := 0
+	for i < len(src) {
+		switch {
+		case valid(src[i]):
+			digits++
+			i++
+		case src[i] == '_':
+			if digits == 0 || i+1 >= len(src) || !valid(src[i+1]) {
+				return 0, 0, &Error{
+					Code:       ErrMalformedNumber,
+					Msg:        "misplaced digit separator",
+					Pos:        i,
+					Token:      "_",
+					Suggestion: "'_' may only appear between two digits",
+				}
+			}
+			i++
+		default:
+			return i, digits, nil
+		}
+	}
+	return i, digits, nil
+}
+
+// checkLiteralEnd rejects literals glued to letters or digits that do not
+// belong to them, such as "0b102", "0xFG" or "12abc".
+func checkLiteralEnd(src string, start, end int, base string) error {
+	if end >= len(src) || !isIdentPart(src[end]) {
+		return nil
+	}
+	stop := end
+	for stop < len(src) && isIdentPart(src[stop]) {
+		stop++
+	}
+	return &Error{
+		Code:       ErrMalformedNumber,
+		Msg:        fmt.Sprintf("invalid character %q in %s literal", src[end], base),
+		Pos:        end,
+		Token:      src[start:stop],
+		Suggestion: "separate numbers and names with an operator",
+	}
+}
+
+func isBinaryDigit(c byte) bool {
+	return c == '0' || c == '1'
+}
+
+// ParseNumber converts a literal accepted by the lexer to its value.
+func ParseNumber(text string) (float64, error) {
+	s := strings.ReplaceAll(text, "_", "")
+	if len(s) > 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x', 'X':
+			return parseInteger(s[2:], 16)
+		case 'b', 'B':
+			return parseInteger(s[2:], 2)
+		}
+	}
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return val, nil
+}
+
+func parseInteger(digits string, base int) (float64, error) {
+	if n, err := strconv.ParseUint(digits, base, 64); err == nil {
+		return float64(n), nil
+	}
+	val := 0.0
+	for i := 0; i < len(digits); i++ {
+		d, err := strconv.ParseUint(digits[i:i+1], base, 8)
+		if err != nil {
+			return 0, err
+		}
+		val = val*float64(base) + float64(d)
+	}
+	if math.IsInf(val, 0) {
+		return 0, strconv.ErrRange
+	}
+	return val, nil
+}
@@ -0,0 +1,301 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "//" | "%") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | ident | call | "(" expr ")"
+//	call    = ident "(" [ expr { "," expr } ] ")"
+//
+// "^" is right-associative and binds tighter than unary minus, so -2^2 is
+// -(2^2) = -4 and 2^3^2 is 2^(3^2) = 512. The exponent itself may be
+// negated: 2^-1 = 0.5.
+
+type parser struct {
+	tokens []Token
+	pos    int
+}
+
+func Parse(src string) (Node, error) {
+	node, err := parse(src)
+	if err != nil {
+		var perr *Error
+		if errors.As(err, &perr) {
+			return nil, perr.locate(src)
+		}
+		return nil, err
+	}
+	return node, nil
+}
+
+func parse(src string) (Node, error) {
+	tokens, err := Tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().Kind == TokenEOF {
+		return nil, &Error{
+			Code:       ErrEmptyExpression,
+			Msg:        "empty expression",
+			Pos:        0,
+			Suggestion: "enter an expression such as 2+2*2",
+		}
+	}
+
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != TokenEOF {
+		if tok.Kind == TokenRParen {
+			return nil, &Error{
+				Code:       ErrUnmatchedParen,
+				Msg:        "unmatched ')'",
+				Pos:        tok.Pos,
+				Token:      tok.Text,
+				Suggestion: "remove this ')' or add a matching '('",
+			}
+		}
+		e := &Error{
+			Code:       ErrMissingOperator,
+			Msg:        fmt.Sprintf("unexpected %s", tok.Kind),
+			Pos:        tok.Pos,
+			Token:      tok.Text,
+			Suggestion: fmt.Sprintf("missing operator before %s", tok.Kind),
+		}
+		if tok.Kind == TokenComma {
+			e.Code = ErrUnexpectedToken
+			e.Suggestion = "',' may only separate function arguments"
+		}
+		return nil, e
+	}
+	return node, nil
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != TokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// prev returns the token consumed before the current one, if any.
+func (p *parser) prev() (Token, bool) {
+	if p.pos == 0 {
+		return Token{}, false
+	}
+	return p.tokens[p.pos-1], true
+}
+
+func (p *parser) parseExpr() (Node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.Kind != TokenPlus && tok.Kind != TokenMinus {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: tok.Text, X: left, Y: right, OpPos: tok.Pos}
+	}
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		switch tok.Kind {
+		case TokenStar, TokenSlash, TokenDoubleSlash, TokenPercent:
+		default:
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: tok.Text, X: left, Y: right, OpPos: tok.Pos}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	tok := p.peek()
+	if tok.Kind == TokenMinus {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: "-", X: x, OpPos: tok.Pos}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *parser) parsePower() (Node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.Kind != TokenCaret {
+		return base, nil
+	}
+	p.next()
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &Binary{Op: tok.Text, X: base, Y: exp, OpPos: tok.Pos}, nil
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	before, _ := p.prev()
+	tok := p.next()
+	switch tok.Kind {
+	case TokenNumber:
+		val, err := ParseNumber(tok.Text)
+		if err != nil {
+			perr := &Error{
+				Code:  ErrMalformedNumber,
+				Msg:   fmt.Sprintf("invalid number %q", tok.Text),
+				Pos:   tok.Pos,
+				Token: tok.Text,
+			}
+			if errors.Is(err, strconv.ErrRange) {
+				perr.Msg = fmt.Sprintf("number %q is out of range", tok.Text)
+			}
+			return nil, perr
+		}
+		return &Number{Value: val, Raw: tok.Text, ValuePos: tok.Pos}, nil
+	case TokenLParen:
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.Kind != TokenRParen {
+			return nil, &Error{
+				Code:       ErrUnclosedParen,
+				Msg:        fmt.Sprintf("expected ')' to close '(' at position %d", tok.Pos),
+				Pos:        closing.Pos,
+				Token:      closing.Text,
+				Suggestion: "add the missing ')'",
+			}
+		}
+		return inner, nil
+	case TokenIdent:
+		if p.peek().Kind != TokenLParen && !IsFunction(tok.Text) {
+			return &Ident{Name: tok.Text, NamePos: tok.Pos}, nil
+		}
+		return p.parseCall(tok)
+	}
+
+	return nil, missingOperand(before, tok)
+}
+
+func (p *parser) parseCall(name Token) (Node, error) {
+	arity, ok := Functions[name.Text]
+	if !ok {
+		return nil, &Error{
+			Code:       ErrUnknownFunction,
+			Msg:        fmt.Sprintf("unknown function %q", name.Text),
+			Pos:        name.Pos,
+			Token:      name.Text,
+			Suggestion: "available functions: " + functionList(),
+		}
+	}
+	if open := p.next(); open.Kind != TokenLParen {
+		return nil, &Error{
+			Code:       ErrUnexpectedToken,
+			Msg:        fmt.Sprintf("unexpected %s", open.Kind),
+			Pos:        open.Pos,
+			Token:      open.Text,
+			Suggestion: fmt.Sprintf("arguments of %s must be enclosed in parentheses", name.Text),
+		}
+	}
+
+	call := &Call{Name: name.Text, NamePos: name.Pos}
+	if p.peek().Kind != TokenRParen {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if p.peek().Kind != TokenComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	closing := p.next()
+	if closing.Kind != TokenRParen {
+		return nil, &Error{
+			Code:       ErrUnclosedParen,
+			Msg:        fmt.Sprintf("expected ')' to close the call of %s", name.Text),
+			Pos:        closing.Pos,
+			Token:      closing.Text,
+			Suggestion: "add the missing ')' or separate arguments with ','",
+		}
+	}
+	if !arity.accepts(len(call.Args)) {
+		return nil, &Error{
+			Code:       ErrArgumentCount,
+			Msg:        fmt.Sprintf("%s called with %d argument(s)", name.Text, len(call.Args)),
+			Pos:        name.Pos,
+			Token:      name.Text,
+			Suggestion: fmt.Sprintf("%s expects %s", name.Text, arity),
+		}
+	}
+	return call, nil
+}
+
+// missingOperand reports tok found where an operand was expected, after the
+// token before.
+func missingOperand(before, tok Token) *Error {
+	e := &Error{
+		Code:  ErrUnexpectedToken,
+		Msg:   fmt.Sprintf("unexpected %s", tok.Kind),
+		Pos:   tok.Pos,
+		Token: tok.Text,
+	}
+	if tok.Kind == TokenEOF {
+		e.Msg = "unexpected end of expression"
+	}
+
+	switch {
+	case before.Kind == TokenLParen && tok.Kind == TokenRParen:
+		e.Code = ErrMissingOperand
+		e.Suggestion = "put an expression inside the parentheses"
+	case before.Kind.isOperator() || before.Kind == TokenLParen || before.Kind == TokenComma:
+		e.Code = ErrMissingOperand
+		e.Suggestion = fmt.Sprintf("missing operand after %s", before.Kind)
+	default:
+		e.Suggestion = "expected a number, a name or '('"
+	}
+	return e
+}
@@ -0,0 +1,258 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func dump(n Node) string {
+	switch n := n.(type) {
+	case *Number:
+		return n.Raw
+	case *Unary:
+		return fmt.Sprintf("(%s%s)", n.Op, dump(n.X))
+	case *Binary:
+		return fmt.Sprintf("(%s %s %s)", dump(n.X), n.Op, dump(n.Y))
+	case *Ident:
+		return n.Name
+	case *Call:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = dump(arg)
+		}
+		return fmt.Sprintf("%s(%s)", n.Name, strings.Join(args, ", "))
+	default:
+		return "?"
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"2+2*2", "(2 + (2 * 2))"},
+		{"(2+3)*4", "((2 + 3) * 4)"},
+		{"8-3-2", "((8 - 3) - 2)"},
+		{"2*-3", "(2 * (-3))"},
+		{"-(1+2)", "(-(1 + 2))"},
+		{"2--2", "(2 - (-2))"},
+		{" 1.5 / .5 ", "(1.5 / .5)"},
+		{"1e-9 + 0xFF*0b10 - 1_000", "((1e-9 + (0xFF * 0b10)) - 1_000)"},
+		{"((7))", "7"},
+		{"2^3^2", "(2 ^ (3 ^ 2))"},
+		{"-2^2", "(-(2 ^ 2))"},
+		{"2^-1", "(2 ^ (-1))"},
+		{"2*3^2", "(2 * (3 ^ 2))"},
+		{"7//2%3", "((7 // 2) % 3)"},
+		{"1-7%3", "(1 - (7 % 3))"},
+		{"sqrt(16)", "sqrt(16)"},
+		{"2*abs(-3)", "(2 * abs((-3)))"},
+		{"max(1, 2+3, min(4,5))", "max(1, (2 + 3), min(4, 5))"},
+		{"log(8, 2)^2", "(log(8, 2) ^ 2)"},
+		{"-sin(0)", "(-sin(0))"},
+		{"2*pi*r", "((2 * pi) * r)"},
+		{"rate*principal", "(rate * principal)"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			root, err := Parse(tc.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tc.input, err)
+			}
+			if got := dump(root); got != tc.want {
+				t.Errorf("Parse(%q) = %s, want %s", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		input          string
+		wantCode       string
+		wantPos        int
+		wantColumn     int
+		wantToken      string
+		wantSuggestion string
+	}{
+		{"", ErrEmptyExpression, 0, 1, "", ""},
+		{"123+", ErrMissingOperand, 4, 5, "", "missing operand after '+'"},
+		{"5/*2", ErrMissingOperand, 2, 3, "*", "missing operand after '/'"},
+		{"2 * ", ErrMissingOperand, 4, 5, "", "missing operand after '*'"},
+		{"1+2)", ErrUnmatchedParen, 3, 4, ")", ""},
+		{"(2+3", ErrUnclosedParen, 4, 5, "", "add the missing ')'"},
+		{"()", ErrMissingOperand, 1, 2, ")", "put an expression inside"},
+		{"2(3)", ErrMissingOperator, 1, 2, "(", "missing operator before '('"},
+		{"2+$", ErrUnexpectedCharacter, 2, 3, "$", ""},
+		{"2+a(1)", ErrUnknownFunction, 2, 3, "a", ""},
+		{"rate principal", ErrMissingOperator, 5, 6, "principal", "missing operator before identifier"},
+		{"2^", ErrMissingOperand, 2, 3, "", "missing operand after '^'"},
+		{"8///2", ErrMissingOperand, 3, 4, "/", "missing operand after '//'"},
+		{"foo(1)", ErrUnknownFunction, 0, 1, "foo", "available functions: abs,"},
+		{"sqrt 4", ErrUnexpectedToken, 5, 6, "4", "enclosed in parentheses"},
+		{"sqrt(1, 2)", ErrArgumentCount, 0, 1, "sqrt", "sqrt expects 1 argument(s)"},
+		{"max()", ErrArgumentCount, 0, 1, "max", "at least 1 argument(s)"},
+		{"min(1,)", ErrMissingOperand, 6, 7, ")", "missing operand after ','"},
+		{"min(1 2)", ErrUnclosedParen, 6, 7, "2", ""},
+		{"1,2", ErrUnexpectedToken, 1, 2, ",", "function arguments"},
+		{"1.2.3", ErrMalformedNumber, 3, 4, "1.2.", ""},
+		{"1e+", ErrMalformedNumber, 1, 2, "1e+", "exponent"},
+		{"2 * 0x", ErrMalformedNumber, 4, 5, "0x", "0xFF"},
+		{"0b102", ErrMalformedNumber, 4, 5, "0b102", ""},
+		{"0xFG", ErrMalformedNumber, 3, 4, "0xFG", ""},
+		{"12abc", ErrMalformedNumber, 2, 3, "12abc", "operator"},
+		{"1__000", ErrMalformedNumber, 1, 2, "_", "between two digits"},
+		{"1_000_", ErrMalformedNumber, 5, 6, "_", ""},
+		{"1_.5", ErrMalformedNumber, 1, 2, "_", ""},
+		{"1e400", ErrMalformedNumber, 0, 1, "1e400", ""},
+		{"√4+ж", ErrUnexpectedCharacter, 0, 1, "√", ""},
+		{"4+ж", ErrUnexpectedCharacter, 2, 3, "ж", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := Parse(tc.input)
+			if err == nil {
+				t.Fatalf("Parse(%q) expected error, got nil", tc.input)
+			}
+			perr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("Parse(%q) error type %T, want *Error", tc.input, err)
+			}
+			if perr.Code != tc.wantCode {
+				t.Errorf("Parse(%q) code = %s, want %s", tc.input, perr.Code, tc.wantCode)
+			}
+			if perr.Pos != tc.wantPos || perr.Column != tc.wantColumn {
+				t.Errorf("Parse(%q) offset/column = %d/%d, want %d/%d",
+					tc.input, perr.Pos, perr.Column, tc.wantPos, tc.wantColumn)
+			}
+			if perr.Token != tc.wantToken {
+				t.Errorf("Parse(%q) token = %q, want %q", tc.input, perr.Token, tc.wantToken)
+			}
+			if !strings.Contains(perr.Suggestion, tc.wantSuggestion) {
+				t.Errorf("Parse(%q) suggestion = %q, want it to contain %q",
+					tc.input, perr.Suggestion, tc.wantSuggestion)
+			}
+		})
+	}
+}
+
+func TestParse_ColumnCountsCharacters(t *testing.T) {
+	_, err := Parse("(1+2)\u00a0*")
+	perr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if perr.Pos != 8 || perr.Column != 8 {
+		t.Errorf("offset/column = %d/%d, want 8/8", perr.Pos, perr.Column)
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	root, err := Parse("10 * -(3 + 4)")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	mul, ok := root.(*Binary)
+	if !ok {
+		t.Fatalf("root is %T, want *Binary", root)
+	}
+	if mul.OpPos != 3 || mul.Pos() != 0 {
+		t.Errorf("mul OpPos=%d Pos=%d, want 3 and 0", mul.OpPos, mul.Pos())
+	}
+	neg, ok := mul.Y.(*Unary)
+	if !ok {
+		t.Fatalf("mul.Y is %T, want *Unary", mul.Y)
+	}
+	if neg.Pos() != 5 {
+		t.Errorf("neg Pos=%d, want 5", neg.Pos())
+	}
+	add := neg.X.(*Binary)
+	if add.OpPos != 9 || add.X.Pos() != 7 || add.Y.Pos() != 11 {
+		t.Errorf("add positions = %d/%d/%d, want 9/7/11", add.OpPos, add.X.Pos(), add.Y.Pos())
+	}
+}
+
+func TestCheckIdentifiers(t *testing.T) {
+	tests := []struct {
+		input    string
+		vars     map[string]float64
+		wantCode string
+		wantPos  int
+	}{
+		{input: "2*pi+e", wantCode: ""},
+		{input: "rate*principal", vars: map[string]float64{"rate": 0.05, "principal": 1000}, wantCode: ""},
+		{input: "rate * principal", vars: map[string]float64{"rate": 0.05}, wantCode: ErrUnboundIdentifier, wantPos: 7},
+		{input: "max(1, x)", wantCode: ErrUnboundIdentifier, wantPos: 7},
+		{input: "pi", vars: map[string]float64{"pi": 3}, wantCode: ErrReservedName},
+		{input: "1", vars: map[string]float64{"sqrt": 3}, wantCode: ErrReservedName},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			root, err := Parse(tc.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tc.input, err)
+			}
+			err = CheckIdentifiers(tc.input, root, tc.vars)
+			if tc.wantCode == "" {
+				if err != nil {
+					t.Fatalf("CheckIdentifiers(%q) unexpected error: %v", tc.input, err)
+				}
+				return
+			}
+			perr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("CheckIdentifiers(%q) error = %v, want *Error", tc.input, err)
+			}
+			if perr.Code != tc.wantCode || perr.Pos != tc.wantPos {
+				t.Errorf("CheckIdentifiers(%q) = %s at %d, want %s at %d",
+					tc.input, perr.Code, perr.Pos, tc.wantCode, tc.wantPos)
+			}
+		})
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want float64
+	}{
+		{"12", 12},
+		{".5", 0.5},
+		{"1.", 1},
+		{"1e-9", 1e-9},
+		{"2.5E3", 2500},
+		{"1e+2", 100},
+		{"0xFF", 255},
+		{"0Xff", 255},
+		{"0b1010", 10},
+		{"1_000_000", 1000000},
+		{"0xFFFF_FFFF", 4294967295},
+		{"0b1111_0000", 240},
+		{"3.141_592", 3.141592},
+		{"0x1_0000_0000_0000_0000", 18446744073709551616},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.raw, func(t *testing.T) {
+			root, err := Parse(tc.raw)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tc.raw, err)
+			}
+			n, ok := root.(*Number)
+			if !ok {
+				t.Fatalf("Parse(%q) = %T, want *Number", tc.raw, root)
+			}
+			if n.Value != tc.want {
+				t.Errorf("Parse(%q) value = %v, want %v", tc.raw, n.Value, tc.want)
+			}
+			if n.Raw != tc.raw {
+				t.Errorf("Parse(%q) raw = %q, want the original text", tc.raw, n.Raw)
+			}
+		})
+	}
+}
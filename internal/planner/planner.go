@@ -2,276 +2,124 @@ package planner
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
-	"unicode"
 
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
 
-func PlanTasks(expressionID string, raw string) (int, error) {
-	expression := strings.ReplaceAll(raw, " ", "")
+type operand struct {
+	value  *float64
+	taskID *int
+}
 
-	for {
-		i := findFirstMulDiv(expression)
-		if i == -1 {
-			break
-		}
-		leftVal, leftTaskID, startPos, err := findOperandLeft(expression, i)
-		if err != nil {
-			return 0, err
-		}
-		rightVal, rightTaskID, endPos, err := findOperandRight(expression, i)
-		if err != nil {
-			return 0, err
-		}
-		op := string(expression[i])
-		task, err := repository.CreateTaskWithArgs(
-			expressionID,
-			op,
-			leftVal, leftTaskID,
-			rightVal, rightTaskID,
-		)
-		if err != nil {
-			return 0, err
-		}
+// TaskStore stores the planned tasks, see repository.BatchTx.
+type TaskStore interface {
+	CreateTask(expressionID string, op string, args []model.TaskArg) (*model.Task, error)
+}
 
-		newPart := fmt.Sprintf("T%d", task.ID)
-		expression = expression[:startPos] + newPart + expression[endPos:]
-	}
+// repositoryStore stores every task in its own transaction.
+type repositoryStore struct{}
 
-	for {
-		j := findFirstAddSub(expression)
-		if j == -1 {
-			break
-		}
-		leftVal, leftTaskID, startPos, err := findOperandLeft(expression, j)
-		if err != nil {
-			return 0, err
-		}
-		rightVal, rightTaskID, endPos, err := findOperandRight(expression, j)
-		if err != nil {
-			return 0, err
-		}
-		op := string(expression[j])
-		task, err := repository.CreateTaskWithArgs(
-			expressionID,
-			op,
-			leftVal, leftTaskID,
-			rightVal, rightTaskID,
-		)
-		if err != nil {
-			return 0, err
-		}
+func (repositoryStore) CreateTask(expressionID string, op string, args []model.TaskArg) (*model.Task, error) {
+	return repository.CreateTask(expressionID, op, args)
+}
 
-		newPart := fmt.Sprintf("T%d", task.ID)
-		expression = expression[:startPos] + newPart + expression[endPos:]
-	}
+type planContext struct {
+	store  TaskStore
+	exprID string
+	vars   map[string]float64
+}
 
-	if strings.HasPrefix(expression, "T") {
-		tidStr := expression[1:]
-		tid, err := strconv.Atoi(tidStr)
-		if err != nil {
-			return 0, fmt.Errorf("cannot parse final task id: %s", expression)
-		}
-		return tid, nil
-	}
+// PlanTasks creates one task per operation of the tree, children first, so
+// the root task always gets the greatest ID. Identifiers are replaced by
+// their values from vars or the built-in constants. It returns the root
+// task ID.
+func PlanTasks(expressionID string, root parser.Node, vars map[string]float64) (int, error) {
+	return PlanTasksIn(repositoryStore{}, expressionID, root, vars)
+}
 
-	val, err := strconv.ParseFloat(expression, 64)
+// PlanTasksIn works like PlanTasks, storing the tasks in store.
+func PlanTasksIn(store TaskStore, expressionID string, root parser.Node, vars map[string]float64) (int, error) {
+	pc := &planContext{store: store, exprID: expressionID, vars: vars}
+	res, err := pc.planNode(root)
 	if err != nil {
-		return 0, fmt.Errorf("cannot parse expression: %s", expression)
+		return 0, err
 	}
-	t, err := repository.CreateTaskWithArgs(
-		expressionID,
-		"+",
-		&val, nil,
-		nil, nil,
-	)
+	if res.taskID != nil {
+		return *res.taskID, nil
+	}
+
+	t, err := store.CreateTask(expressionID, "+", []model.TaskArg{{Value: res.value}, {}})
 	if err != nil {
 		return 0, err
 	}
 	return t.ID, nil
 }
 
-func findFirstMulDiv(expr string) int {
-	for i, c := range expr {
-		if c == '*' || c == '/' {
-			return i
-		}
-	}
-	return -1
-}
-func findFirstAddSub(expr string) int {
-	for i, c := range expr {
-		if c == '+' || c == '-' {
-			return i
-		}
-	}
-	return -1
-}
+func (pc *planContext) planNode(node parser.Node) (operand, error) {
+	switch n := node.(type) {
+	case *parser.Number:
+		val := n.Value
+		return operand{value: &val}, nil
 
-func findOperandLeft(expr string, opPos int) (*float64, *int, int, error) {
-	start := opPos - 1
-	for start >= 0 && !strings.ContainsRune("+-*/", rune(expr[start])) {
-		start--
-	}
-	leftStr := expr[start+1 : opPos]
-	startPos := start + 1
-	if strings.HasPrefix(leftStr, "T") {
-		tidStr := leftStr[1:]
-		tid, err := strconv.Atoi(tidStr)
-		if err != nil {
-			return nil, nil, 0, err
+	case *parser.Ident:
+		val, ok := parser.Lookup(n.Name, pc.vars)
+		if !ok {
+			return operand{}, fmt.Errorf("unknown identifier %q at position %d", n.Name, n.NamePos)
 		}
-		return nil, &tid, startPos, nil
-	}
-	val, err := strconv.ParseFloat(leftStr, 64)
-	if err != nil {
-		return nil, nil, 0, fmt.Errorf("invalid left operand: %s", leftStr)
-	}
-	return &val, nil, startPos, nil
-}
+		return operand{value: &val}, nil
 
-func findOperandRight(expr string, opPos int) (*float64, *int, int, error) {
-	end := opPos + 1
-	for end < len(expr) && !strings.ContainsRune("+-*/", rune(expr[end])) {
-		end++
-	}
-	rightStr := expr[opPos+1 : end]
-	endPos := end
-	if strings.HasPrefix(rightStr, "T") {
-		tidStr := rightStr[1:]
-		tid, err := strconv.Atoi(tidStr)
+	case *parser.Unary:
+		x, err := pc.planNode(n.X)
 		if err != nil {
-			return nil, nil, 0, err
+			return operand{}, err
 		}
-		return nil, &tid, endPos, nil
-	}
-	val, err := strconv.ParseFloat(rightStr, 64)
-	if err != nil {
-		return nil, nil, 0, fmt.Errorf("invalid right operand: %s", rightStr)
-	}
-	return &val, nil, endPos, nil
-}
-
-func removeSpaces(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		if !unicode.IsSpace(r) {
-			b.WriteRune(r)
+		if x.value != nil {
+			val := -*x.value
+			return operand{value: &val}, nil
 		}
-	}
-	return b.String()
-}
-
-func PlanTasksWithNestedParen(exprID, raw string) (int, error) {
-	expression := rewriteUnaryMinuses(removeSpaces(raw))
+		zero := 0.0
+		return pc.createTask(n.Op, operand{value: &zero}, x)
 
-	for strings.Contains(expression, "(") {
-		lp, rp := findDeepestParenPair(expression)
-		if lp == -1 || rp == -1 {
-			return 0, fmt.Errorf("unmatched parentheses in expression: %s", expression)
+	case *parser.Binary:
+		x, err := pc.planNode(n.X)
+		if err != nil {
+			return operand{}, err
 		}
-
-		subStr := expression[lp+1 : rp]
-		subTaskID, err := PlanTasks(exprID, subStr)
+		y, err := pc.planNode(n.Y)
 		if err != nil {
-			return 0, fmt.Errorf("error planning sub-expression %q: %v", subStr, err)
+			return operand{}, err
 		}
+		return pc.createTask(n.Op, x, y)
 
-		newPart := fmt.Sprintf("T%d", subTaskID)
-		expression = expression[:lp] + newPart + expression[rp+1:]
-	}
-
-	return PlanTasks(exprID, expression)
-}
-
-func findDeepestParenPair(s string) (int, int) {
-	maxDepth := 0
-	curDepth := 0
-	lpCandidate := -1
-	lpResult := -1
-	rpResult := -1
-
-	for i, ch := range s {
-		if ch == '(' {
-			curDepth++
-			if curDepth > maxDepth {
-				maxDepth = curDepth
-				lpCandidate = i
-			} else if curDepth == maxDepth {
-				lpCandidate = i
+	case *parser.Call:
+		args := make([]model.TaskArg, 0, len(n.Args))
+		for _, arg := range n.Args {
+			a, err := pc.planNode(arg)
+			if err != nil {
+				return operand{}, err
 			}
-		} else if ch == ')' {
-			if curDepth == maxDepth {
-				lpResult = lpCandidate
-				rpResult = i
-			}
-			curDepth--
+			args = append(args, model.TaskArg{Value: a.value, TaskID: a.taskID})
 		}
-	}
-	return lpResult, rpResult
-}
-
-func rewriteUnaryMinuses(expr string) string {
-	exprRunes := []rune(expr)
-	var result []rune
-
-	i := 0
-	for i < len(exprRunes) {
-		ch := exprRunes[i]
-
-		if ch == '-' {
-			if isUnaryMinus(result) {
-				result = append(result, '0', '-')
-				i++
-				startIdx := i
-
-				for i < len(exprRunes) {
-					if isOperator(exprRunes[i]) && exprRunes[i] != '.' {
-						break
-					}
-					if unicode.IsSpace(exprRunes[i]) {
-						break
-					}
-					i++
-				}
-				sub := exprRunes[startIdx:i]
-				result = append(result, sub...)
-				continue
-			} else {
-				result = append(result, '-')
-				i++
-				continue
-			}
-		} else {
-			result = append(result, ch)
-			i++
+		task, err := pc.store.CreateTask(pc.exprID, n.Name, args)
+		if err != nil {
+			return operand{}, err
 		}
-	}
-	return string(result)
-}
+		return operand{taskID: &task.ID}, nil
 
-func isUnaryMinus(resultSoFar []rune) bool {
-	if len(resultSoFar) == 0 {
-		return true
-	}
-	prev := resultSoFar[len(resultSoFar)-1]
-	if isOperator([]rune{prev}) ||
-		prev == '(' {
-		return true
+	default:
+		return operand{}, fmt.Errorf("cannot plan node %T", node)
 	}
-	return false
 }
 
-func isOperator(r interface{}) bool {
-	switch x := r.(type) {
-	case rune:
-		return x == '+' || x == '-' || x == '*' || x == '/'
-	case []rune:
-		if len(x) == 1 {
-			return isOperator(x[0])
-		}
+func (pc *planContext) createTask(op string, x, y operand) (operand, error) {
+	task, err := pc.store.CreateTask(pc.exprID, op, []model.TaskArg{
+		{Value: x.value, TaskID: x.taskID},
+		{Value: y.value, TaskID: y.taskID},
+	})
+	if err != nil {
+		return operand{}, err
 	}
-	return false
+	return operand{taskID: &task.ID}, nil
 }
@@ -1,10 +1,12 @@
 package planner_test
 
 import (
+	"math"
 	"os"
 	"testing"
 
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/parser"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/planner"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
@@ -20,15 +22,24 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// planRaw parses raw and plans the tasks of the expression.
+func planRaw(exprID, raw string) (int, error) {
+	root, err := parser.Parse(raw)
+	if err != nil {
+		return 0, err
+	}
+	return planner.PlanTasks(exprID, root, nil)
+}
+
 func TestPlanner_Simple(t *testing.T) {
 	expr, err := repository.CreateExpression("2+2*2", testUserID)
 	if err != nil {
 		t.Fatalf("CreateExpression failed: %v", err)
 	}
 
-	finalTaskID, err := planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	finalTaskID, err := planRaw(expr.ID, expr.Raw)
 	if err != nil {
-		t.Fatalf("PlanTasksWithNestedParen error: %v", err)
+		t.Fatalf("planRaw error: %v", err)
 	}
 
 	if finalTaskID <= 0 {
@@ -50,7 +61,7 @@ func TestPlanner_ExpressionWithParen(t *testing.T) {
 		t.Fatalf("CreateExpression error: %v", err)
 	}
 
-	finalTaskID, err := planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	finalTaskID, err := planRaw(expr.ID, expr.Raw)
 	if err != nil {
 		t.Fatalf("plan error: %v", err)
 	}
@@ -73,7 +84,7 @@ func TestPlanner_InvalidExpression(t *testing.T) {
 		t.Fatalf("CreateExpression error: %v", err)
 	}
 
-	_, err = planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	_, err = planRaw(expr.ID, expr.Raw)
 	if err == nil {
 		t.Fatal("expected error for incomplete expression, got nil")
 	}
@@ -90,9 +101,9 @@ func TestPlanTasks_Simple(t *testing.T) {
 		t.Fatal("expr.ID is empty")
 	}
 
-	finalID, err := planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	finalID, err := planRaw(expr.ID, expr.Raw)
 	if err != nil {
-		t.Fatalf("PlanTasksWithNestedParen error: %v", err)
+		t.Fatalf("planRaw error: %v", err)
 	}
 	if finalID <= 0 {
 		t.Errorf("invalid final task ID = %d, want > 0", finalID)
@@ -116,7 +127,7 @@ func TestPlanTasks_Paren(t *testing.T) {
 		t.Fatalf("CreateExpression error: %v", err)
 	}
 
-	finalID, err := planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	finalID, err := planRaw(expr.ID, expr.Raw)
 	if err != nil {
 		t.Fatalf("plan error: %v", err)
 	}
@@ -140,9 +151,184 @@ func TestPlanTasks_Invalid(t *testing.T) {
 		t.Fatalf("CreateExpression error: %v", err)
 	}
 
-	_, err = planner.PlanTasksWithNestedParen(expr.ID, expr.Raw)
+	_, err = planRaw(expr.ID, expr.Raw)
 	if err == nil {
 		t.Fatal("expected error for invalid expression '5/*2', got nil")
 	}
 	t.Logf("Got expected error: %v", err)
 }
+
+func TestPlanTasks_UnaryMinus(t *testing.T) {
+	repository.Reset()
+
+	tests := []struct {
+		raw       string
+		wantTasks int
+		wantOp    string
+		wantArg2  *float64
+	}{
+		{raw: "2*-3", wantTasks: 1, wantOp: "*", wantArg2: floatPtr(-3)},
+		{raw: "-(1+2)", wantTasks: 2, wantOp: "-"},
+		{raw: "--5", wantTasks: 1, wantOp: "+"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.raw, func(t *testing.T) {
+			expr, err := repository.CreateExpression(tc.raw, testUserID)
+			if err != nil {
+				t.Fatalf("CreateExpression error: %v", err)
+			}
+			finalID, err := planRaw(expr.ID, expr.Raw)
+			if err != nil {
+				t.Fatalf("plan error: %v", err)
+			}
+
+			tasks, err := repository.GetTasksByExpressionID(expr.ID)
+			if err != nil {
+				t.Fatalf("GetTasksByExpressionID error: %v", err)
+			}
+			if len(tasks) != tc.wantTasks {
+				t.Fatalf("expected %d tasks for %q, got %d", tc.wantTasks, tc.raw, len(tasks))
+			}
+			last := tasks[len(tasks)-1]
+			if last.ID != finalID {
+				t.Errorf("final task ID = %d, want the last created task %d", finalID, last.ID)
+			}
+			if last.Op != tc.wantOp {
+				t.Errorf("final op = %q, want %q", last.Op, tc.wantOp)
+			}
+			if tc.wantArg2 != nil && (last.Arg2Value == nil || *last.Arg2Value != *tc.wantArg2) {
+				t.Errorf("final arg2 = %v, want %v", last.Arg2Value, *tc.wantArg2)
+			}
+		})
+	}
+}
+
+func TestPlanTasks_Functions(t *testing.T) {
+	repository.Reset()
+
+	expr, err := repository.CreateExpression("max(1, 2+3, sqrt(16), 4)", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	finalID, err := planRaw(expr.ID, expr.Raw)
+	if err != nil {
+		t.Fatalf("plan error: %v", err)
+	}
+
+	tasks, err := repository.GetTasksByExpressionID(expr.ID)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID error: %v", err)
+	}
+	if len(tasks) != 3 {
+		t.Fatalf("expected 3 tasks (+, sqrt, max), got %d", len(tasks))
+	}
+
+	sqrtTask := tasks[1]
+	if sqrtTask.Op != "sqrt" || len(sqrtTask.Args()) != 1 {
+		t.Errorf("expected unary sqrt task, got op=%q args=%d", sqrtTask.Op, len(sqrtTask.Args()))
+	}
+
+	maxTask, err := repository.GetTaskByID(finalID)
+	if err != nil {
+		t.Fatalf("GetTaskByID error: %v", err)
+	}
+	if maxTask.Op != "max" {
+		t.Fatalf("expected final op max, got %q", maxTask.Op)
+	}
+	args := maxTask.Args()
+	if len(args) != 4 {
+		t.Fatalf("expected 4 args for max, got %d", len(args))
+	}
+	if args[1].TaskID == nil || *args[1].TaskID != tasks[0].ID {
+		t.Errorf("second arg should reference the + task, got %+v", args[1])
+	}
+	if args[2].TaskID == nil || *args[2].TaskID != sqrtTask.ID {
+		t.Errorf("third arg should reference the sqrt task, got %+v", args[2])
+	}
+	if args[3].Value == nil || *args[3].Value != 4 {
+		t.Errorf("fourth arg should be 4, got %+v", args[3])
+	}
+}
+
+func TestPlanTasks_Variables(t *testing.T) {
+	repository.Reset()
+
+	raw := "rate*principal + pi"
+	expr, err := repository.CreateExpression(raw, testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	root, err := parser.Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	vars := map[string]float64{"rate": 0.05, "principal": 1000}
+	if _, err := planner.PlanTasks(expr.ID, root, vars); err != nil {
+		t.Fatalf("PlanTasks error: %v", err)
+	}
+
+	tasks, err := repository.GetTasksByExpressionID(expr.ID)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID error: %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(tasks))
+	}
+	mul := tasks[0]
+	if mul.Arg1Value == nil || *mul.Arg1Value != 0.05 || mul.Arg2Value == nil || *mul.Arg2Value != 1000 {
+		t.Errorf("variables not substituted: arg1=%v arg2=%v", mul.Arg1Value, mul.Arg2Value)
+	}
+	add := tasks[1]
+	if add.Arg2Value == nil || *add.Arg2Value != math.Pi {
+		t.Errorf("pi not substituted: arg2=%v", add.Arg2Value)
+	}
+
+	if _, err := planner.PlanTasks(expr.ID, root, nil); err == nil {
+		t.Error("expected error for unbound variables, got nil")
+	}
+}
+
+func TestPlanTasks_Literals(t *testing.T) {
+	repository.Reset()
+
+	raw := "0xFF * 1e-3 + 1_000"
+	expr, err := repository.CreateExpression(raw, testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	root, err := parser.Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := planner.PlanTasks(expr.ID, root, nil); err != nil {
+		t.Fatalf("PlanTasks error: %v", err)
+	}
+
+	tasks, err := repository.GetTasksByExpressionID(expr.ID)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID error: %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(tasks))
+	}
+	mul, add := tasks[0], tasks[1]
+	if mul.Arg1Value == nil || *mul.Arg1Value != 255 || mul.Arg2Value == nil || *mul.Arg2Value != 0.001 {
+		t.Errorf("literals not canonicalized: arg1=%v arg2=%v", mul.Arg1Value, mul.Arg2Value)
+	}
+	if add.Arg2Value == nil || *add.Arg2Value != 1000 {
+		t.Errorf("digit separators not removed: arg2=%v", add.Arg2Value)
+	}
+
+	stored, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID error: %v", err)
+	}
+	if stored.Raw != raw {
+		t.Errorf("raw = %q, want %q", stored.Raw, raw)
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.36.6
+// 	protoc-gen-go v1.36.11
 // 	protoc        v5.29.3
 // source: internal/proto/calc.proto
 
@@ -22,7 +22,14 @@ const (
 )
 
 type GetTaskRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Идентификатор агента, на которого оформляется аренда задачи
+	AgentId string `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// Операции, которые умеет вычислять агент; пустой список – любые
+	Operations []string `protobuf:"bytes,2,rep,name=operations,proto3" json:"operations,omitempty"`
+	// Метки агента (например "gpu-free", "high-precision"); задачи выражений,
+	// требующих меток, выдаются только агентам, у которых они все есть
+	Tags          []string `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -57,6 +64,27 @@ func (*GetTaskRequest) Descriptor() ([]byte, []int) {
 	return file_internal_proto_calc_proto_rawDescGZIP(), []int{0}
 }
 
+func (x *GetTaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *GetTaskRequest) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *GetTaskRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
 // Ответ
 type GetTaskResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -118,6 +146,13 @@ type TaskData struct {
 	Arg2          float64                `protobuf:"fixed64,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
 	Operation     string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	OperationTime int32                  `protobuf:"varint,5,opt,name=operation_time,json=operationTime,proto3" json:"operation_time,omitempty"`
+	// Все аргументы по порядку; для функций (sqrt, min, ...) агент берёт их отсюда
+	Args []float64 `protobuf:"fixed64,6,rep,packed,name=args,proto3" json:"args,omitempty"`
+	// Срок аренды; если агент не успевает, он продлевает её через RenewLease
+	LeaseMs int32 `protobuf:"varint,7,opt,name=lease_ms,json=leaseMs,proto3" json:"lease_ms,omitempty"`
+	// Сколько миллисекунд осталось до дедлайна выражения; 0 – дедлайна нет.
+	// Агент бросает задачу, если не успеет вычислить её до дедлайна
+	DeadlineMs    int64 `protobuf:"varint,8,opt,name=deadline_ms,json=deadlineMs,proto3" json:"deadline_ms,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -187,10 +222,32 @@ func (x *TaskData) GetOperationTime() int32 {
 	return 0
 }
 
+func (x *TaskData) GetArgs() []float64 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *TaskData) GetLeaseMs() int32 {
+	if x != nil {
+		return x.LeaseMs
+	}
+	return 0
+}
+
+func (x *TaskData) GetDeadlineMs() int64 {
+	if x != nil {
+		return x.DeadlineMs
+	}
+	return 0
+}
+
 type PostResultRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
 	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	AgentId       string                 `protobuf:"bytes,3,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -239,6 +296,13 @@ func (x *PostResultRequest) GetResult() float64 {
 	return 0
 }
 
+func (x *PostResultRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 type PostResultResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
@@ -283,68 +347,935 @@ func (x *PostResultResponse) GetStatus() string {
 	return ""
 }
 
-var File_internal_proto_calc_proto protoreflect.FileDescriptor
+// ReportErrorRequest сообщает, что агент не смог вычислить задачу
+type ReportErrorRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Id      int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Error   string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"` // причина, например "division by zero"
+	AgentId string                 `protobuf:"bytes,3,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// Сбой не связан с самой задачей (например, агент не умеет её операцию):
+	// задача возвращается в очередь по политике повторов, а не завершается ошибкой
+	Transient     bool `protobuf:"varint,4,opt,name=transient,proto3" json:"transient,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
 
-const file_internal_proto_calc_proto_rawDesc = "" +
-	"\n" +
-	"\x19internal/proto/calc.proto\x12\x04calc\"\x10\n" +
-	"\x0eGetTaskRequest\"M\n" +
-	"\x0fGetTaskResponse\x12\x16\n" +
-	"\x06status\x18\x01 \x01(\tR\x06status\x12\"\n" +
-	"\x04task\x18\x02 \x01(\v2\x0e.calc.TaskDataR\x04task\"\x87\x01\n" +
-	"\bTaskData\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
-	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
-	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
-	"\toperation\x18\x04 \x01(\tR\toperation\x12%\n" +
-	"\x0eoperation_time\x18\x05 \x01(\x05R\roperationTime\";\n" +
-	"\x11PostResultRequest\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x01R\x06result\",\n" +
-	"\x12PostResultResponse\x12\x16\n" +
-	"\x06status\x18\x01 \x01(\tR\x06status2\x86\x01\n" +
-	"\vCalcService\x126\n" +
-	"\aGetTask\x12\x14.calc.GetTaskRequest\x1a\x15.calc.GetTaskResponse\x12?\n" +
-	"\n" +
-	"PostResult\x12\x17.calc.PostResultRequest\x1a\x18.calc.PostResultResponseB?Z=github.com/TuHeKocmoc/yalyceumfinal2/internal/proto/calc;calcb\x06proto3"
+func (x *ReportErrorRequest) Reset() {
+	*x = ReportErrorRequest{}
+	mi := &file_internal_proto_calc_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
 
-var (
-	file_internal_proto_calc_proto_rawDescOnce sync.Once
-	file_internal_proto_calc_proto_rawDescData []byte
-)
+func (x *ReportErrorRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
 
-func file_internal_proto_calc_proto_rawDescGZIP() []byte {
-	file_internal_proto_calc_proto_rawDescOnce.Do(func() {
-		file_internal_proto_calc_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_internal_proto_calc_proto_rawDesc), len(file_internal_proto_calc_proto_rawDesc)))
-	})
-	return file_internal_proto_calc_proto_rawDescData
+func (*ReportErrorRequest) ProtoMessage() {}
+
+func (x *ReportErrorRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
 }
 
-var file_internal_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
-var file_internal_proto_calc_proto_goTypes = []any{
-	(*GetTaskRequest)(nil),     // 0: calc.GetTaskRequest
-	(*GetTaskResponse)(nil),    // 1: calc.GetTaskResponse
-	(*TaskData)(nil),           // 2: calc.TaskData
-	(*PostResultRequest)(nil),  // 3: calc.PostResultRequest
-	(*PostResultResponse)(nil), // 4: calc.PostResultResponse
+// Deprecated: Use ReportErrorRequest.ProtoReflect.Descriptor instead.
+func (*ReportErrorRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{5}
 }
-var file_internal_proto_calc_proto_depIdxs = []int32{
-	2, // 0: calc.GetTaskResponse.task:type_name -> calc.TaskData
-	0, // 1: calc.CalcService.GetTask:input_type -> calc.GetTaskRequest
-	3, // 2: calc.CalcService.PostResult:input_type -> calc.PostResultRequest
-	1, // 3: calc.CalcService.GetTask:output_type -> calc.GetTaskResponse
-	4, // 4: calc.CalcService.PostResult:output_type -> calc.PostResultResponse
-	3, // [3:5] is the sub-list for method output_type
-	1, // [1:3] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+
+func (x *ReportErrorRequest) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
 }
 
-func init() { file_internal_proto_calc_proto_init() }
-func file_internal_proto_calc_proto_init() {
-	if File_internal_proto_calc_proto != nil {
-		return
+func (x *ReportErrorRequest) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *ReportErrorRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *ReportErrorRequest) GetTransient() bool {
+	if x != nil {
+		return x.Transient
+	}
+	return false
+}
+
+type ReportErrorResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReportErrorResponse) Reset() {
+	*x = ReportErrorResponse{}
+	mi := &file_internal_proto_calc_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReportErrorResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportErrorResponse) ProtoMessage() {}
+
+func (x *ReportErrorResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportErrorResponse.ProtoReflect.Descriptor instead.
+func (*ReportErrorResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ReportErrorResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+type RenewLeaseRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RenewLeaseRequest) Reset() {
+	*x = RenewLeaseRequest{}
+	mi := &file_internal_proto_calc_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RenewLeaseRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RenewLeaseRequest) ProtoMessage() {}
+
+func (x *RenewLeaseRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RenewLeaseRequest.ProtoReflect.Descriptor instead.
+func (*RenewLeaseRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *RenewLeaseRequest) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *RenewLeaseRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+// status: OK или LEASE_LOST, если задача уже передана другому агенту
+type RenewLeaseResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	LeaseMs       int32                  `protobuf:"varint,2,opt,name=lease_ms,json=leaseMs,proto3" json:"lease_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RenewLeaseResponse) Reset() {
+	*x = RenewLeaseResponse{}
+	mi := &file_internal_proto_calc_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RenewLeaseResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RenewLeaseResponse) ProtoMessage() {}
+
+func (x *RenewLeaseResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RenewLeaseResponse.ProtoReflect.Descriptor instead.
+func (*RenewLeaseResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *RenewLeaseResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *RenewLeaseResponse) GetLeaseMs() int32 {
+	if x != nil {
+		return x.LeaseMs
+	}
+	return 0
+}
+
+type AgentHello struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Capacity      int32                  `protobuf:"varint,2,opt,name=capacity,proto3" json:"capacity,omitempty"`    // сколько задач агент готов выполнять одновременно
+	Operations    []string               `protobuf:"bytes,3,rep,name=operations,proto3" json:"operations,omitempty"` // как в GetTaskRequest
+	Tags          []string               `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentHello) Reset() {
+	*x = AgentHello{}
+	mi := &file_internal_proto_calc_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentHello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentHello) ProtoMessage() {}
+
+func (x *AgentHello) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentHello.ProtoReflect.Descriptor instead.
+func (*AgentHello) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AgentHello) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *AgentHello) GetCapacity() int32 {
+	if x != nil {
+		return x.Capacity
+	}
+	return 0
+}
+
+func (x *AgentHello) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *AgentHello) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+type AgentMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*AgentMessage_Hello
+	//	*AgentMessage_Result
+	//	*AgentMessage_Error
+	//	*AgentMessage_Renew
+	Payload       isAgentMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentMessage) Reset() {
+	*x = AgentMessage{}
+	mi := &file_internal_proto_calc_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentMessage) ProtoMessage() {}
+
+func (x *AgentMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentMessage.ProtoReflect.Descriptor instead.
+func (*AgentMessage) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *AgentMessage) GetPayload() isAgentMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetHello() *AgentHello {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Hello); ok {
+			return x.Hello
+		}
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetResult() *PostResultRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetError() *ReportErrorRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Error); ok {
+			return x.Error
+		}
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetRenew() *RenewLeaseRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Renew); ok {
+			return x.Renew
+		}
+	}
+	return nil
+}
+
+type isAgentMessage_Payload interface {
+	isAgentMessage_Payload()
+}
+
+type AgentMessage_Hello struct {
+	Hello *AgentHello `protobuf:"bytes,1,opt,name=hello,proto3,oneof"`
+}
+
+type AgentMessage_Result struct {
+	Result *PostResultRequest `protobuf:"bytes,2,opt,name=result,proto3,oneof"`
+}
+
+type AgentMessage_Error struct {
+	Error *ReportErrorRequest `protobuf:"bytes,3,opt,name=error,proto3,oneof"`
+}
+
+type AgentMessage_Renew struct {
+	Renew *RenewLeaseRequest `protobuf:"bytes,4,opt,name=renew,proto3,oneof"`
+}
+
+func (*AgentMessage_Hello) isAgentMessage_Payload() {}
+
+func (*AgentMessage_Result) isAgentMessage_Payload() {}
+
+func (*AgentMessage_Error) isAgentMessage_Payload() {}
+
+func (*AgentMessage_Renew) isAgentMessage_Payload() {}
+
+// TaskAck – ответ оркестратора на result, error или renew из потока
+type TaskAck struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Status        string                 `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TaskAck) Reset() {
+	*x = TaskAck{}
+	mi := &file_internal_proto_calc_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TaskAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TaskAck) ProtoMessage() {}
+
+func (x *TaskAck) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TaskAck.ProtoReflect.Descriptor instead.
+func (*TaskAck) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *TaskAck) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *TaskAck) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+type ServerMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*ServerMessage_Task
+	//	*ServerMessage_Ack
+	Payload       isServerMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerMessage) Reset() {
+	*x = ServerMessage{}
+	mi := &file_internal_proto_calc_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerMessage) ProtoMessage() {}
+
+func (x *ServerMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerMessage.ProtoReflect.Descriptor instead.
+func (*ServerMessage) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ServerMessage) GetPayload() isServerMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetTask() *TaskData {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerMessage_Task); ok {
+			return x.Task
+		}
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetAck() *TaskAck {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerMessage_Ack); ok {
+			return x.Ack
+		}
+	}
+	return nil
+}
+
+type isServerMessage_Payload interface {
+	isServerMessage_Payload()
+}
+
+type ServerMessage_Task struct {
+	Task *TaskData `protobuf:"bytes,1,opt,name=task,proto3,oneof"`
+}
+
+type ServerMessage_Ack struct {
+	Ack *TaskAck `protobuf:"bytes,2,opt,name=ack,proto3,oneof"`
+}
+
+func (*ServerMessage_Task) isServerMessage_Payload() {}
+
+func (*ServerMessage_Ack) isServerMessage_Payload() {}
+
+type RegisterAgentRequest struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	AgentId        string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Hostname       string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Version        string                 `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	ComputingPower int32                  `protobuf:"varint,4,opt,name=computing_power,json=computingPower,proto3" json:"computing_power,omitempty"`
+	Operations     []string               `protobuf:"bytes,5,rep,name=operations,proto3" json:"operations,omitempty"` // операции, которые умеет вычислять агент
+	Tags           []string               `protobuf:"bytes,6,rep,name=tags,proto3" json:"tags,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *RegisterAgentRequest) Reset() {
+	*x = RegisterAgentRequest{}
+	mi := &file_internal_proto_calc_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAgentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAgentRequest) ProtoMessage() {}
+
+func (x *RegisterAgentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAgentRequest.ProtoReflect.Descriptor instead.
+func (*RegisterAgentRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *RegisterAgentRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *RegisterAgentRequest) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *RegisterAgentRequest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *RegisterAgentRequest) GetComputingPower() int32 {
+	if x != nil {
+		return x.ComputingPower
+	}
+	return 0
+}
+
+func (x *RegisterAgentRequest) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *RegisterAgentRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+type RegisterAgentResponse struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	Status              string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	HeartbeatIntervalMs int32                  `protobuf:"varint,2,opt,name=heartbeat_interval_ms,json=heartbeatIntervalMs,proto3" json:"heartbeat_interval_ms,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *RegisterAgentResponse) Reset() {
+	*x = RegisterAgentResponse{}
+	mi := &file_internal_proto_calc_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAgentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAgentResponse) ProtoMessage() {}
+
+func (x *RegisterAgentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAgentResponse.ProtoReflect.Descriptor instead.
+func (*RegisterAgentResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *RegisterAgentResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *RegisterAgentResponse) GetHeartbeatIntervalMs() int32 {
+	if x != nil {
+		return x.HeartbeatIntervalMs
+	}
+	return 0
+}
+
+type HeartbeatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatRequest) Reset() {
+	*x = HeartbeatRequest{}
+	mi := &file_internal_proto_calc_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatRequest) ProtoMessage() {}
+
+func (x *HeartbeatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatRequest.ProtoReflect.Descriptor instead.
+func (*HeartbeatRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *HeartbeatRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+// status: OK или UNKNOWN_AGENT – агенту нужно заново вызвать RegisterAgent
+type HeartbeatResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatResponse) Reset() {
+	*x = HeartbeatResponse{}
+	mi := &file_internal_proto_calc_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatResponse) ProtoMessage() {}
+
+func (x *HeartbeatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatResponse.ProtoReflect.Descriptor instead.
+func (*HeartbeatResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *HeartbeatResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+var File_internal_proto_calc_proto protoreflect.FileDescriptor
+
+const file_internal_proto_calc_proto_rawDesc = "" +
+	"\n" +
+	"\x19internal/proto/calc.proto\x12\x04calc\"_\n" +
+	"\x0eGetTaskRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x02 \x03(\tR\n" +
+	"operations\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\"M\n" +
+	"\x0fGetTaskResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\"\n" +
+	"\x04task\x18\x02 \x01(\v2\x0e.calc.TaskDataR\x04task\"\xd7\x01\n" +
+	"\bTaskData\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
+	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
+	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
+	"\toperation\x18\x04 \x01(\tR\toperation\x12%\n" +
+	"\x0eoperation_time\x18\x05 \x01(\x05R\roperationTime\x12\x12\n" +
+	"\x04args\x18\x06 \x03(\x01R\x04args\x12\x19\n" +
+	"\blease_ms\x18\a \x01(\x05R\aleaseMs\x12\x1f\n" +
+	"\vdeadline_ms\x18\b \x01(\x03R\n" +
+	"deadlineMs\"V\n" +
+	"\x11PostResultRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x16\n" +
+	"\x06result\x18\x02 \x01(\x01R\x06result\x12\x19\n" +
+	"\bagent_id\x18\x03 \x01(\tR\aagentId\",\n" +
+	"\x12PostResultResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\"s\n" +
+	"\x12ReportErrorRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12\x19\n" +
+	"\bagent_id\x18\x03 \x01(\tR\aagentId\x12\x1c\n" +
+	"\ttransient\x18\x04 \x01(\bR\ttransient\"-\n" +
+	"\x13ReportErrorResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\">\n" +
+	"\x11RenewLeaseRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\"G\n" +
+	"\x12RenewLeaseResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x19\n" +
+	"\blease_ms\x18\x02 \x01(\x05R\aleaseMs\"w\n" +
+	"\n" +
+	"AgentHello\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1a\n" +
+	"\bcapacity\x18\x02 \x01(\x05R\bcapacity\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x03 \x03(\tR\n" +
+	"operations\x12\x12\n" +
+	"\x04tags\x18\x04 \x03(\tR\x04tags\"\xd9\x01\n" +
+	"\fAgentMessage\x12(\n" +
+	"\x05hello\x18\x01 \x01(\v2\x10.calc.AgentHelloH\x00R\x05hello\x121\n" +
+	"\x06result\x18\x02 \x01(\v2\x17.calc.PostResultRequestH\x00R\x06result\x120\n" +
+	"\x05error\x18\x03 \x01(\v2\x18.calc.ReportErrorRequestH\x00R\x05error\x12/\n" +
+	"\x05renew\x18\x04 \x01(\v2\x17.calc.RenewLeaseRequestH\x00R\x05renewB\t\n" +
+	"\apayload\"1\n" +
+	"\aTaskAck\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x16\n" +
+	"\x06status\x18\x02 \x01(\tR\x06status\"c\n" +
+	"\rServerMessage\x12$\n" +
+	"\x04task\x18\x01 \x01(\v2\x0e.calc.TaskDataH\x00R\x04task\x12!\n" +
+	"\x03ack\x18\x02 \x01(\v2\r.calc.TaskAckH\x00R\x03ackB\t\n" +
+	"\apayload\"\xc4\x01\n" +
+	"\x14RegisterAgentRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1a\n" +
+	"\bhostname\x18\x02 \x01(\tR\bhostname\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\tR\aversion\x12'\n" +
+	"\x0fcomputing_power\x18\x04 \x01(\x05R\x0ecomputingPower\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x05 \x03(\tR\n" +
+	"operations\x12\x12\n" +
+	"\x04tags\x18\x06 \x03(\tR\x04tags\"c\n" +
+	"\x15RegisterAgentResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x122\n" +
+	"\x15heartbeat_interval_ms\x18\x02 \x01(\x05R\x13heartbeatIntervalMs\"-\n" +
+	"\x10HeartbeatRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"+\n" +
+	"\x11HeartbeatResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status2\xce\x03\n" +
+	"\vCalcService\x126\n" +
+	"\aGetTask\x12\x14.calc.GetTaskRequest\x1a\x15.calc.GetTaskResponse\x12?\n" +
+	"\n" +
+	"PostResult\x12\x17.calc.PostResultRequest\x1a\x18.calc.PostResultResponse\x12B\n" +
+	"\vReportError\x12\x18.calc.ReportErrorRequest\x1a\x19.calc.ReportErrorResponse\x12?\n" +
+	"\n" +
+	"RenewLease\x12\x17.calc.RenewLeaseRequest\x1a\x18.calc.RenewLeaseResponse\x129\n" +
+	"\n" +
+	"WorkStream\x12\x12.calc.AgentMessage\x1a\x13.calc.ServerMessage(\x010\x01\x12H\n" +
+	"\rRegisterAgent\x12\x1a.calc.RegisterAgentRequest\x1a\x1b.calc.RegisterAgentResponse\x12<\n" +
+	"\tHeartbeat\x12\x16.calc.HeartbeatRequest\x1a\x17.calc.HeartbeatResponseB?Z=github.com/TuHeKocmoc/yalyceumfinal2/internal/proto/calc;calcb\x06proto3"
+
+var (
+	file_internal_proto_calc_proto_rawDescOnce sync.Once
+	file_internal_proto_calc_proto_rawDescData []byte
+)
+
+func file_internal_proto_calc_proto_rawDescGZIP() []byte {
+	file_internal_proto_calc_proto_rawDescOnce.Do(func() {
+		file_internal_proto_calc_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_internal_proto_calc_proto_rawDesc), len(file_internal_proto_calc_proto_rawDesc)))
+	})
+	return file_internal_proto_calc_proto_rawDescData
+}
+
+var file_internal_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 17)
+var file_internal_proto_calc_proto_goTypes = []any{
+	(*GetTaskRequest)(nil),        // 0: calc.GetTaskRequest
+	(*GetTaskResponse)(nil),       // 1: calc.GetTaskResponse
+	(*TaskData)(nil),              // 2: calc.TaskData
+	(*PostResultRequest)(nil),     // 3: calc.PostResultRequest
+	(*PostResultResponse)(nil),    // 4: calc.PostResultResponse
+	(*ReportErrorRequest)(nil),    // 5: calc.ReportErrorRequest
+	(*ReportErrorResponse)(nil),   // 6: calc.ReportErrorResponse
+	(*RenewLeaseRequest)(nil),     // 7: calc.RenewLeaseRequest
+	(*RenewLeaseResponse)(nil),    // 8: calc.RenewLeaseResponse
+	(*AgentHello)(nil),            // 9: calc.AgentHello
+	(*AgentMessage)(nil),          // 10: calc.AgentMessage
+	(*TaskAck)(nil),               // 11: calc.TaskAck
+	(*ServerMessage)(nil),         // 12: calc.ServerMessage
+	(*RegisterAgentRequest)(nil),  // 13: calc.RegisterAgentRequest
+	(*RegisterAgentResponse)(nil), // 14: calc.RegisterAgentResponse
+	(*HeartbeatRequest)(nil),      // 15: calc.HeartbeatRequest
+	(*HeartbeatResponse)(nil),     // 16: calc.HeartbeatResponse
+}
+var file_internal_proto_calc_proto_depIdxs = []int32{
+	2,  // 0: calc.GetTaskResponse.task:type_name -> calc.TaskData
+	9,  // 1: calc.AgentMessage.hello:type_name -> calc.AgentHello
+	3,  // 2: calc.AgentMessage.result:type_name -> calc.PostResultRequest
+	5,  // 3: calc.AgentMessage.error:type_name -> calc.ReportErrorRequest
+	7,  // 4: calc.AgentMessage.renew:type_name -> calc.RenewLeaseRequest
+	2,  // 5: calc.ServerMessage.task:type_name -> calc.TaskData
+	11, // 6: calc.ServerMessage.ack:type_name -> calc.TaskAck
+	0,  // 7: calc.CalcService.GetTask:input_type -> calc.GetTaskRequest
+	3,  // 8: calc.CalcService.PostResult:input_type -> calc.PostResultRequest
+	5,  // 9: calc.CalcService.ReportError:input_type -> calc.ReportErrorRequest
+	7,  // 10: calc.CalcService.RenewLease:input_type -> calc.RenewLeaseRequest
+	10, // 11: calc.CalcService.WorkStream:input_type -> calc.AgentMessage
+	13, // 12: calc.CalcService.RegisterAgent:input_type -> calc.RegisterAgentRequest
+	15, // 13: calc.CalcService.Heartbeat:input_type -> calc.HeartbeatRequest
+	1,  // 14: calc.CalcService.GetTask:output_type -> calc.GetTaskResponse
+	4,  // 15: calc.CalcService.PostResult:output_type -> calc.PostResultResponse
+	6,  // 16: calc.CalcService.ReportError:output_type -> calc.ReportErrorResponse
+	8,  // 17: calc.CalcService.RenewLease:output_type -> calc.RenewLeaseResponse
+	12, // 18: calc.CalcService.WorkStream:output_type -> calc.ServerMessage
+	14, // 19: calc.CalcService.RegisterAgent:output_type -> calc.RegisterAgentResponse
+	16, // 20: calc.CalcService.Heartbeat:output_type -> calc.HeartbeatResponse
+	14, // [14:21] is the sub-list for method output_type
+	7,  // [7:14] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_internal_proto_calc_proto_init() }
+func file_internal_proto_calc_proto_init() {
+	if File_internal_proto_calc_proto != nil {
+		return
+	}
+	file_internal_proto_calc_proto_msgTypes[10].OneofWrappers = []any{
+		(*AgentMessage_Hello)(nil),
+		(*AgentMessage_Result)(nil),
+		(*AgentMessage_Error)(nil),
+		(*AgentMessage_Renew)(nil),
+	}
+	file_internal_proto_calc_proto_msgTypes[12].OneofWrappers = []any{
+		(*ServerMessage_Task)(nil),
+		(*ServerMessage_Ack)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -352,7 +1283,7 @@ func file_internal_proto_calc_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_calc_proto_rawDesc), len(file_internal_proto_calc_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   5,
+			NumMessages:   17,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
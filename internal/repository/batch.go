@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+)
+
+// BatchTx stores a batch of expressions and plans their tasks in a single
+// transaction. Until Commit or Rollback it holds the only database
+// connection, so no other repository function may be called meanwhile.
+type BatchTx struct {
+	ID      string
+	tx      *sql.Tx
+	userID  int64
+	ready   bool
+	started []*model.Expression
+}
+
+// BeginBatch opens a batch of expressions of the user.
+func BeginBatch(userID int64) (*BatchTx, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("BeginBatch error: %w", err)
+	}
+	b := &BatchTx{ID: uuid.New().String(), tx: tx, userID: userID}
+	_, err = tx.Exec(
+		`INSERT INTO batches (id, user_id, created_at) VALUES (?, ?, ?)`,
+		b.ID, userID, time.Now().UnixMilli(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("BeginBatch insert error: %w", err)
+	}
+	return b, nil
+}
+
+// BeginExpression opens a transaction storing expressions of the user
+// outside of any batch, e.g. a single one sent to /api/v1/calculate.
+func BeginExpression(userID int64) (*BatchTx, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("BeginExpression error: %w", err)
+	}
+	return &BatchTx{tx: tx, userID: userID}, nil
+}
+
+// CreateExpression stores e as a pending expression of the batch together
+// with its options and tags. It fills in the ID, owner and batch of e.
+func (b *BatchTx) CreateExpression(e *model.Expression, tags []string) error {
+	e.ID = uuid.New().String()
+	e.UserID = b.userID
+	e.BatchID = b.ID
+	e.Status = model.StatusPending
+	e.CreatedAt = time.UnixMilli(time.Now().UnixMilli())
+	if e.Replication < 1 {
+		e.Replication = 1
+	}
+
+	var batchID, deadline, callback, label interface{}
+	if e.BatchID != "" {
+		batchID = e.BatchID
+	}
+	if e.Deadline != nil {
+		deadline = e.Deadline.UnixMilli()
+	}
+	if e.CallbackURL != "" {
+		callback = e.CallbackURL
+	}
+	if e.Label != "" {
+		label = e.Label
+	}
+	_, err := b.tx.Exec(
+		`INSERT INTO expressions
+             (id, user_id, raw, status, replication, deadline, priority, callback_url, batch_id, label, created_at)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.UserID, e.Raw, e.Status, e.Replication, deadline, e.Priority, callback, batchID, label,
+		e.CreatedAt.UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("batch create expression error: %w", err)
+	}
+	return insertTags(b.tx, e.ID, tags)
+}
+
+// CreateTask stores a planned task of an expression of the batch.
+func (b *BatchTx) CreateTask(expressionID string, op string, args []model.TaskArg) (*model.Task, error) {
+	t, ready, err := createTask(b.tx, expressionID, op, args)
+	if err != nil {
+		return nil, err
+	}
+	b.ready = b.ready || ready
+	return t, nil
+}
+
+// StartExpression moves the planned expression to IN_PROGRESS.
+func (b *BatchTx) StartExpression(e *model.Expression, finalTaskID int) error {
+	_, err := b.tx.Exec(
+		`UPDATE expressions SET status = ?, final_task_id = ? WHERE id = ?`,
+		model.StatusInProgress, finalTaskID, e.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("batch start expression error: %w", err)
+	}
+	e.Status = model.StatusInProgress
+	e.FinalTaskID = finalTaskID
+	b.started = append(b.started, e)
+	return nil
+}
+
+// CompleteIdempotencyKey records within the batch that the request holding
+// key created exprID, see the function of the same name.
+func (b *BatchTx) CompleteIdempotencyKey(key, exprID string, statusCode int) error {
+	return completeIdempotencyKey(b.tx, b.userID, key, exprID, statusCode)
+}
+
+// Commit stores the batch and wakes up the agents waiting for tasks.
+func (b *BatchTx) Commit() error {
+	if err := b.tx.Commit(); err != nil {
+		return fmt.Errorf("batch commit error: %w", err)
+	}
+	if b.ready {
+		notify.TasksReady.Broadcast()
+	}
+	for _, e := range b.started {
+		if err := expressionChanged(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback drops the batch; it does nothing after Commit.
+func (b *BatchTx) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// GetBatch returns the batch of the user with its expressions in the order
+// they were submitted, nil if there is no such batch.
+func GetBatch(userID int64, batchID string) (*model.Batch, error) {
+	var created int64
+	err := db.GlobalDB.QueryRow(
+		`SELECT created_at FROM batches WHERE id = ? AND user_id = ?`,
+		batchID, userID,
+	).Scan(&created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetBatch error: %w", err)
+	}
+
+	rows, err := db.GlobalDB.Query(
+		`SELECT `+expressionColumns+` FROM expressions WHERE batch_id = ? ORDER BY rowid`,
+		batchID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetBatch expressions error: %w", err)
+	}
+	defer rows.Close()
+
+	batch := &model.Batch{
+		ID:          batchID,
+		CreatedAt:   time.UnixMilli(created),
+		Counts:      map[string]int{},
+		Expressions: []*model.Expression{},
+	}
+	finished, failed := 0, 0
+	for rows.Next() {
+		e, err := scanExpression(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetBatch scan error: %w", err)
+		}
+		batch.Expressions = append(batch.Expressions, e)
+		batch.Counts[e.Status]++
+		if e.Finished() {
+			finished++
+			if e.Status != model.StatusDone {
+				failed++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	batch.Total = len(batch.Expressions)
+	switch {
+	case finished < batch.Total:
+		batch.Status = model.BatchInProgress
+	case failed > 0:
+		batch.Status = model.BatchFailed
+	default:
+		batch.Status = model.BatchDone
+	}
+	return batch, nil
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+)
+
+// publishTask tells the streams of userID that the task finished. The task
+// is copied since the caller may keep changing it.
+func publishTask(userID int64, t *model.Task) {
+	task := *t
+	notify.Events.Publish(notify.Event{
+		Type:         notify.EventTask,
+		UserID:       userID,
+		ExpressionID: t.ExpressionID,
+		Task:         &task,
+	})
+}
+
+// expressionChanged tells the streams of the owner that the expression
+// changed its status and, once it is finished, queues its webhooks.
+func expressionChanged(e *model.Expression) error {
+	expr := *e
+	notify.Events.Publish(notify.Event{
+		Type:         notify.EventExpression,
+		UserID:       e.UserID,
+		ExpressionID: e.ID,
+		Expression:   &expr,
+	})
+	if !e.Finished() {
+		return nil
+	}
+	return queueWebhooks(&expr)
+}
+
+// expressionDeleted tells the streams of userID that the expression is gone.
+func expressionDeleted(userID int64, exprID string) {
+	notify.Events.Publish(notify.Event{
+		Type:         notify.EventDeleted,
+		UserID:       userID,
+		ExpressionID: exprID,
+	})
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -10,74 +11,187 @@ import (
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
 )
 
+const expressionColumns = `id, user_id, raw, status, result, final_task_id, error, replication, deadline, priority, unroutable, callback_url,
+        batch_id, label, created_at, finished_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanExpression reads a row selected with expressionColumns, followed by
+// the extra columns if any.
+func scanExpression(row rowScanner, extra ...interface{}) (*model.Expression, error) {
+	var e model.Expression
+	var nullableRes sql.NullFloat64
+	var nullableFinalTaskID sql.NullInt64
+	var nullableErr sql.NullString
+	var nullableDeadline sql.NullInt64
+	var nullableUnroutable sql.NullString
+	var nullableCallback sql.NullString
+	var nullableBatch sql.NullString
+	var nullableLabel sql.NullString
+	var created int64
+	var nullableFinished sql.NullInt64
+
+	dest := []interface{}{
+		&e.ID,
+		&e.UserID,
+		&e.Raw,
+		&e.Status,
+		&nullableRes,
+		&nullableFinalTaskID,
+		&nullableErr,
+		&e.Replication,
+		&nullableDeadline,
+		&e.Priority,
+		&nullableUnroutable,
+		&nullableCallback,
+		&nullableBatch,
+		&nullableLabel,
+		&created,
+		&nullableFinished,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if nullableRes.Valid {
+		val := nullableRes.Float64
+		e.Result = &val
+	}
+	if nullableFinalTaskID.Valid {
+		e.FinalTaskID = int(nullableFinalTaskID.Int64)
+	}
+	e.Error = nullableErr.String
+	e.Unroutable = nullableUnroutable.String
+	e.CallbackURL = nullableCallback.String
+	e.BatchID = nullableBatch.String
+	e.Label = nullableLabel.String
+	e.CreatedAt = time.UnixMilli(created)
+	if nullableFinished.Valid {
+		f := time.UnixMilli(nullableFinished.Int64)
+		e.FinishedAt = &f
+	}
+	if nullableDeadline.Valid {
+		d := time.UnixMilli(nullableDeadline.Int64)
+		e.Deadline = &d
+	}
+
+	return &e, nil
+}
+
 func CreateExpression(raw string, userID int64) (*model.Expression, error) {
 	exprID := uuid.New().String()
 	status := model.StatusPending
+	now := time.Now()
 
 	query := `
-        INSERT INTO expressions (id, user_id, raw, status)
-        VALUES (?, ?, ?, ?)
+        INSERT INTO expressions (id, user_id, raw, status, created_at)
+        VALUES (?, ?, ?, ?, ?)
     `
-	_, err := db.GlobalDB.Exec(query, exprID, userID, raw, status)
+	_, err := db.GlobalDB.Exec(query, exprID, userID, raw, status, now.UnixMilli())
 	if err != nil {
 		return nil, fmt.Errorf("create expression error: %w", err)
 	}
 
 	return &model.Expression{
-		ID:     exprID,
-		UserID: userID,
-		Raw:    raw,
-		Status: status,
+		ID:          exprID,
+		UserID:      userID,
+		Raw:         raw,
+		Status:      status,
+		Replication: 1,
+		CreatedAt:   time.UnixMilli(now.UnixMilli()),
 	}, nil
 }
 
+// SetExpressionReplication sets how many distinct agents compute each task
+// of the expression. It has to be called before the tasks are planned.
+func SetExpressionReplication(exprID string, replication int) error {
+	_, err := db.GlobalDB.Exec(`UPDATE expressions SET replication = ? WHERE id = ?`, replication, exprID)
+	if err != nil {
+		return fmt.Errorf("set expression replication error: %w", err)
+	}
+	return nil
+}
+
+// SetExpressionPriority sets the scheduling priority of the expression. It
+// has to be called before the tasks are planned.
+func SetExpressionPriority(exprID string, priority int) error {
+	_, err := db.GlobalDB.Exec(`UPDATE expressions SET priority = ? WHERE id = ?`, priority, exprID)
+	if err != nil {
+		return fmt.Errorf("set expression priority error: %w", err)
+	}
+	return nil
+}
+
+// SetExpressionTags stores the tags an agent needs to compute the tasks of
+// the expression. It has to be called before the tasks are planned.
+func SetExpressionTags(exprID string, tags []string) error {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return fmt.Errorf("set expression tags begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertTags(tx, exprID, tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertTags(tx *sql.Tx, exprID string, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO expression_tags (expression_id, tag) VALUES (?, ?)`, exprID, tag)
+		if err != nil {
+			return fmt.Errorf("set expression tags error: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetExpressionTags returns the tags required by the expression in order.
+func GetExpressionTags(exprID string) ([]string, error) {
+	rows, err := db.GlobalDB.Query(`SELECT tag FROM expression_tags WHERE expression_id = ? ORDER BY tag`, exprID)
+	if err != nil {
+		return nil, fmt.Errorf("get expression tags error: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("get expression tags scan error: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
 func GetExpressionByID(userID int64, exprID string) (*model.Expression, error) {
 	query := `
-        SELECT id, user_id, raw, status, result, final_task_id
+        SELECT ` + expressionColumns + `
         FROM expressions
         WHERE id = ? AND user_id = ?
         LIMIT 1
     `
-	row := db.GlobalDB.QueryRow(query, exprID, userID)
-
-	var e model.Expression
-	var nullableRes sql.NullFloat64
-	var nullableFinalTaskID sql.NullInt64
-
-	err := row.Scan(
-		&e.ID,
-		&e.UserID,
-		&e.Raw,
-		&e.Status,
-		&nullableRes,
-		&nullableFinalTaskID,
-	)
+	e, err := scanExpression(db.GlobalDB.QueryRow(query, exprID, userID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("get expression error: %w", err)
 	}
-
-	if nullableRes.Valid {
-		val := nullableRes.Float64
-		e.Result = &val
-	}
-	if nullableFinalTaskID.Valid {
-		e.FinalTaskID = int(nullableFinalTaskID.Int64)
-	} else {
-		e.FinalTaskID = 0
-	}
-
-	return &e, nil
+	return e, nil
 }
 
 func GetAllExpressions(userID int64) ([]*model.Expression, error) {
 	query := `
-        SELECT id, user_id, raw, status, result, final_task_id
+        SELECT ` + expressionColumns + `
         FROM expressions
         WHERE user_id = ?
-        ORDER BY id
+        ORDER BY created_at, rowid
     `
 	rows, err := db.GlobalDB.Query(query, userID)
 	if err != nil {
@@ -87,33 +201,11 @@ func GetAllExpressions(userID int64) ([]*model.Expression, error) {
 
 	var result []*model.Expression
 	for rows.Next() {
-		var e model.Expression
-		var nullableRes sql.NullFloat64
-		var nullableFinalTaskID sql.NullInt64
-
-		err := rows.Scan(
-			&e.ID,
-			&e.UserID,
-			&e.Raw,
-			&e.Status,
-			&nullableRes,
-			&nullableFinalTaskID,
-		)
+		e, err := scanExpression(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scan expression error: %w", err)
 		}
-
-		if nullableRes.Valid {
-			val := nullableRes.Float64
-			e.Result = &val
-		}
-		if nullableFinalTaskID.Valid {
-			e.FinalTaskID = int(nullableFinalTaskID.Int64)
-		} else {
-			e.FinalTaskID = 0
-		}
-
-		result = append(result, &e)
+		result = append(result, e)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -128,8 +220,11 @@ func UpdateExpression(e *model.Expression) error {
         UPDATE expressions
         SET status = ?,
             result = ?,
-            final_task_id = ?
+            final_task_id = ?,
+            error = ?,
+            finished_at = CASE WHEN ? THEN COALESCE(finished_at, ?) END
         WHERE id = ? AND user_id = ?
+        RETURNING finished_at
     `
 	var resultVal interface{}
 	if e.Result != nil {
@@ -137,25 +232,252 @@ func UpdateExpression(e *model.Expression) error {
 	} else {
 		resultVal = nil
 	}
+	var errVal interface{}
+	if e.Error != "" {
+		errVal = e.Error
+	}
 
-	_, err := db.GlobalDB.Exec(
+	var finished sql.NullInt64
+	err := db.GlobalDB.QueryRow(
 		query,
 		e.Status,
 		resultVal,
 		e.FinalTaskID,
+		errVal,
+		e.Finished(),
+		time.Now().UnixMilli(),
 		e.ID,
 		e.UserID,
-	)
-	if err != nil {
+	).Scan(&finished)
+	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("update expression error: %w", err)
 	}
+	e.FinishedAt = nil
+	if finished.Valid {
+		f := time.UnixMilli(finished.Int64)
+		e.FinishedAt = &f
+	}
+	return expressionChanged(e)
+}
+
+// SetExpressionDeadline sets the moment after which the tasks of the
+// expression are no longer handed out and the expression times out.
+func SetExpressionDeadline(exprID string, deadline time.Time) error {
+	_, err := db.GlobalDB.Exec(`UPDATE expressions SET deadline = ? WHERE id = ?`, deadline.UnixMilli(), exprID)
+	if err != nil {
+		return fmt.Errorf("set expression deadline error: %w", err)
+	}
 	return nil
 }
 
-func DeleteExpression(userID int64, exprID string) error {
-	query := `DELETE FROM expressions WHERE id = ? AND user_id = ?`
-	_, err := db.GlobalDB.Exec(query, exprID, userID)
-	return err
+// GetExpressionProgress counts the done and all tasks of the expression;
+// replicas only count when they are dead.
+func GetExpressionProgress(exprID string) (*model.Progress, error) {
+	var p model.Progress
+	err := db.GlobalDB.QueryRow(
+		`SELECT COALESCE(SUM(replica_of IS NULL), 0),
+                COALESCE(SUM(replica_of IS NULL AND status = ?), 0),
+                COALESCE(SUM(status = ?), 0)
+         FROM tasks WHERE expression_id = ?`,
+		model.TaskStatusDone, model.TaskStatusDead, exprID,
+	).Scan(&p.Total, &p.Done, &p.Dead)
+	if err != nil {
+		return nil, fmt.Errorf("get expression progress error: %w", err)
+	}
+	return &p, nil
+}
+
+// ExpireDeadlines times out the unfinished expressions whose deadline is
+// before now: their waiting and in-flight tasks are cancelled and the error
+// tells how far the computation got. It returns the number of expressions
+// timed out.
+func ExpireDeadlines(now time.Time) (int, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ExpireDeadlines begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT id FROM expressions
+         WHERE deadline IS NOT NULL AND deadline <= ? AND status IN (?, ?)`,
+		now.UnixMilli(), model.StatusPending, model.StatusInProgress,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("ExpireDeadlines select error: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("ExpireDeadlines scan error: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var timedOut []*model.Expression
+	for _, id := range ids {
+		expr, err := timeOutExpression(tx, id, now)
+		if err != nil {
+			return 0, err
+		}
+		if expr != nil {
+			timedOut = append(timedOut, expr)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ExpireDeadlines commit error: %w", err)
+	}
+	for _, e := range timedOut {
+		if err := expressionChanged(e); err != nil {
+			return len(timedOut), err
+		}
+	}
+	return len(timedOut), nil
+}
+
+// timeOutExpression times out the unfinished expression within tx, see
+// ExpireDeadlines. It returns nil if the expression is finished already.
+func timeOutExpression(tx *sql.Tx, exprID string, now time.Time) (*model.Expression, error) {
+	var total, done int
+	err := tx.QueryRow(
+		`SELECT COUNT(*), COUNT(CASE WHEN status = ? THEN 1 END)
+         FROM tasks WHERE expression_id = ? AND replica_of IS NULL`,
+		model.TaskStatusDone, exprID,
+	).Scan(&total, &done)
+	if err != nil {
+		return nil, fmt.Errorf("time out expression progress error: %w", err)
+	}
+
+	expr, err := scanExpression(tx.QueryRow(
+		`UPDATE expressions SET status = ?, error = ?, finished_at = ?
+         WHERE id = ? AND status IN (?, ?)
+         RETURNING `+expressionColumns,
+		model.StatusTimeout,
+		fmt.Sprintf("deadline exceeded: %d of %d tasks done", done, total),
+		now.UnixMilli(),
+		exprID, model.StatusPending, model.StatusInProgress,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("time out expression update error: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET status = ?, lease_owner = NULL, lease_expires_at = NULL
+         WHERE expression_id = ? AND status IN (?, ?, ?, ?)`,
+		model.TaskStatusCancelled, exprID,
+		model.TaskStatusWaiting, model.TaskStatusInProgress, model.TaskStatusDead, model.TaskStatusReplicated,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("time out expression tasks error: %w", err)
+	}
+	return expr, nil
+}
+
+// CancelExpression stops an unfinished expression of userID: the
+// expression and its waiting, in-flight and dead tasks become CANCELLED, so
+// agents computing one of them are told to drop it when they renew the
+// lease or post the result. A finished expression is returned unchanged; nil means
+// there is no such expression.
+func CancelExpression(userID int64, exprID string) (*model.Expression, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("CancelExpression begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT ` + expressionColumns + `
+        FROM expressions
+        WHERE id = ? AND user_id = ?
+    `
+	e, err := scanExpression(tx.QueryRow(query, exprID, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("CancelExpression select error: %w", err)
+	}
+	if e.Finished() {
+		return e, nil
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET status = ?, lease_owner = NULL, lease_expires_at = NULL
+         WHERE expression_id = ? AND status IN (?, ?, ?, ?)`,
+		model.TaskStatusCancelled, exprID,
+		model.TaskStatusWaiting, model.TaskStatusInProgress, model.TaskStatusDead, model.TaskStatusReplicated,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("CancelExpression tasks error: %w", err)
+	}
+	finished := time.UnixMilli(time.Now().UnixMilli())
+	_, err = tx.Exec(
+		`UPDATE expressions SET status = ?, finished_at = ? WHERE id = ?`,
+		model.StatusCancelled, finished.UnixMilli(), exprID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("CancelExpression update error: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("CancelExpression commit error: %w", err)
+	}
+	e.Status = model.StatusCancelled
+	e.FinishedAt = &finished
+	return e, expressionChanged(e)
+}
+
+// DeleteExpression removes the expression of userID with all its tasks,
+// webhook deliveries and the idempotency keys that created it. It returns
+// false if there is no such expression.
+func DeleteExpression(userID int64, exprID string) (bool, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("DeleteExpression begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM expressions WHERE id = ? AND user_id = ?`, exprID, userID)
+	if err != nil {
+		return false, fmt.Errorf("DeleteExpression error: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	cascade := []string{
+		`DELETE FROM task_runs WHERE task_id IN (SELECT id FROM tasks WHERE expression_id = ?)`,
+		`DELETE FROM task_args WHERE task_id IN (SELECT id FROM tasks WHERE expression_id = ?)`,
+		`DELETE FROM tasks WHERE expression_id = ?`,
+		`DELETE FROM expression_tags WHERE expression_id = ?`,
+		`DELETE FROM webhook_deliveries WHERE expression_id = ?`,
+		`DELETE FROM idempotency_keys WHERE expression_id = ?`,
+	}
+	for _, q := range cascade {
+		if _, err := tx.Exec(q, exprID); err != nil {
+			return false, fmt.Errorf("DeleteExpression cascade error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("DeleteExpression commit error: %w", err)
+	}
+	expressionDeleted(userID, exprID)
+	return true, nil
 }
 
 func FetchTasksForExpression(e *model.Expression) error {
@@ -180,81 +502,34 @@ func FetchTasksForExpression(e *model.Expression) error {
 
 func GetExpressionByIDForTask(exprID string) (*model.Expression, error) {
 	query := `
-        SELECT id, user_id, raw, status, result, final_task_id
+        SELECT ` + expressionColumns + `
         FROM expressions
         WHERE id = ?
         LIMIT 1
     `
-	row := db.GlobalDB.QueryRow(query, exprID)
-
-	var e model.Expression
-	var nullableRes sql.NullFloat64
-	var nullableFinalTaskID sql.NullInt64
-
-	err := row.Scan(
-		&e.ID,
-		&e.UserID,
-		&e.Raw,
-		&e.Status,
-		&nullableRes,
-		&nullableFinalTaskID,
-	)
+	e, err := scanExpression(db.GlobalDB.QueryRow(query, exprID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("GetExpressionByIDForTask error: %w", err)
 	}
-
-	if nullableRes.Valid {
-		val := nullableRes.Float64
-		e.Result = &val
-	}
-	if nullableFinalTaskID.Valid {
-		e.FinalTaskID = int(nullableFinalTaskID.Int64)
-	} else {
-		e.FinalTaskID = 0
-	}
-	return &e, nil
+	return e, nil
 }
 
 func GetExpressionByIDNoUserCheck(exprID string) (*model.Expression, error) {
 	query := `
-        SELECT id, user_id, raw, status, result, final_task_id
+        SELECT ` + expressionColumns + `
         FROM expressions
         WHERE id = ?
         LIMIT 1
     `
-	row := db.GlobalDB.QueryRow(query, exprID)
-
-	var e model.Expression
-	var nullableRes sql.NullFloat64
-	var nullableFinalTaskID sql.NullInt64
-
-	err := row.Scan(
-		&e.ID,
-		&e.UserID,
-		&e.Raw,
-		&e.Status,
-		&nullableRes,
-		&nullableFinalTaskID,
-	)
+	e, err := scanExpression(db.GlobalDB.QueryRow(query, exprID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
-
-	if nullableRes.Valid {
-		val := nullableRes.Float64
-		e.Result = &val
-	}
-
-	if nullableFinalTaskID.Valid {
-		e.FinalTaskID = int(nullableFinalTaskID.Int64)
-	} else {
-		e.FinalTaskID = 0
-	}
-	return &e, nil
+	return e, nil
 }
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+)
+
+// ReserveIdempotencyKey claims the key of the user for a request with the
+// given hash until now+ttl. It returns nil once the key is reserved for the
+// caller, otherwise the live entry of an earlier request. An expired entry
+// is replaced.
+func ReserveIdempotencyKey(userID int64, key, hash string, now time.Time, ttl time.Duration) (*model.IdempotencyKey, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("ReserveIdempotencyKey begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND expires_at <= ?`,
+		userID, key, now.UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ReserveIdempotencyKey expire error: %w", err)
+	}
+
+	res, err := tx.Exec(
+		`INSERT OR IGNORE INTO idempotency_keys (user_id, key, request_hash, created_at, expires_at)
+         VALUES (?, ?, ?, ?, ?)`,
+		userID, key, hash, now.UnixMilli(), now.Add(ttl).UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ReserveIdempotencyKey insert error: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil, tx.Commit()
+	}
+
+	k := model.IdempotencyKey{Key: key}
+	var exprID sql.NullString
+	var code sql.NullInt64
+	var created, expires int64
+	err = tx.QueryRow(
+		`SELECT request_hash, expression_id, status_code, created_at, expires_at
+         FROM idempotency_keys WHERE user_id = ? AND key = ?`,
+		userID, key,
+	).Scan(&k.RequestHash, &exprID, &code, &created, &expires)
+	if err != nil {
+		return nil, fmt.Errorf("ReserveIdempotencyKey select error: %w", err)
+	}
+	k.ExpressionID = exprID.String
+	k.StatusCode = int(code.Int64)
+	k.CreatedAt = time.UnixMilli(created)
+	k.ExpiresAt = time.UnixMilli(expires)
+	return &k, nil
+}
+
+// CompleteIdempotencyKey records the outcome of the request that reserved
+// the key.
+func CompleteIdempotencyKey(userID int64, key, exprID string, statusCode int) error {
+	return completeIdempotencyKey(db.GlobalDB, userID, key, exprID, statusCode)
+}
+
+func completeIdempotencyKey(ex interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, userID int64, key, exprID string, statusCode int) error {
+	_, err := ex.Exec(
+		`UPDATE idempotency_keys SET expression_id = ?, status_code = ? WHERE user_id = ? AND key = ?`,
+		exprID, statusCode, userID, key,
+	)
+	if err != nil {
+		return fmt.Errorf("CompleteIdempotencyKey error: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey frees a key whose request created nothing, so that
+// it can be sent again.
+func ReleaseIdempotencyKey(userID int64, key string) error {
+	_, err := db.GlobalDB.Exec(
+		`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND expression_id IS NULL`,
+		userID, key,
+	)
+	if err != nil {
+		return fmt.Errorf("ReleaseIdempotencyKey error: %w", err)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the keys expired at now.
+func PurgeIdempotencyKeys(now time.Time) (int64, error) {
+	res, err := db.GlobalDB.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("PurgeIdempotencyKeys error: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+)
+
+// RenewLease extends the lease of owner on the task by ttl from now. It
+// returns false if the task is not in progress under owner's lease anymore.
+func RenewLease(taskID int, owner string, ttl time.Duration) (bool, error) {
+	res, err := db.GlobalDB.Exec(
+		`UPDATE tasks SET lease_expires_at = ?
+         WHERE id = ? AND status = ? AND lease_owner = ?`,
+		time.Now().Add(ttl).UnixMilli(),
+		taskID, model.TaskStatusInProgress, owner,
+	)
+	if err != nil {
+		return false, fmt.Errorf("RenewLease exec error: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("RenewLease rows error: %w", err)
+	}
+	return n > 0, nil
+}
+
+// RequeueExpiredLeases returns the in-progress tasks whose lease expired
+// before now to the queue, so another agent can pick them up after the
+// backoff of the retry policy. Tasks out of retries become DEAD.
+func RequeueExpiredLeases(now time.Time) (int64, error) {
+	n, err := failAttempts(`'lease of ' || lease_owner || ' expired'`,
+		`status = 'IN_PROGRESS' AND lease_expires_at < ?1`, now)
+	if err != nil {
+		return n, fmt.Errorf("RequeueExpiredLeases %w", err)
+	}
+	return n, nil
+}
+
+// ReleaseTask returns a task leased by owner to the queue right away, e.g.
+// when the agent disconnects before finishing it. It counts as a failed
+// attempt, see RetryPolicy.
+func ReleaseTask(taskID int, owner string) (bool, error) {
+	n, err := failAttempts(`'agent ' || lease_owner || ' disconnected'`,
+		`id = ?5 AND status = 'IN_PROGRESS' AND lease_owner = ?6`, time.Now(), taskID, owner)
+	if err != nil {
+		return n > 0, fmt.Errorf("ReleaseTask %w", err)
+	}
+	return n > 0, nil
+}
+
+// ReleaseAgentTasks returns every task leased by owner to the queue, e.g.
+// when the agent stopped sending heartbeats. It counts as a failed attempt
+// of each task.
+func ReleaseAgentTasks(owner string) (int64, error) {
+	n, err := failAttempts(`'agent ' || lease_owner || ' missed heartbeats'`,
+		`status = 'IN_PROGRESS' AND lease_owner = ?5`, time.Now(), owner)
+	if err != nil {
+		return n, fmt.Errorf("ReleaseAgentTasks %w", err)
+	}
+	return n, nil
+}
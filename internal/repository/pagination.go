@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+)
+
+// Orders of ListExpressions.
+const (
+	SortCreated  = "created_at"
+	SortFinished = "finished_at"
+)
+
+// ExpressionCursor is the position after the last expression of a page:
+// its sort key in milliseconds and its row, which breaks ties.
+type ExpressionCursor struct {
+	Key int64
+	Row int64
+}
+
+// ExpressionFilter selects a page of ListExpressions.
+type ExpressionFilter struct {
+	// Statuses keeps the expressions in any of them, all if empty.
+	Statuses []string
+	// CreatedFrom (inclusive) and CreatedTo (exclusive) bound the creation
+	// time.
+	CreatedFrom, CreatedTo *time.Time
+	// Search keeps the expressions whose raw text contains it.
+	Search string
+	// Sort is SortCreated or SortFinished; the latter lists only finished
+	// expressions.
+	Sort string
+	Desc bool
+	// After continues the listing from the previous page.
+	After *ExpressionCursor
+	// Limit is the page size, 0 lists all expressions at once.
+	Limit int
+}
+
+// likeEscaper makes a search text match literally in LIKE ... ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListExpressions returns a page of the expressions of the user and the
+// cursor of the next page, nil on the last one.
+func ListExpressions(userID int64, f ExpressionFilter) ([]*model.Expression, *ExpressionCursor, error) {
+	column := SortCreated
+	if f.Sort == SortFinished {
+		column = SortFinished
+	}
+
+	where := []string{`user_id = ?`}
+	args := []interface{}{userID}
+	if len(f.Statuses) > 0 {
+		where = append(where, `status IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(f.Statuses)), ", ")+`)`)
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+	if f.CreatedFrom != nil {
+		where = append(where, `created_at >= ?`)
+		args = append(args, f.CreatedFrom.UnixMilli())
+	}
+	if f.CreatedTo != nil {
+		where = append(where, `created_at < ?`)
+		args = append(args, f.CreatedTo.UnixMilli())
+	}
+	if f.Search != "" {
+		where = append(where, `raw LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.Search)+"%")
+	}
+	if column == SortFinished {
+		where = append(where, `finished_at IS NOT NULL`)
+	}
+
+	dir, cmp := "ASC", ">"
+	if f.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if f.After != nil {
+		where = append(where, fmt.Sprintf(`(%s, rowid) %s (?, ?)`, column, cmp))
+		args = append(args, f.After.Key, f.After.Row)
+	}
+
+	// One row more than asked tells whether there is a next page; a
+	// negative LIMIT has none.
+	query := `SELECT ` + expressionColumns + `, rowid
+        FROM expressions
+        WHERE ` + strings.Join(where, " AND ") + `
+        ORDER BY ` + column + ` ` + dir + `, rowid ` + dir + `
+        LIMIT ?`
+	limit := -1
+	if f.Limit > 0 {
+		limit = f.Limit + 1
+	}
+	args = append(args, limit)
+
+	rows, err := db.GlobalDB.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ListExpressions query error: %w", err)
+	}
+	defer rows.Close()
+
+	var list []*model.Expression
+	var rowIDs []int64
+	for rows.Next() {
+		var rowID int64
+		e, err := scanExpression(rows, &rowID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ListExpressions scan error: %w", err)
+		}
+		list = append(list, e)
+		rowIDs = append(rowIDs, rowID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if f.Limit <= 0 || len(list) <= f.Limit {
+		return list, nil, nil
+	}
+	list = list[:f.Limit]
+	last := list[len(list)-1]
+	next := &ExpressionCursor{Key: last.CreatedAt.UnixMilli(), Row: rowIDs[len(list)-1]}
+	if column == SortFinished {
+		next.Key = last.FinishedAt.UnixMilli()
+	}
+	return list, next, nil
+}
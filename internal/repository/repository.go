@@ -3,35 +3,31 @@ package repository
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
 )
 
-func GetTaskByID(id int) (*model.Task, error) {
-	query := `
-        SELECT
-            id,
-            expression_id,
-            op,
-            arg1_value,
-            arg1_task_id,
-            arg2_value,
-            arg2_task_id,
-            result,
-            status
-        FROM tasks
-        WHERE id = ?
-        LIMIT 1
-    `
-	row := db.GlobalDB.QueryRow(query, id)
+const taskColumns = `id, expression_id, op, arg1_value, arg1_task_id, arg2_value, arg2_task_id, result, status, error,
+        lease_owner, lease_expires_at, attempts, last_error, retry_at, replica_of`
 
+// scanTask reads a row selected with taskColumns. Extra arguments are not
+// loaded, see loadExtraArgs.
+func scanTask(row rowScanner) (*model.Task, error) {
 	var t model.Task
 	var arg1Val sql.NullFloat64
 	var arg1TaskID sql.NullInt64
 	var arg2Val sql.NullFloat64
 	var arg2TaskID sql.NullInt64
 	var resVal sql.NullFloat64
+	var errVal sql.NullString
+	var leaseOwner sql.NullString
+	var leaseExpires sql.NullInt64
+	var lastErr sql.NullString
+	var retryAt sql.NullInt64
+	var replicaOf sql.NullInt64
 
 	err := row.Scan(
 		&t.ID,
@@ -43,11 +39,15 @@ func GetTaskByID(id int) (*model.Task, error) {
 		&arg2TaskID,
 		&resVal,
 		&t.Status,
+		&errVal,
+		&leaseOwner,
+		&leaseExpires,
+		&t.Attempts,
+		&lastErr,
+		&retryAt,
+		&replicaOf,
 	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, err
 	}
 
@@ -71,10 +71,44 @@ func GetTaskByID(id int) (*model.Task, error) {
 		f := resVal.Float64
 		t.Result = &f
 	}
+	t.Error = errVal.String
+	t.LeaseOwner = leaseOwner.String
+	if leaseExpires.Valid {
+		exp := time.UnixMilli(leaseExpires.Int64)
+		t.LeaseExpiresAt = &exp
+	}
+	t.LastError = lastErr.String
+	if retryAt.Valid {
+		at := time.UnixMilli(retryAt.Int64)
+		t.RetryAt = &at
+	}
+	t.ReplicaOf = int(replicaOf.Int64)
 
 	return &t, nil
 }
 
+func GetTaskByID(id int) (*model.Task, error) {
+	query := `
+        SELECT ` + taskColumns + `
+        FROM tasks
+        WHERE id = ?
+        LIMIT 1
+    `
+	t, err := scanTask(db.GlobalDB.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := loadExtraArgs(t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
 func UpdateTask(t *model.Task) error {
 	query := `
         UPDATE tasks
@@ -85,7 +119,10 @@ func UpdateTask(t *model.Task) error {
             arg2_value = ?,
             arg2_task_id = ?,
             result = ?,
-            status = ?
+            status = ?,
+            error = ?,
+            lease_owner = ?,
+            lease_expires_at = ?
         WHERE id = ?
     `
 	var (
@@ -94,6 +131,9 @@ func UpdateTask(t *model.Task) error {
 		arg2Val  interface{}
 		arg2Task interface{}
 		resVal   interface{}
+		errVal   interface{}
+		leaseExp interface{}
+		owner    interface{}
 	)
 
 	if t.Arg1Value != nil {
@@ -111,8 +151,31 @@ func UpdateTask(t *model.Task) error {
 	if t.Result != nil {
 		resVal = *t.Result
 	}
+	if t.Error != "" {
+		errVal = t.Error
+	}
+	if t.LeaseExpiresAt != nil {
+		leaseExp = t.LeaseExpiresAt.UnixMilli()
+		owner = t.LeaseOwner
+	}
+
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return fmt.Errorf("UpdateTask begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldStatus string
+	var userID int64
+	err = tx.QueryRow(`SELECT status, user_id FROM tasks WHERE id = ?`, t.ID).Scan(&oldStatus, &userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("task not found with id=%d", t.ID)
+		}
+		return fmt.Errorf("UpdateTask select error: %w", err)
+	}
 
-	res, err := db.GlobalDB.Exec(query,
+	_, err = tx.Exec(query,
 		t.Op,
 		arg1Val,
 		arg1Task,
@@ -120,115 +183,199 @@ func UpdateTask(t *model.Task) error {
 		arg2Task,
 		resVal,
 		t.Status,
+		errVal,
+		owner,
+		leaseExp,
 		t.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("UpdateTask exec error: %w", err)
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("task not found with id=%d", t.ID)
+	wasDone := oldStatus == model.TaskStatusDone
+	isDone := t.Status == model.TaskStatusDone
+	if wasDone != isDone {
+		delta := -1
+		if wasDone {
+			delta = 1
+		}
+		if err := adjustDependents(tx, t.ID, delta); err != nil {
+			return err
+		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateTask commit error: %w", err)
+	}
+	if isDone != wasDone || t.Status == model.TaskStatusWaiting {
+		notify.TasksReady.Broadcast()
+	}
+	if isDone && !wasDone {
+		publishTask(userID, t)
+	}
 	return nil
 }
 
-func GetNextWaitingTask() (*model.Task, error) {
+// adjustDependents adds delta to pending_deps of every task that takes the
+// result of taskID as an argument, once per such argument.
+func adjustDependents(tx *sql.Tx, taskID int, delta int) error {
+	queries := []string{
+		`UPDATE tasks SET pending_deps = pending_deps + ? WHERE arg1_task_id = ?`,
+		`UPDATE tasks SET pending_deps = pending_deps + ? WHERE arg2_task_id = ?`,
+		`UPDATE tasks SET pending_deps = pending_deps + ?1 * (
+             SELECT COUNT(*) FROM task_args a WHERE a.task_id = tasks.id AND a.arg_task_id = ?2
+         )
+         WHERE id IN (SELECT task_id FROM task_args WHERE arg_task_id = ?2)`,
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q, delta, taskID); err != nil {
+			return fmt.Errorf("adjustDependents error: %w", err)
+		}
+	}
+	return nil
+}
 
-	waitingQuery := `
-        SELECT
-            id,
-            expression_id,
-            op,
-            arg1_value,
-            arg1_task_id,
-            arg2_value,
-            arg2_task_id,
-            result,
-            status
-        FROM tasks
-        WHERE status = 'WAITING'
-        ORDER BY id
-    `
-	rows, err := db.GlobalDB.Query(waitingQuery)
+// readyCondition selects waiting tasks whose dependencies are all done.
+// pending_deps is maintained by CreateTask, RecordRun and UpdateTask, so no
+// dependency has to be looked up at claim time.
+const readyCondition = `t.status = 'WAITING' AND t.pending_deps = 0`
+
+// claimableCondition selects ready tasks that owner (?1) may compute now
+// (?2, unix ms): an agent gets at most one replica of a task, and none if
+// it has no ID to vote under; tasks of expressions past their deadline are
+// skipped and retried tasks wait for their backoff.
+const claimableCondition = readyCondition + `
+    AND (t.retry_at IS NULL OR t.retry_at <= ?2)
+    AND (t.replica_of IS NULL OR (
+        ?1 <> ''
+        AND NOT EXISTS (SELECT 1 FROM task_runs r WHERE r.task_id = t.replica_of AND r.agent_id = ?1)
+        AND NOT EXISTS (SELECT 1 FROM tasks s WHERE s.replica_of = t.replica_of AND s.lease_owner = ?1)
+    ))
+    AND NOT EXISTS (
+        SELECT 1 FROM expressions e
+        WHERE e.id = t.expression_id AND e.deadline <= ?2
+    )`
+
+// ClaimNextTask claims a task for an agent that can compute any task, see
+// ClaimNextTaskFor.
+func ClaimNextTask(owner string, ttl func(op string) time.Duration) (*model.Task, error) {
+	return ClaimNextTaskFor(owner, model.Capabilities{}, ttl)
+}
+
+// ClaimNextTaskFor atomically picks a ready task that an agent with caps can
+// compute and leases it to owner for ttl(op). Concurrent callers never
+// receive the same task. It returns nil if no such task is ready.
+//
+// Tasks of a higher priority always go first. Among users whose best ready
+// tasks share the same priority the one served longest ago wins, so a user
+// with a huge batch cannot starve the others; each user's tasks are handed
+// out oldest first.
+func ClaimNextTaskFor(owner string, caps model.Capabilities, ttl func(op string) time.Duration) (*model.Task, error) {
+	tx, err := db.GlobalDB.Begin()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("ClaimNextTask begin error: %w", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var tasks []*model.Task
-	for rows.Next() {
-		var tr model.Task
-		var arg1Val sql.NullFloat64
-		var arg1TaskID sql.NullInt64
-		var arg2Val sql.NullFloat64
-		var arg2TaskID sql.NullInt64
-		var resVal sql.NullFloat64
-
-		err := rows.Scan(
-			&tr.ID,
-			&tr.ExpressionID,
-			&tr.Op,
-			&arg1Val,
-			&arg1TaskID,
-			&arg2Val,
-			&arg2TaskID,
-			&resVal,
-			&tr.Status,
-		)
-		if err != nil {
-			return nil, err
-		}
-		if arg1Val.Valid {
-			f := arg1Val.Float64
-			tr.Arg1Value = &f
-		}
-		if arg2Val.Valid {
-			f := arg2Val.Float64
-			tr.Arg2Value = &f
-		}
-		if arg1TaskID.Valid {
-			i := int(arg1TaskID.Int64)
-			tr.Arg1TaskID = &i
+	now := time.Now()
+	capable, capArgs := capabilityCondition(caps, 3)
+	top := `
+        SELECT t.priority FROM tasks t
+        WHERE ` + claimableCondition + capable + `
+        ORDER BY t.priority DESC
+        LIMIT 1
+    `
+	var priority int
+	args := append([]interface{}{owner, now.UnixMilli()}, capArgs...)
+	err = tx.QueryRow(top, args...).Scan(&priority)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		if arg2TaskID.Valid {
-			i := int(arg2TaskID.Int64)
-			tr.Arg2TaskID = &i
+		return nil, fmt.Errorf("ClaimNextTask priority error: %w", err)
+	}
+
+	// ready walks the users with ready tasks of that priority through the
+	// index, one lookup per user, instead of checking every user ever seen.
+	capable, capArgs = capabilityCondition(caps, 4)
+	pick := `
+        WITH RECURSIVE ready(user_id) AS (
+            SELECT MIN(user_id) FROM tasks
+            WHERE status = 'WAITING' AND pending_deps = 0 AND priority = ?3
+            UNION ALL
+            SELECT (SELECT MIN(user_id) FROM tasks
+                    WHERE status = 'WAITING' AND pending_deps = 0 AND priority = ?3
+                      AND user_id > ready.user_id)
+            FROM ready WHERE ready.user_id IS NOT NULL
+        )
+        SELECT f.user_id FROM ready JOIN fair_share f ON f.user_id = ready.user_id
+        WHERE EXISTS (
+            SELECT 1 FROM tasks t
+            WHERE t.user_id = f.user_id AND t.priority = ?3 AND ` + claimableCondition + capable + `
+        )
+        ORDER BY f.last_served, f.user_id
+        LIMIT 1
+    `
+	var userID int64
+	args = append([]interface{}{owner, now.UnixMilli(), priority}, capArgs...)
+	err = tx.QueryRow(pick, args...).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		if resVal.Valid {
-			f := resVal.Float64
-			tr.Result = &f
+		return nil, fmt.Errorf("ClaimNextTask pick error: %w", err)
+	}
+
+	capable, capArgs = capabilityCondition(caps, 5)
+	claim := `
+        UPDATE tasks
+        SET status = 'IN_PROGRESS', lease_owner = ?1
+        WHERE status = 'WAITING' AND id = (
+            SELECT t.id FROM tasks t
+            WHERE t.user_id = ?3 AND t.priority = ?4 AND ` + claimableCondition + capable + `
+            ORDER BY t.id
+            LIMIT 1
+        )
+        RETURNING ` + taskColumns
+	args = append([]interface{}{owner, now.UnixMilli(), userID, priority}, capArgs...)
+	t, err := scanTask(tx.QueryRow(claim, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		tasks = append(tasks, &tr)
+		return nil, fmt.Errorf("ClaimNextTask update error: %w", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+
+	_, err = tx.Exec(
+		`UPDATE fair_share SET last_served = (SELECT MAX(last_served) FROM fair_share) + 1 WHERE user_id = ?`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ClaimNextTask fair share error: %w", err)
 	}
 
-	for _, t := range tasks {
-		if t.Arg1TaskID != nil {
-			dep, err := GetTaskByID(*t.Arg1TaskID)
-			if err != nil {
-				return nil, err
-			}
-			if dep == nil || dep.Status != model.TaskStatusDone {
-				continue
-			}
-		}
-		if t.Arg2TaskID != nil {
-			dep, err := GetTaskByID(*t.Arg2TaskID)
-			if err != nil {
-				return nil, err
-			}
-			if dep == nil || dep.Status != model.TaskStatusDone {
-				continue
-			}
-		}
-		return t, nil
+	expires := now.Add(ttl(t.Op))
+	if _, err := tx.Exec(`UPDATE tasks SET lease_expires_at = ? WHERE id = ?`, expires.UnixMilli(), t.ID); err != nil {
+		return nil, fmt.Errorf("ClaimNextTask lease error: %w", err)
+	}
+	var deadline sql.NullInt64
+	err = tx.QueryRow(`SELECT deadline FROM expressions WHERE id = ?`, t.ExpressionID).Scan(&deadline)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("ClaimNextTask deadline error: %w", err)
+	}
+	if deadline.Valid {
+		d := time.UnixMilli(deadline.Int64)
+		t.Deadline = &d
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ClaimNextTask commit error: %w", err)
 	}
+	t.LeaseExpiresAt = &expires
 
-	return nil, nil
+	if err := loadExtraArgs(t); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
 func CreateTaskWithArgs(
@@ -237,6 +384,48 @@ func CreateTaskWithArgs(
 	arg1Value *float64, arg1TaskID *int,
 	arg2Value *float64, arg2TaskID *int,
 ) (*model.Task, error) {
+	return CreateTask(expressionID, op, []model.TaskArg{
+		{Value: arg1Value, TaskID: arg1TaskID},
+		{Value: arg2Value, TaskID: arg2TaskID},
+	})
+}
+
+// CreateTask stores a task with any number of arguments: the first two go to
+// the arg1/arg2 columns, the rest to task_args.
+func CreateTask(expressionID string, op string, args []model.TaskArg) (*model.Task, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("CreateTask begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, ready, err := createTask(tx, expressionID, op, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("CreateTask commit error: %w", err)
+	}
+	if ready {
+		notify.TasksReady.Broadcast()
+	}
+	return t, nil
+}
+
+// createTask inserts the task within tx and reports whether it is ready to
+// be computed right away.
+func createTask(tx *sql.Tx, expressionID string, op string, args []model.TaskArg) (*model.Task, bool, error) {
+	var arg1, arg2 model.TaskArg
+	if len(args) > 0 {
+		arg1 = args[0]
+	}
+	if len(args) > 1 {
+		arg2 = args[1]
+	}
+	var extra []model.TaskArg
+	if len(args) > 2 {
+		extra = args[2:]
+	}
 
 	query := `
         INSERT INTO tasks (
@@ -246,57 +435,170 @@ func CreateTaskWithArgs(
             arg1_task_id,
             arg2_value,
             arg2_task_id,
-            status
-        ) VALUES (?, ?, ?, ?, ?, ?, 'WAITING')
+            status,
+            pending_deps,
+            user_id,
+            priority
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `
-	var arg1Val, arg1T, arg2Val, arg2T interface{}
-	if arg1Value != nil {
-		arg1Val = *arg1Value
+	pending := 0
+	for _, arg := range args {
+		if arg.TaskID == nil {
+			continue
+		}
+		var status string
+		err := tx.QueryRow(`SELECT status FROM tasks WHERE id = ?`, *arg.TaskID).Scan(&status)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, false, fmt.Errorf("CreateTask dependency error: %w", err)
+		}
+		if status != model.TaskStatusDone {
+			pending++
+		}
 	}
-	if arg1TaskID != nil {
-		arg1T = *arg1TaskID
+
+	// Tasks carry the owner and priority of their expression so that the
+	// scheduler can pick them from an index.
+	var userID int64
+	var priority int
+	replication := 1
+	err := tx.QueryRow(
+		`SELECT user_id, priority, replication FROM expressions WHERE id = ?`,
+		expressionID,
+	).Scan(&userID, &priority, &replication)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("CreateTask expression error: %w", err)
 	}
-	if arg2Value != nil {
-		arg2Val = *arg2Value
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO fair_share (user_id) VALUES (?)`, userID); err != nil {
+		return nil, false, fmt.Errorf("CreateTask fair share error: %w", err)
 	}
-	if arg2TaskID != nil {
-		arg2T = *arg2TaskID
+
+	// A replicated task is not handed out itself, its replicas are.
+	status := model.TaskStatusWaiting
+	if replication > 1 {
+		status = model.TaskStatusReplicated
 	}
 
-	res, err := db.GlobalDB.Exec(query,
+	arg1Val, arg1T := argColumns(arg1)
+	arg2Val, arg2T := argColumns(arg2)
+	res, err := tx.Exec(query,
 		expressionID,
 		op,
 		arg1Val,
 		arg1T,
 		arg2Val,
 		arg2T,
+		status,
+		pending,
+		userID,
+		priority,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("CreateTaskWithArgs insert error: %w", err)
+		return nil, false, fmt.Errorf("CreateTask insert error: %w", err)
 	}
 
 	lastID, err := res.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("cannot get lastInsertId: %w", err)
+		return nil, false, fmt.Errorf("cannot get lastInsertId: %w", err)
 	}
-
 	taskID := int(lastID)
+
+	for i, arg := range extra {
+		val, argTask := argColumns(arg)
+		_, err := tx.Exec(
+			`INSERT INTO task_args (task_id, position, value, arg_task_id) VALUES (?, ?, ?, ?)`,
+			taskID, i+2, val, argTask,
+		)
+		if err != nil {
+			return nil, false, fmt.Errorf("CreateTask insert arg error: %w", err)
+		}
+	}
+	if replication > 1 {
+		for i := 0; i < replication; i++ {
+			if err := addReplica(tx, taskID); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
 	newTask := &model.Task{
 		ID:           taskID,
 		ExpressionID: expressionID,
 		Op:           op,
-		Arg1Value:    arg1Value,
-		Arg1TaskID:   arg1TaskID,
-		Arg2Value:    arg2Value,
-		Arg2TaskID:   arg2TaskID,
-		Status:       model.TaskStatusWaiting,
+		Arg1Value:    arg1.Value,
+		Arg1TaskID:   arg1.TaskID,
+		Arg2Value:    arg2.Value,
+		Arg2TaskID:   arg2.TaskID,
+		ExtraArgs:    extra,
+		Status:       status,
+	}
+
+	return newTask, pending == 0, nil
+}
+
+func argColumns(arg model.TaskArg) (interface{}, interface{}) {
+	var val, taskID interface{}
+	if arg.Value != nil {
+		val = *arg.Value
+	}
+	if arg.TaskID != nil {
+		taskID = *arg.TaskID
 	}
+	return val, taskID
+}
 
-	return newTask, nil
+func loadExtraArgs(t *model.Task) error {
+	rows, err := db.GlobalDB.Query(
+		`SELECT value, arg_task_id FROM task_args WHERE task_id = ? ORDER BY position`,
+		t.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("loadExtraArgs query error: %w", err)
+	}
+	defer rows.Close()
+
+	t.ExtraArgs = nil
+	for rows.Next() {
+		var val sql.NullFloat64
+		var argTaskID sql.NullInt64
+		if err := rows.Scan(&val, &argTaskID); err != nil {
+			return fmt.Errorf("loadExtraArgs scan error: %w", err)
+		}
+		var arg model.TaskArg
+		if val.Valid {
+			f := val.Float64
+			arg.Value = &f
+		}
+		if argTaskID.Valid {
+			i := int(argTaskID.Int64)
+			arg.TaskID = &i
+		}
+		t.ExtraArgs = append(t.ExtraArgs, arg)
+	}
+	return rows.Err()
 }
 
 func Reset() error {
-	_, err := db.GlobalDB.Exec("DELETE FROM tasks;")
+	_, err := db.GlobalDB.Exec("DELETE FROM task_runs;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM webhook_deliveries;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM fair_share;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM expression_tags;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM task_args;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM tasks;")
 	if err != nil {
 		return err
 	}
@@ -304,5 +606,13 @@ func Reset() error {
 	if err != nil {
 		return err
 	}
+	_, err = db.GlobalDB.Exec("DELETE FROM idempotency_keys;")
+	if err != nil {
+		return err
+	}
+	_, err = db.GlobalDB.Exec("DELETE FROM batches;")
+	if err != nil {
+		return err
+	}
 	return nil
 }
@@ -1,11 +1,15 @@
 package repository_test
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
 )
 
@@ -61,10 +65,11 @@ func TestCreateTaskWithArgs(t *testing.T) {
 	}
 }
 
-func TestGetNextWaitingTask(t *testing.T) {
+func TestClaimNextTask_Dependencies(t *testing.T) {
 	if err := repository.Reset(); err != nil {
 		t.Fatalf("reset DB error: %v", err)
 	}
+	ttl := func(string) time.Duration { return time.Minute }
 
 	expr, err := repository.CreateExpression("dummy", testUserID)
 	if err != nil {
@@ -83,9 +88,9 @@ func TestGetNextWaitingTask(t *testing.T) {
 
 	t.Logf("Created tasks: t1=%d, t2=%d", t1.ID, t2.ID)
 
-	task, err := repository.GetNextWaitingTask()
+	task, err := repository.ClaimNextTask("agent-a", ttl)
 	if err != nil {
-		t.Fatalf("GetNextWaitingTask error: %v", err)
+		t.Fatalf("ClaimNextTask error: %v", err)
 	}
 	if task == nil {
 		t.Fatal("expected a waiting task, got nil")
@@ -101,9 +106,9 @@ func TestGetNextWaitingTask(t *testing.T) {
 		t.Fatalf("UpdateTask(t1) error: %v", err)
 	}
 
-	task2, err := repository.GetNextWaitingTask()
+	task2, err := repository.ClaimNextTask("agent-a", ttl)
 	if err != nil {
-		t.Fatalf("GetNextWaitingTask error: %v", err)
+		t.Fatalf("ClaimNextTask error: %v", err)
 	}
 	if task2 == nil {
 		t.Fatal("expected a second task, got nil")
@@ -197,6 +202,7 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 	if err := repository.Reset(); err != nil {
 		t.Fatalf("Reset error: %v", err)
 	}
+	ttl := func(string) time.Duration { return time.Minute }
 
 	expr, err := repository.CreateExpression("dummy", 123)
 	if err != nil {
@@ -219,9 +225,9 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 
 	t.Logf("Created tasks: A=%d, B=%d, C=%d", taskA.ID, taskB.ID, taskC.ID)
 
-	first, err := repository.GetNextWaitingTask()
+	first, err := repository.ClaimNextTask("agent-a", ttl)
 	if err != nil {
-		t.Fatalf("GetNextWaitingTask error: %v", err)
+		t.Fatalf("ClaimNextTask error: %v", err)
 	}
 	if first == nil {
 		t.Fatal("expected a waiting task, got nil")
@@ -234,9 +240,9 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 	if err := repository.UpdateTask(taskA); err != nil {
 		t.Fatalf("UpdateTask(A) error: %v", err)
 	}
-	second, err := repository.GetNextWaitingTask()
+	second, err := repository.ClaimNextTask("agent-a", ttl)
 	if err != nil {
-		t.Fatalf("GetNextWaitingTask error: %v", err)
+		t.Fatalf("ClaimNextTask error: %v", err)
 	}
 	if second == nil {
 		t.Fatal("expected a second task, got nil")
@@ -250,9 +256,9 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 		t.Fatalf("UpdateTask(B) error: %v", err)
 	}
 
-	third, err := repository.GetNextWaitingTask()
+	third, err := repository.ClaimNextTask("agent-a", ttl)
 	if err != nil {
-		t.Fatalf("GetNextWaitingTask error: %v", err)
+		t.Fatalf("ClaimNextTask error: %v", err)
 	}
 	if third == nil {
 		t.Fatal("expected a third task, got nil")
@@ -262,6 +268,819 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 	}
 }
 
+func TestCreateTask_ExtraArgDependency(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	ttl := func(string) time.Duration { return time.Minute }
+
+	expr, err := repository.CreateExpression("dummy", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+
+	val := 1.0
+	dep, err := repository.CreateTaskWithArgs(expr.ID, "+", &val, nil, &val, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	dep.Status = model.TaskStatusInProgress
+	if err := repository.UpdateTask(dep); err != nil {
+		t.Fatalf("UpdateTask error: %v", err)
+	}
+
+	maxTask, err := repository.CreateTask(expr.ID, "max", []model.TaskArg{
+		{Value: &val},
+		{Value: &val},
+		{TaskID: &dep.ID},
+	})
+	if err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+
+	next, err := repository.ClaimNextTask("agent-a", ttl)
+	if err != nil {
+		t.Fatalf("ClaimNextTask error: %v", err)
+	}
+	if next != nil {
+		t.Fatalf("max must wait for its third argument, got task %d", next.ID)
+	}
+
+	dep.Status = model.TaskStatusDone
+	if err := repository.UpdateTask(dep); err != nil {
+		t.Fatalf("UpdateTask error: %v", err)
+	}
+	next, err = repository.ClaimNextTask("agent-a", ttl)
+	if err != nil {
+		t.Fatalf("ClaimNextTask error: %v", err)
+	}
+	if next == nil || next.ID != maxTask.ID {
+		t.Fatalf("expected max task %d, got %v", maxTask.ID, next)
+	}
+	if len(next.ExtraArgs) != 1 || next.ExtraArgs[0].TaskID == nil || *next.ExtraArgs[0].TaskID != dep.ID {
+		t.Errorf("extra args not loaded: %+v", next.ExtraArgs)
+	}
+}
+
+func TestFailTask(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	ttl := func(string) time.Duration { return time.Minute }
+
+	expr, err := repository.CreateExpression("1/0 + 2*3", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+
+	one, zero, two, three := 1.0, 0.0, 2.0, 3.0
+	div, err := repository.CreateTaskWithArgs(expr.ID, "/", &one, nil, &zero, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs(div) error: %v", err)
+	}
+	mul, err := repository.CreateTaskWithArgs(expr.ID, "*", &two, nil, &three, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs(mul) error: %v", err)
+	}
+	add, err := repository.CreateTaskWithArgs(expr.ID, "+", nil, &div.ID, nil, &mul.ID)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs(add) error: %v", err)
+	}
+	expr.Status = model.StatusInProgress
+	expr.FinalTaskID = add.ID
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	div.Status = model.TaskStatusInProgress
+	if err := repository.UpdateTask(div); err != nil {
+		t.Fatalf("UpdateTask error: %v", err)
+	}
+	if err := repository.FailTask(div, "division by zero"); err != nil {
+		t.Fatalf("FailTask error: %v", err)
+	}
+
+	tasks, err := repository.GetTasksByExpressionID(expr.ID)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID error: %v", err)
+	}
+	want := map[int]string{
+		div.ID: model.TaskStatusError,
+		mul.ID: model.TaskStatusCancelled,
+		add.ID: model.TaskStatusCancelled,
+	}
+	for _, task := range tasks {
+		if task.Status != want[task.ID] {
+			t.Errorf("task %d status = %s, want %s", task.ID, task.Status, want[task.ID])
+		}
+	}
+	if tasks[0].Error != "division by zero" {
+		t.Errorf("task error = %q, want %q", tasks[0].Error, "division by zero")
+	}
+
+	got, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID error: %v", err)
+	}
+	if got.Status != model.StatusError {
+		t.Errorf("expression status = %s, want %s", got.Status, model.StatusError)
+	}
+	if !strings.Contains(got.Error, "division by zero") {
+		t.Errorf("expression error = %q, want it to mention the reason", got.Error)
+	}
+
+	next, err := repository.ClaimNextTask("agent-a", ttl)
+	if err != nil {
+		t.Fatalf("ClaimNextTask error: %v", err)
+	}
+	if next != nil {
+		t.Errorf("cancelled tasks must not be handed out, got task %d", next.ID)
+	}
+
+	// A task failing late does not overwrite how its expression ended.
+	expr, err = repository.CreateExpression("1/0", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	div, err = repository.CreateTaskWithArgs(expr.ID, "/", &one, nil, &zero, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs(div) error: %v", err)
+	}
+	if _, err := repository.CancelExpression(testUserID, expr.ID); err != nil {
+		t.Fatalf("CancelExpression error: %v", err)
+	}
+	if err := repository.FailTask(div, "division by zero"); err != nil {
+		t.Fatalf("FailTask error: %v", err)
+	}
+	got, err = repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil || got.Status != model.StatusCancelled || got.Error != "" {
+		t.Errorf("cancelled expression = %+v, %v; want it still %s", got, err, model.StatusCancelled)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	defer func(p repository.RetryPolicy) { repository.Retry = p }(repository.Retry)
+	repository.Retry = repository.RetryPolicy{MaxRetries: 3}
+	ttl := func(string) time.Duration { return time.Minute }
+
+	expr, err := repository.CreateExpression("1+1", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	val := 1.0
+	task, err := repository.CreateTaskWithArgs(expr.ID, "+", &val, nil, &val, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+
+	claimed, err := repository.ClaimNextTask("agent-a", ttl)
+	if err != nil || claimed == nil || claimed.ID != task.ID {
+		t.Fatalf("ClaimNextTask = %v, %v; want task %d", claimed, err, task.ID)
+	}
+	if claimed, err := repository.ClaimNextTask("agent-b", ttl); err != nil || claimed != nil {
+		t.Fatalf("second ClaimNextTask = %v, %v; want nil", claimed, err)
+	}
+
+	stored, err := repository.GetTaskByID(task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskByID error: %v", err)
+	}
+	if stored.Status != model.TaskStatusInProgress || stored.LeaseOwner != "agent-a" || stored.LeaseExpiresAt == nil {
+		t.Fatalf("unexpected lease state: status=%s owner=%q expires=%v",
+			stored.Status, stored.LeaseOwner, stored.LeaseExpiresAt)
+	}
+
+	if ok, _ := repository.RenewLease(task.ID, "agent-b", time.Minute); ok {
+		t.Error("RenewLease by another agent must fail")
+	}
+	if ok, _ := repository.RenewLease(task.ID, "agent-a", time.Minute); !ok {
+		t.Error("RenewLease by the owner must succeed")
+	}
+
+	n, err := repository.RequeueExpiredLeases(time.Now())
+	if err != nil {
+		t.Fatalf("RequeueExpiredLeases error: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("requeued %d tasks with a valid lease", n)
+	}
+
+	n, err = repository.RequeueExpiredLeases(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Fatalf("RequeueExpiredLeases error: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("requeued %d tasks, want 1", n)
+	}
+	stored, _ = repository.GetTaskByID(task.ID)
+	if stored.Status != model.TaskStatusWaiting || stored.LeaseOwner != "" || stored.LeaseExpiresAt != nil {
+		t.Errorf("task not requeued: status=%s owner=%q", stored.Status, stored.LeaseOwner)
+	}
+
+	claimed, err = repository.ClaimNextTask("agent-b", ttl)
+	if err != nil || claimed == nil || claimed.ID != task.ID {
+		t.Fatalf("ClaimNextTask after requeue = %v, %v; want task %d", claimed, err, task.ID)
+	}
+	if ok, _ := repository.RenewLease(task.ID, "agent-a", time.Minute); ok {
+		t.Error("the previous owner must not renew a reassigned lease")
+	}
+
+	two, three := 2.0, 3.0
+	if _, ok, err := repository.RecordRun(claimed, "agent-a", &two, "", 0); err != nil || ok {
+		t.Fatalf("RecordRun by the previous owner = %v, %v; want false, nil", ok, err)
+	}
+	if stored, _ := repository.GetTaskByID(task.ID); stored.Status != model.TaskStatusInProgress || stored.Result != nil {
+		t.Fatalf("a lost lease completed the task: status=%s result=%v", stored.Status, stored.Result)
+	}
+	if _, ok, err := repository.RecordRun(claimed, "agent-b", &two, "", 0); err != nil || !ok {
+		t.Fatalf("RecordRun by the owner = %v, %v; want true, nil", ok, err)
+	}
+	stored, _ = repository.GetTaskByID(task.ID)
+	if stored.Status != model.TaskStatusDone || stored.Result == nil || *stored.Result != 2 || stored.LeaseOwner != "" {
+		t.Errorf("completed task: status=%s result=%v owner=%q", stored.Status, stored.Result, stored.LeaseOwner)
+	}
+	if _, ok, _ := repository.RecordRun(claimed, "agent-b", &three, "", 0); ok {
+		t.Error("a done task must not be completed twice")
+	}
+	got, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil || got.Status != model.StatusDone || got.Result == nil || *got.Result != 2 {
+		t.Errorf("expression after its only task = %+v, %v; want DONE with 2", got, err)
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	ttl := func(string) time.Duration { return time.Minute }
+
+	// newTask creates an expression with a single task computed by
+	// replication agents.
+	newTask := func(replication int) (*model.Expression, *model.Task) {
+		expr, err := repository.CreateExpression("1+1", testUserID)
+		if err != nil {
+			t.Fatalf("CreateExpression error: %v", err)
+		}
+		if err := repository.SetExpressionReplication(expr.ID, replication); err != nil {
+			t.Fatalf("SetExpressionReplication error: %v", err)
+		}
+		one := 1.0
+		task, err := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil)
+		if err != nil {
+			t.Fatalf("CreateTaskWithArgs error: %v", err)
+		}
+		return expr, task
+	}
+	// claim has agent claim a replica of the task.
+	claim := func(agent string, task *model.Task) *model.Task {
+		t.Helper()
+		claimed, err := repository.ClaimNextTask(agent, ttl)
+		if err != nil {
+			t.Fatalf("ClaimNextTask error: %v", err)
+		}
+		if claimed == nil || claimed.ReplicaOf != task.ID {
+			t.Fatalf("%s did not get a replica of task %d: %+v", agent, task.ID, claimed)
+		}
+		return claimed
+	}
+	// answer has agent answer its replica with result, or with errText if
+	// result is nil.
+	answer := func(replica *model.Task, agent string, result *float64, errText string) *repository.Vote {
+		t.Helper()
+		vote, ok, err := repository.RecordRun(replica, agent, result, errText, 1e-9)
+		if err != nil || !ok {
+			t.Fatalf("RecordRun = %v, %v", ok, err)
+		}
+		return vote
+	}
+	two, three := 2.0, 3.0
+	almostTwo := 2.0 + 1e-12
+
+	// The replicas are computed at the same time, each by another agent.
+	expr, task := newTask(3)
+	if task.Status != model.TaskStatusReplicated {
+		t.Fatalf("replicated task status = %s", task.Status)
+	}
+	ra, rb, rc := claim("agent-a", task), claim("agent-b", task), claim("agent-c", task)
+	if ra.ID == rb.ID || rb.ID == rc.ID || ra.ID == rc.ID {
+		t.Fatalf("agents share replicas %d, %d, %d", ra.ID, rb.ID, rc.ID)
+	}
+	if claimed, _ := repository.ClaimNextTask("agent-d", ttl); claimed != nil {
+		t.Fatalf("got task %d beyond the replication", claimed.ID)
+	}
+	if vote := answer(ra, "agent-a", &two, ""); vote.Decided {
+		t.Fatalf("vote decided after one of three runs: %+v", vote)
+	}
+	if vote := answer(rb, "agent-b", &three, ""); vote.Decided {
+		t.Fatalf("vote decided after two of three runs: %+v", vote)
+	}
+	if stored, _ := repository.GetTaskByID(task.ID); stored.Status != model.TaskStatusReplicated {
+		t.Errorf("task decided before the vote: status=%s", stored.Status)
+	}
+	vote := answer(rc, "agent-c", &almostTwo, "")
+	if !vote.Decided || vote.Result == nil || *vote.Result != 2 {
+		t.Fatalf("vote = %+v, want result 2", vote)
+	}
+	if strings.Join(vote.Winners, ",") != "agent-a,agent-c" || strings.Join(vote.Losers, ",") != "agent-b" {
+		t.Errorf("winners=%v losers=%v", vote.Winners, vote.Losers)
+	}
+	runs, err := repository.GetTaskRuns(task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskRuns error: %v", err)
+	}
+	if len(runs) != 3 || runs[0].Vote != model.VoteAgreed || runs[1].Vote != model.VoteOutvoted {
+		t.Errorf("unexpected runs %+v", runs)
+	}
+	if stored, _ := repository.GetTaskByID(task.ID); stored.Status != model.TaskStatusDone || *stored.Result != 2 {
+		t.Errorf("decided task: status=%s result=%v", stored.Status, stored.Result)
+	}
+	got, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil || got.Status != model.StatusDone || got.Result == nil || *got.Result != 2 {
+		t.Errorf("expression = %+v, %v; want DONE with 2", got, err)
+	}
+	if progress, _ := repository.GetExpressionProgress(expr.ID); progress.Total != 1 || progress.Done != 1 {
+		t.Errorf("progress = %+v, replicas must not count", progress)
+	}
+
+	// A tie between two replicas is broken by a third agent.
+	_, task = newTask(2)
+	ra, rb = claim("agent-a", task), claim("agent-b", task)
+	answer(ra, "agent-a", &two, "")
+	if vote := answer(rb, "agent-b", &three, ""); vote.Decided {
+		t.Fatalf("tied vote decided: %+v", vote)
+	}
+	if claimed, _ := repository.ClaimNextTask("agent-a", ttl); claimed != nil {
+		t.Fatalf("agent-a got task %d again", claimed.ID)
+	}
+	vote = answer(claim("agent-c", task), "agent-c", &three, "")
+	if !vote.Decided || vote.Result == nil || *vote.Result != 3 || strings.Join(vote.Losers, ",") != "agent-a" {
+		t.Fatalf("tiebreak vote = %+v, want 3 with agent-a outvoted", vote)
+	}
+
+	// An agreed error fails the task, no agreement at all too.
+	expr, task = newTask(2)
+	ra, rb = claim("agent-a", task), claim("agent-b", task)
+	answer(ra, "agent-a", nil, "division by zero")
+	vote = answer(rb, "agent-b", nil, "division by zero")
+	if !vote.Decided || vote.Result != nil || vote.Error != "division by zero" {
+		t.Fatalf("error vote = %+v", vote)
+	}
+	if got, _ := repository.GetExpressionByID(testUserID, expr.ID); got.Status != model.StatusError {
+		t.Errorf("expression status = %s, want %s", got.Status, model.StatusError)
+	}
+
+	_, task = newTask(2)
+	ra, rb = claim("agent-a", task), claim("agent-b", task)
+	answer(ra, "agent-a", &two, "")
+	answer(rb, "agent-b", &three, "")
+	vote = answer(claim("agent-c", task), "agent-c", nil, "overflow")
+	if !vote.Decided || vote.Result != nil || !strings.Contains(vote.Error, "disagree") {
+		t.Fatalf("vote without majority = %+v", vote)
+	}
+	if len(vote.Winners) != 0 || len(vote.Losers) != 0 {
+		t.Errorf("nobody wins a vote without majority: %+v", vote)
+	}
+
+	// Agents without an ID cannot vote, they get no replicas.
+	_, task = newTask(2)
+	if claimed, _ := repository.ClaimNextTask("", ttl); claimed != nil {
+		t.Fatalf("an anonymous agent got replica %d", claimed.ID)
+	}
+	answer(claim("agent-a", task), "agent-a", &two, "")
+	answer(claim("agent-b", task), "agent-b", &two, "")
+
+	// A replica that ran out of retries does not count as pending: the two
+	// answers that disagree are settled by another agent.
+	func() {
+		defer func(p repository.RetryPolicy) { repository.Retry = p }(repository.Retry)
+		repository.Retry = repository.RetryPolicy{}
+		expr, task := newTask(3)
+		ra, rb, rc := claim("agent-a", task), claim("agent-b", task), claim("agent-c", task)
+		if ok, err := repository.RetryTask(rc.ID, "agent-c", "lost"); err != nil || !ok {
+			t.Fatalf("RetryTask = %v, %v", ok, err)
+		}
+		if stored, _ := repository.GetTaskByID(rc.ID); stored.Status != model.TaskStatusDead {
+			t.Fatalf("replica status = %s, want %s", stored.Status, model.TaskStatusDead)
+		}
+		if got, _ := repository.GetExpressionByID(testUserID, expr.ID); got.Status == model.StatusError {
+			t.Fatalf("a dead replica failed the expression: %s", got.Error)
+		}
+		answer(ra, "agent-a", &two, "")
+		if vote := answer(rb, "agent-b", &three, ""); vote.Decided {
+			t.Fatalf("vote decided with two disagreeing runs: %+v", vote)
+		}
+		vote := answer(claim("agent-d", task), "agent-d", &two, "")
+		if !vote.Decided || vote.Result == nil || *vote.Result != 2 {
+			t.Fatalf("tiebreak vote = %+v, want result 2", vote)
+		}
+	}()
+
+	// Without replication the answer is final and no run is stored.
+	_, task = newTask(1)
+	claimed, err := repository.ClaimNextTask("agent-a", ttl)
+	if err != nil || claimed == nil || claimed.ID != task.ID {
+		t.Fatalf("ClaimNextTask = %+v, %v; want task %d", claimed, err, task.ID)
+	}
+	if vote := answer(claimed, "agent-a", &two, ""); !vote.Decided || *vote.Result != 2 {
+		t.Fatalf("single run vote = %+v", vote)
+	}
+	if runs, _ := repository.GetTaskRuns(task.ID); len(runs) != 0 {
+		t.Errorf("stored %d runs without replication", len(runs))
+	}
+}
+
+func TestExpireDeadlines(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	ttl := func(string) time.Duration { return time.Minute }
+	one := 1.0
+
+	expr, err := repository.CreateExpression("(1+1)*(1+1)", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	deadline := time.Now().Add(time.Hour)
+	if err := repository.SetExpressionDeadline(expr.ID, deadline); err != nil {
+		t.Fatalf("SetExpressionDeadline error: %v", err)
+	}
+	left, _ := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil)
+	right, _ := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil)
+	if _, err := repository.CreateTaskWithArgs(expr.ID, "*", nil, &left.ID, nil, &right.ID); err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+
+	claimed, err := repository.ClaimNextTask("agent-a", ttl)
+	if err != nil || claimed == nil {
+		t.Fatalf("ClaimNextTask = %v, %v", claimed, err)
+	}
+	if claimed.Deadline == nil || claimed.Deadline.UnixMilli() != deadline.UnixMilli() {
+		t.Errorf("claimed task deadline = %v, want %v", claimed.Deadline, deadline)
+	}
+	two := 2.0
+	claimed.Status = model.TaskStatusDone
+	claimed.Result = &two
+	if err := repository.UpdateTask(claimed); err != nil {
+		t.Fatalf("UpdateTask error: %v", err)
+	}
+
+	if n, err := repository.ExpireDeadlines(time.Now()); err != nil || n != 0 {
+		t.Fatalf("ExpireDeadlines before the deadline = %d, %v", n, err)
+	}
+
+	// Past the deadline nothing is handed out, even before the reaper runs.
+	if err := repository.SetExpressionDeadline(expr.ID, time.Now().Add(-time.Millisecond)); err != nil {
+		t.Fatalf("SetExpressionDeadline error: %v", err)
+	}
+	if claimed, _ := repository.ClaimNextTask("agent-a", ttl); claimed != nil {
+		t.Fatalf("task %d of an expired expression was handed out", claimed.ID)
+	}
+
+	n, err := repository.ExpireDeadlines(time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("ExpireDeadlines = %d, %v; want 1", n, err)
+	}
+	stored, _ := repository.GetExpressionByID(testUserID, expr.ID)
+	if stored.Status != model.StatusTimeout || stored.Error != "deadline exceeded: 1 of 3 tasks done" {
+		t.Errorf("expression = %s %q", stored.Status, stored.Error)
+	}
+	tasks, _ := repository.GetTasksByExpressionID(expr.ID)
+	for _, task := range tasks {
+		if task.Status != model.TaskStatusDone && task.Status != model.TaskStatusCancelled {
+			t.Errorf("task %d left %s", task.ID, task.Status)
+		}
+	}
+	progress, err := repository.GetExpressionProgress(expr.ID)
+	if err != nil || progress.Done != 1 || progress.Total != 3 {
+		t.Errorf("progress = %+v, %v", progress, err)
+	}
+
+	if n, _ := repository.ExpireDeadlines(time.Now()); n != 0 {
+		t.Errorf("expression timed out twice")
+	}
+}
+
+func TestClaimNextTask_FairShare(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	ttl := func(string) time.Duration { return time.Minute }
+	one := 1.0
+	const batchUser, smallUser, vipUser int64 = 1, 2, 3
+
+	submit := func(userID int64, priority, tasks int) *model.Expression {
+		t.Helper()
+		expr, err := repository.CreateExpression("batch", userID)
+		if err != nil {
+			t.Fatalf("CreateExpression error: %v", err)
+		}
+		if err := repository.SetExpressionPriority(expr.ID, priority); err != nil {
+			t.Fatalf("SetExpressionPriority error: %v", err)
+		}
+		for i := 0; i < tasks; i++ {
+			if _, err := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil); err != nil {
+				t.Fatalf("CreateTaskWithArgs error: %v", err)
+			}
+		}
+		return expr
+	}
+	claim := func() *model.Task {
+		t.Helper()
+		task, err := repository.ClaimNextTask("agent-a", ttl)
+		if err != nil || task == nil {
+			t.Fatalf("ClaimNextTask = %v, %v", task, err)
+		}
+		return task
+	}
+
+	huge := submit(batchUser, 0, 2000)
+	for i := 0; i < 3; i++ {
+		if task := claim(); task.ExpressionID != huge.ID {
+			t.Fatalf("claim %d: got a task of %s", i, task.ExpressionID)
+		}
+	}
+
+	// A small job submitted after the batch is served in turn with it
+	// instead of waiting for 2000 tasks.
+	small := submit(smallUser, 0, 3)
+	var order []string
+	for i := 0; i < 6; i++ {
+		if task := claim(); task.ExpressionID == small.ID {
+			order = append(order, "small")
+		} else {
+			order = append(order, "huge")
+		}
+	}
+	if got := strings.Join(order, ","); got != "small,huge,small,huge,small,huge" {
+		t.Errorf("claim order = %s", got)
+	}
+
+	// A higher priority goes before any turn.
+	vip := submit(vipUser, 3, 2)
+	boost := submit(batchUser, 1, 1)
+	for i, want := range []string{vip.ID, vip.ID, boost.ID, huge.ID} {
+		if task := claim(); task.ExpressionID != want {
+			t.Errorf("claim %d after priorities: expression %s, want %s", i, task.ExpressionID, want)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	defer func(p repository.RetryPolicy) { repository.Retry = p }(repository.Retry)
+	repository.Retry = repository.RetryPolicy{MaxRetries: 2, Backoff: time.Hour, MaxBackoff: 90 * time.Minute}
+	ttl := func(string) time.Duration { return time.Minute }
+
+	expr, err := repository.CreateExpression("1+1", testUserID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	val := 1.0
+	task, err := repository.CreateTaskWithArgs(expr.ID, "+", &val, nil, &val, nil)
+	if err != nil {
+		t.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+
+	fail := func(attempt int, wantBackoff time.Duration) *model.Task {
+		t.Helper()
+		// The backoff of the previous attempt is over.
+		if _, err := db.GlobalDB.Exec(`UPDATE tasks SET retry_at = NULL WHERE id = ?`, task.ID); err != nil {
+			t.Fatalf("attempt %d: skip backoff error: %v", attempt, err)
+		}
+		if next, err := repository.ClaimNextTask("agent-a", ttl); err != nil || next == nil || next.ID != task.ID {
+			t.Fatalf("attempt %d: ClaimNextTask = %v, %v", attempt, next, err)
+		}
+		if ok, _ := repository.RetryTask(task.ID, "agent-b", "boom"); ok {
+			t.Fatalf("attempt %d: RetryTask without the lease must fail", attempt)
+		}
+		before := time.Now()
+		if ok, err := repository.RetryTask(task.ID, "agent-a", "boom"); err != nil || !ok {
+			t.Fatalf("attempt %d: RetryTask = %v, %v", attempt, ok, err)
+		}
+		stored, err := repository.GetTaskByID(task.ID)
+		if err != nil {
+			t.Fatalf("GetTaskByID error: %v", err)
+		}
+		if stored.Attempts != attempt || stored.LastError != "boom" || stored.LeaseOwner != "" {
+			t.Errorf("attempt %d: attempts=%d last_error=%q owner=%q",
+				attempt, stored.Attempts, stored.LastError, stored.LeaseOwner)
+		}
+		if wantBackoff > 0 {
+			if stored.RetryAt == nil {
+				t.Fatalf("attempt %d: retry_at not set", attempt)
+			}
+			if d := stored.RetryAt.Sub(before); d < wantBackoff-time.Second || d > wantBackoff+time.Second {
+				t.Errorf("attempt %d: backoff %v, want %v", attempt, d, wantBackoff)
+			}
+		}
+		*task = *stored
+		return stored
+	}
+
+	if stored := fail(1, time.Hour); stored.Status != model.TaskStatusWaiting {
+		t.Fatalf("status after first failure = %s", stored.Status)
+	}
+	if next, err := repository.ClaimNextTask("agent-a", ttl); err != nil || next != nil {
+		t.Fatalf("ClaimNextTask during backoff = %v, %v; want nil", next, err)
+	}
+	// The second backoff doubles the first one but is capped.
+	fail(2, 90*time.Minute)
+
+	events, unsubscribe := notify.Events.Subscribe(testUserID)
+	defer unsubscribe()
+	if stored := fail(3, 0); stored.Status != model.TaskStatusDead || stored.RetryAt != nil {
+		t.Fatalf("after the last retry: status=%s retry_at=%v", stored.Status, stored.RetryAt)
+	}
+	// The expression cannot finish without the task.
+	wantErr := fmt.Sprintf("task %d (+) failed: boom", task.ID)
+	failed, err := repository.GetExpressionByID(testUserID, expr.ID)
+	if err != nil || failed.Status != model.StatusError || failed.Error != wantErr {
+		t.Fatalf("expression of a DEAD task = %+v, %v; want %s %q", failed, err, model.StatusError, wantErr)
+	}
+	published := false
+	for len(events) > 0 {
+		if e := <-events; e.Type == notify.EventExpression {
+			published = e.ExpressionID == expr.ID && e.Expression.Status == model.StatusError
+		}
+	}
+	if !published {
+		t.Error("the failed expression was not published")
+	}
+	dead, err := repository.GetDeadTasks()
+	if err != nil || len(dead) != 1 || dead[0].ID != task.ID {
+		t.Fatalf("GetDeadTasks = %v, %v", dead, err)
+	}
+	progress, err := repository.GetExpressionProgress(expr.ID)
+	if err != nil {
+		t.Fatalf("GetExpressionProgress error: %v", err)
+	}
+	if progress.Dead != 1 {
+		t.Errorf("progress.dead = %d, want 1", progress.Dead)
+	}
+
+	requeued, ok, err := repository.RequeueDeadTask(task.ID)
+	if err != nil || !ok {
+		t.Fatalf("RequeueDeadTask = %v, %v", ok, err)
+	}
+	if requeued.Status != model.TaskStatusWaiting || requeued.Attempts != 0 || requeued.RetryAt != nil {
+		t.Errorf("requeued task: status=%s attempts=%d", requeued.Status, requeued.Attempts)
+	}
+	if resumed, _ := repository.GetExpressionByID(testUserID, expr.ID); resumed.Status != model.StatusInProgress || resumed.Error != "" {
+		t.Errorf("expression after requeue = %s %q, want %s", resumed.Status, resumed.Error, model.StatusInProgress)
+	}
+	if _, ok, _ := repository.RequeueDeadTask(task.ID); ok {
+		t.Error("requeueing a task that is not dead must fail")
+	}
+	if next, err := repository.ClaimNextTask("agent-a", ttl); err != nil || next == nil || next.ID != task.ID {
+		t.Errorf("ClaimNextTask after requeue = %v, %v", next, err)
+	}
+}
+
+// BenchmarkClaimNextTask measures a claim with 100k queued tasks, almost
+// all of them blocked behind an unfinished dependency and queued before
+// the ready ones.
+func BenchmarkClaimNextTask(b *testing.B) {
+	const queued = 100000
+
+	if err := repository.Reset(); err != nil {
+		b.Fatalf("Reset error: %v", err)
+	}
+	expr, err := repository.CreateExpression("bench", testUserID)
+	if err != nil {
+		b.Fatalf("CreateExpression error: %v", err)
+	}
+	val := 1.0
+	blocker, err := repository.CreateTaskWithArgs(expr.ID, "+", &val, nil, &val, nil)
+	if err != nil {
+		b.Fatalf("CreateTaskWithArgs error: %v", err)
+	}
+	hour := func(string) time.Duration { return time.Hour }
+	if claimed, err := repository.ClaimNextTask("bench", hour); err != nil || claimed == nil || claimed.ID != blocker.ID {
+		b.Fatalf("ClaimNextTask = %v, %v", claimed, err)
+	}
+
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		b.Fatalf("Begin error: %v", err)
+	}
+	stmt, err := tx.Prepare(`
+        INSERT INTO tasks (expression_id, op, arg1_value, arg1_task_id, arg2_value, status, pending_deps, user_id)
+        VALUES (?, '+', ?, ?, ?, 'WAITING', ?, ?)
+    `)
+	if err != nil {
+		b.Fatalf("Prepare error: %v", err)
+	}
+	for i := 0; i < queued; i++ {
+		if i < queued-100 {
+			_, err = stmt.Exec(expr.ID, nil, blocker.ID, val, 1, testUserID)
+		} else {
+			_, err = stmt.Exec(expr.ID, val, nil, val, 0, testUserID)
+		}
+		if err != nil {
+			b.Fatalf("insert error: %v", err)
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatalf("Commit error: %v", err)
+	}
+
+	ttl := func(string) time.Duration { return time.Minute }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task, err := repository.ClaimNextTask("bench", ttl)
+		if err != nil {
+			b.Fatalf("ClaimNextTask error: %v", err)
+		}
+		if task == nil {
+			b.Fatal("no ready task")
+		}
+
+		b.StopTimer()
+		if _, err := db.GlobalDB.Exec(`UPDATE tasks SET status = 'WAITING' WHERE id = ?`, task.ID); err != nil {
+			b.Fatalf("reset task error: %v", err)
+		}
+		b.StartTimer()
+	}
+}
+
+// BenchmarkClaimNextTask_ManyUsers claims among many users, most of whom
+// have no ready task.
+func BenchmarkClaimNextTask_ManyUsers(b *testing.B) {
+	const (
+		users      = 10000
+		readyUsers = 100
+		perUser    = 10
+	)
+
+	if err := repository.Reset(); err != nil {
+		b.Fatalf("Reset error: %v", err)
+	}
+	expr, err := repository.CreateExpression("bench", testUserID)
+	if err != nil {
+		b.Fatalf("CreateExpression error: %v", err)
+	}
+
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		b.Fatalf("Begin error: %v", err)
+	}
+	user, err := tx.Prepare(`INSERT OR IGNORE INTO fair_share (user_id, last_served) VALUES (?, ?)`)
+	if err != nil {
+		b.Fatalf("Prepare error: %v", err)
+	}
+	task, err := tx.Prepare(`
+        INSERT INTO tasks (expression_id, op, arg1_value, arg2_value, status, pending_deps, user_id)
+        VALUES (?, '+', 1, 1, ?, 0, ?)
+    `)
+	if err != nil {
+		b.Fatalf("Prepare error: %v", err)
+	}
+	for u := 1; u <= users; u++ {
+		if _, err := user.Exec(u, u); err != nil {
+			b.Fatalf("insert user error: %v", err)
+		}
+		// Every user has finished tasks, only some have ready ones.
+		status := model.TaskStatusDone
+		if u%(users/readyUsers) == 0 {
+			status = model.TaskStatusWaiting
+		}
+		for i := 0; i < perUser; i++ {
+			if _, err := task.Exec(expr.ID, status, u); err != nil {
+				b.Fatalf("insert task error: %v", err)
+			}
+		}
+	}
+	user.Close()
+	task.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatalf("Commit error: %v", err)
+	}
+
+	ttl := func(string) time.Duration { return time.Minute }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task, err := repository.ClaimNextTask("bench", ttl)
+		if err != nil {
+			b.Fatalf("ClaimNextTask error: %v", err)
+		}
+		if task == nil {
+			b.Fatal("no ready task")
+		}
+
+		b.StopTimer()
+		if _, err := db.GlobalDB.Exec(`UPDATE tasks SET status = 'WAITING' WHERE id = ?`, task.ID); err != nil {
+			b.Fatalf("reset task error: %v", err)
+		}
+		b.StartTimer()
+	}
+}
+
 // func TestTasks_NoDependencies(t *testing.T) {
 // 	if err := repository.Reset(); err != nil {
 // 		t.Fatalf("Reset error: %v", err)
@@ -358,3 +1177,112 @@ func TestTasks_MultipleDependencies(t *testing.T) {
 // 	}
 
 // }
+
+func TestBatch_Rollback(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	b, err := repository.BeginBatch(testUserID)
+	if err != nil {
+		t.Fatalf("BeginBatch error: %v", err)
+	}
+	expr := &model.Expression{Raw: "1+2", Priority: 3, Label: "first"}
+	if err := b.CreateExpression(expr, []string{"gpu"}); err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	one, two := 1.0, 2.0
+	task, err := b.CreateTask(expr.ID, "+", []model.TaskArg{{Value: &one}, {Value: &two}})
+	if err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+	if err := b.StartExpression(expr, task.ID); err != nil {
+		t.Fatalf("StartExpression error: %v", err)
+	}
+	if err := b.Rollback(); err != nil {
+		t.Fatalf("Rollback error: %v", err)
+	}
+
+	if got, err := repository.GetExpressionByID(testUserID, expr.ID); err != nil || got != nil {
+		t.Errorf("rolled back expression = %+v, %v; want none", got, err)
+	}
+	if got, err := repository.GetTaskByID(task.ID); err != nil || got != nil {
+		t.Errorf("rolled back task = %+v, %v; want none", got, err)
+	}
+	if got, err := repository.GetBatch(testUserID, b.ID); err != nil || got != nil {
+		t.Errorf("rolled back batch = %+v, %v; want none", got, err)
+	}
+}
+
+func TestIdempotencyKeys_Expire(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	now := time.Now()
+
+	if prev, err := repository.ReserveIdempotencyKey(testUserID, "k", "h1", now, time.Minute); err != nil || prev != nil {
+		t.Fatalf("ReserveIdempotencyKey = %+v, %v; want reserved", prev, err)
+	}
+	if err := repository.CompleteIdempotencyKey(testUserID, "k", "expr-1", 201); err != nil {
+		t.Fatalf("CompleteIdempotencyKey error: %v", err)
+	}
+	// Completed keys survive a release.
+	if err := repository.ReleaseIdempotencyKey(testUserID, "k"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey error: %v", err)
+	}
+
+	prev, err := repository.ReserveIdempotencyKey(testUserID, "k", "h2", now.Add(30*time.Second), time.Minute)
+	if err != nil || prev == nil {
+		t.Fatalf("ReserveIdempotencyKey = %+v, %v; want the first request", prev, err)
+	}
+	if prev.RequestHash != "h1" || prev.ExpressionID != "expr-1" || prev.StatusCode != 201 {
+		t.Errorf("first request = %+v", prev)
+	}
+
+	if prev, err := repository.ReserveIdempotencyKey(testUserID, "k", "h2", now.Add(2*time.Minute), time.Minute); err != nil || prev != nil {
+		t.Errorf("expired key: ReserveIdempotencyKey = %+v, %v; want reserved again", prev, err)
+	}
+	if n, err := repository.PurgeIdempotencyKeys(now.Add(5 * time.Minute)); err != nil || n != 1 {
+		t.Errorf("PurgeIdempotencyKeys = %d, %v; want 1", n, err)
+	}
+}
+
+func TestReadyRequirements(t *testing.T) {
+	if err := repository.Reset(); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+
+	one := 1.0
+	add := func(tags ...string) string {
+		t.Helper()
+		expr, err := repository.CreateExpression("1+1", testUserID)
+		if err != nil {
+			t.Fatalf("CreateExpression error: %v", err)
+		}
+		if err := repository.SetExpressionTags(expr.ID, tags); err != nil {
+			t.Fatalf("SetExpressionTags error: %v", err)
+		}
+		if _, err := repository.CreateTaskWithArgs(expr.ID, "+", &one, nil, &one, nil); err != nil {
+			t.Fatalf("CreateTaskWithArgs error: %v", err)
+		}
+		return expr.ID
+	}
+	plain1, plain2 := add(), add()
+	tagged := add("gpu", "fp64")
+
+	reqs, err := repository.ReadyRequirements()
+	if err != nil {
+		t.Fatalf("ReadyRequirements error: %v", err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("ReadyRequirements = %+v, want 2 requirements", reqs)
+	}
+	if r := reqs[0]; r.Operation != "+" || len(r.Tags) != 0 || len(r.ExpressionIDs) != 2 ||
+		!strings.Contains(strings.Join(r.ExpressionIDs, " "), plain1) ||
+		!strings.Contains(strings.Join(r.ExpressionIDs, " "), plain2) {
+		t.Errorf("untagged requirement = %+v", r)
+	}
+	if r := reqs[1]; strings.Join(r.Tags, "|") != "fp64|gpu" || len(r.ExpressionIDs) != 1 || r.ExpressionIDs[0] != tagged {
+		t.Errorf("tagged requirement = %+v", r)
+	}
+}
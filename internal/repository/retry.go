@@ -0,0 +1,278 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+)
+
+// RetryPolicy decides what happens to a task whose attempt failed for a
+// reason unrelated to the task itself: its lease expired, its agent was
+// lost, or the agent reported the error as transient.
+type RetryPolicy struct {
+	// MaxRetries is how many times a task is retried before it is DEAD.
+	MaxRetries int
+	// Backoff delays the first retry, each next one waits twice as long up
+	// to MaxBackoff. A zero Backoff retries right away.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Retry is the policy applied to failed attempts; the orchestrator sets it
+// from its configuration.
+var Retry = RetryPolicy{MaxRetries: 3, Backoff: time.Second, MaxBackoff: time.Minute}
+
+// failAttempt is the SET clause recording a failed attempt, reason being an
+// SQL expression. It takes now (?1) and the policy (?2 to ?4, see args), so
+// statements using it number their own parameters from ?5.
+func failAttempt(reason string) string {
+	return `attempts = attempts + 1, last_error = ` + reason + `,
+        status = CASE WHEN attempts >= ?2 THEN 'DEAD' ELSE 'WAITING' END,
+        retry_at = CASE WHEN attempts >= ?2 OR ?3 = 0 THEN NULL
+                        ELSE ?1 + MIN(?3 << MIN(attempts, 30), ?4) END,
+        lease_owner = NULL, lease_expires_at = NULL`
+}
+
+func (p RetryPolicy) args(now time.Time, extra ...interface{}) []interface{} {
+	args := []interface{}{now.UnixMilli(), p.MaxRetries, p.Backoff.Milliseconds(), p.MaxBackoff.Milliseconds()}
+	return append(args, extra...)
+}
+
+// failAttempts records a failed attempt of every task matched by where,
+// see failAttempt, and fails the expressions of the tasks that ran out of
+// retries with their last error. It returns how many tasks were matched.
+func failAttempts(reason, where string, now time.Time, extra ...interface{}) (int64, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`UPDATE tasks SET `+failAttempt(reason)+` WHERE `+where+` RETURNING `+taskColumns,
+		Retry.args(now, extra...)...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update error: %w", err)
+	}
+	var n int64
+	var dead []*model.Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan error: %w", err)
+		}
+		n++
+		if t.Status == model.TaskStatusDead {
+			dead = append(dead, t)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Tasks of one expression may run out of retries together, the first
+	// one fails it. A dead replica is replaced rather than failing the vote.
+	failed := make(map[string]bool)
+	replaced := false
+	var culprits []*model.Task
+	var exprs []*model.Expression
+	for _, t := range dead {
+		if failed[t.ExpressionID] {
+			continue
+		}
+		var e *model.Expression
+		if t.ReplicaOf != 0 {
+			var added bool
+			e, added, err = replaceDeadReplica(tx, t)
+			replaced = replaced || added
+		} else {
+			e, err = failExpression(tx, t, t.LastError)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if e != nil {
+			failed[t.ExpressionID] = true
+			culprits = append(culprits, t)
+			exprs = append(exprs, e)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit error: %w", err)
+	}
+
+	if n > int64(len(dead)) || replaced {
+		notify.TasksReady.Broadcast()
+	}
+	var errs []error
+	for i, e := range exprs {
+		publishTask(e.UserID, culprits[i])
+		errs = append(errs, expressionChanged(e))
+	}
+	return n, errors.Join(errs...)
+}
+
+// RetryTask records a transient failure reported by the agent holding the
+// lease on the task and schedules a retry, or marks the task DEAD once it
+// ran out of retries. It returns false if owner does not hold the lease.
+func RetryTask(taskID int, owner, reason string) (bool, error) {
+	n, err := failAttempts(`?7`, `id = ?5 AND status = 'IN_PROGRESS' AND lease_owner = ?6`,
+		time.Now(), taskID, owner, reason)
+	if err != nil {
+		return n > 0, fmt.Errorf("RetryTask %w", err)
+	}
+	return n > 0, nil
+}
+
+// RetryOrExpireTask works like RetryTask, unless the expression of the task
+// is due before a retry taking need could finish: then the expression times
+// out right away with its progress, as ExpireDeadlines would do later.
+func RetryOrExpireTask(taskID int, owner, reason string, need time.Duration) (bool, error) {
+	expired, err := expireTask(taskID, owner, time.Now(), need)
+	if err != nil || expired {
+		return expired, err
+	}
+	return RetryTask(taskID, owner, reason)
+}
+
+func expireTask(taskID int, owner string, now time.Time, need time.Duration) (bool, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("expireTask begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exprID string
+	err = tx.QueryRow(
+		`SELECT t.expression_id FROM tasks t JOIN expressions e ON e.id = t.expression_id
+         WHERE t.id = ? AND t.status = ? AND t.lease_owner = ?
+           AND e.deadline IS NOT NULL AND e.deadline < ?`,
+		taskID, model.TaskStatusInProgress, owner, now.Add(need).UnixMilli(),
+	).Scan(&exprID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("expireTask select error: %w", err)
+	}
+
+	expr, err := timeOutExpression(tx, exprID, now)
+	if err != nil {
+		return false, err
+	}
+	if expr == nil {
+		return false, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("expireTask commit error: %w", err)
+	}
+	return true, expressionChanged(expr)
+}
+
+// GetDeadTasks lists the DEAD tasks, oldest first.
+func GetDeadTasks() ([]*model.Task, error) {
+	rows, err := db.GlobalDB.Query(
+		`SELECT `+taskColumns+` FROM tasks WHERE status = ? ORDER BY id`,
+		model.TaskStatusDead,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetDeadTasks query error: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*model.Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetDeadTasks scan error: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// RequeueDeadTask gives a DEAD task a fresh set of retries and resumes the
+// expression it failed. It returns nil if there is no such task and false
+// if the task is not DEAD, the task is unchanged then.
+func RequeueDeadTask(taskID int) (*model.Task, bool, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("RequeueDeadTask begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := scanTask(tx.QueryRow(
+		`UPDATE tasks SET status = ?, attempts = 0, retry_at = NULL
+         WHERE id = ? AND status = ?
+         RETURNING `+taskColumns,
+		model.TaskStatusWaiting, taskID, model.TaskStatusDead,
+	))
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		t, err := GetTaskByID(taskID)
+		return t, false, err
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("RequeueDeadTask error: %w", err)
+	}
+	expr, err := reopenExpression(tx, t.ExpressionID)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("RequeueDeadTask commit error: %w", err)
+	}
+
+	notify.TasksReady.Broadcast()
+	if expr != nil {
+		return t, true, expressionChanged(expr)
+	}
+	return t, true, nil
+}
+
+// reopenExpression puts an expression failed by DEAD tasks back in
+// progress within tx: the tasks cancelled with it wait again and its
+// undelivered webhooks are dropped. It returns nil if the expression was not
+// failed that way, e.g. an agent reported an error or the user cancelled it.
+func reopenExpression(tx *sql.Tx, exprID string) (*model.Expression, error) {
+	expr, err := scanExpression(tx.QueryRow(
+		`UPDATE expressions SET status = ?2, error = NULL, finished_at = NULL
+         WHERE id = ?1 AND status = ?3
+           AND NOT EXISTS (SELECT 1 FROM tasks WHERE expression_id = ?1 AND status = ?4)
+         RETURNING `+expressionColumns,
+		exprID, model.StatusInProgress, model.StatusError, model.TaskStatusError,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reopenExpression update error: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET
+             status = CASE WHEN EXISTS (SELECT 1 FROM tasks r WHERE r.replica_of = tasks.id) THEN ? ELSE ? END,
+             lease_owner = NULL, lease_expires_at = NULL
+         WHERE expression_id = ? AND status = ?`,
+		model.TaskStatusReplicated, model.TaskStatusWaiting, exprID, model.TaskStatusCancelled,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("reopenExpression tasks error: %w", err)
+	}
+	_, err = tx.Exec(
+		`DELETE FROM webhook_deliveries WHERE expression_id = ? AND status = ?`,
+		exprID, model.DeliveryPending,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("reopenExpression webhooks error: %w", err)
+	}
+	return expr, nil
+}
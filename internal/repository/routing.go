@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+)
+
+// capabilityCondition restricts claimable tasks to those an agent with caps
+// can compute: the operation is one the agent supports and the expression
+// requires no tag the agent lacks. Parameters are numbered from first.
+func capabilityCondition(caps model.Capabilities, first int) (string, []interface{}) {
+	var cond strings.Builder
+	var args []interface{}
+
+	if len(caps.Operations) > 0 {
+		cond.WriteString(" AND t.op IN (" + placeholders(first, len(caps.Operations)) + ")")
+		for _, op := range caps.Operations {
+			args = append(args, op)
+		}
+		first += len(caps.Operations)
+	}
+
+	cond.WriteString(" AND NOT EXISTS (SELECT 1 FROM expression_tags g WHERE g.expression_id = t.expression_id")
+	if len(caps.Tags) > 0 {
+		cond.WriteString(" AND g.tag NOT IN (" + placeholders(first, len(caps.Tags)) + ")")
+		for _, tag := range caps.Tags {
+			args = append(args, tag)
+		}
+	}
+	cond.WriteString(")")
+	return cond.String(), args
+}
+
+// placeholders returns n numbered parameters starting at first: "?3, ?4".
+func placeholders(first, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = fmt.Sprintf("?%d", first+i)
+	}
+	return strings.Join(ps, ", ")
+}
+
+// tagSeparator joins the tags of an expression in ReadyRequirements, it is
+// char(31) in SQL.
+const tagSeparator = "\x1f"
+
+// Requirement is what an agent needs to compute some ready tasks: the
+// operation, the tags of their expressions and, for replicas, the number of
+// distinct agents to vote.
+type Requirement struct {
+	Operation string
+	Tags      []string
+	// Voters is how many distinct agents the ready replicas need, 0 if
+	// the expressions are not replicated.
+	Voters int
+	// ExpressionIDs are the expressions having such ready tasks.
+	ExpressionIDs []string
+}
+
+// ReadyRequirements lists the distinct requirements of the ready tasks,
+// each with the expressions it holds up, in one query.
+func ReadyRequirements() ([]Requirement, error) {
+	rows, err := db.GlobalDB.Query(`
+        SELECT r.op, r.tags, r.voters, group_concat(r.expression_id)
+        FROM (
+            SELECT t.expression_id, t.op,
+                   COALESCE((SELECT group_concat(g.tag, char(31) ORDER BY g.tag)
+                             FROM expression_tags g WHERE g.expression_id = t.expression_id), '') AS tags,
+                   MAX(CASE WHEN t.replica_of IS NULL THEN 0
+                            ELSE (SELECT COUNT(*) FROM tasks s WHERE s.replica_of = t.replica_of) END) AS voters
+            FROM tasks t
+            WHERE ` + readyCondition + `
+            GROUP BY t.expression_id, t.op
+        ) r
+        GROUP BY r.op, r.tags, r.voters
+        ORDER BY r.op, r.tags, r.voters
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("ReadyRequirements query error: %w", err)
+	}
+	defer rows.Close()
+
+	var reqs []Requirement
+	for rows.Next() {
+		var req Requirement
+		var tags, ids string
+		if err := rows.Scan(&req.Operation, &tags, &req.Voters, &ids); err != nil {
+			return nil, fmt.Errorf("ReadyRequirements scan error: %w", err)
+		}
+		if tags != "" {
+			req.Tags = strings.Split(tags, tagSeparator)
+		}
+		req.ExpressionIDs = strings.Split(ids, ",")
+		sort.Strings(req.ExpressionIDs)
+		reqs = append(reqs, req)
+	}
+	return reqs, rows.Err()
+}
+
+// FlagUnroutable replaces the unroutable flags of all expressions: each
+// expression in reasons gets its reason, every other one is cleared. It
+// returns the IDs of the expressions that were not flagged before.
+func FlagUnroutable(reasons map[string]string) ([]string, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("FlagUnroutable begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, unroutable FROM expressions WHERE unroutable IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("FlagUnroutable query error: %w", err)
+	}
+	flagged := make(map[string]string)
+	for rows.Next() {
+		var id, reason string
+		if err := rows.Scan(&id, &reason); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("FlagUnroutable scan error: %w", err)
+		}
+		flagged[id] = reason
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for id := range flagged {
+		if _, ok := reasons[id]; ok {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE expressions SET unroutable = NULL WHERE id = ?`, id); err != nil {
+			return nil, fmt.Errorf("FlagUnroutable clear error: %w", err)
+		}
+	}
+
+	var added []string
+	for id, reason := range reasons {
+		prev, ok := flagged[id]
+		if ok && prev == reason {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE expressions SET unroutable = ? WHERE id = ?`, reason, id); err != nil {
+			return nil, fmt.Errorf("FlagUnroutable update error: %w", err)
+		}
+		if !ok {
+			added = append(added, id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("FlagUnroutable commit error: %w", err)
+	}
+	sort.Strings(added)
+	return added, nil
+}
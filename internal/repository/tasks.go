@@ -3,6 +3,7 @@ package repository
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
 	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
@@ -10,10 +11,7 @@ import (
 
 func GetTasksByExpressionID(exprID string) ([]*model.Task, error) {
 	query := `
-        SELECT id, expression_id, op,
-               arg1_value, arg1_task_id,
-               arg2_value, arg2_task_id,
-               result, status
+        SELECT ` + taskColumns + `
         FROM tasks
         WHERE expression_id = ?
         ORDER BY id
@@ -26,56 +24,93 @@ func GetTasksByExpressionID(exprID string) ([]*model.Task, error) {
 
 	var tasks []*model.Task
 	for rows.Next() {
-		var t model.Task
-
-		var arg1Val sql.NullFloat64
-		var arg2Val sql.NullFloat64
-		var arg1TaskID sql.NullInt64
-		var arg2TaskID sql.NullInt64
-		var res sql.NullFloat64
-
-		err := rows.Scan(
-			&t.ID,
-			&t.ExpressionID,
-			&t.Op,
-			&arg1Val,
-			&arg1TaskID,
-			&arg2Val,
-			&arg2TaskID,
-			&res,
-			&t.Status,
-		)
+		t, err := scanTask(rows)
 		if err != nil {
 			return nil, fmt.Errorf("GetTasksByExpressionID scan error: %w", err)
 		}
-
-		if arg1Val.Valid {
-			f := arg1Val.Float64
-			t.Arg1Value = &f
-		}
-		if arg2Val.Valid {
-			f := arg2Val.Float64
-			t.Arg2Value = &f
-		}
-		if arg1TaskID.Valid {
-			i := int(arg1TaskID.Int64)
-			t.Arg1TaskID = &i
-		}
-		if arg2TaskID.Valid {
-			i := int(arg2TaskID.Int64)
-			t.Arg2TaskID = &i
-		}
-		if res.Valid {
-			f := res.Float64
-			t.Result = &f
-		}
-
-		tasks = append(tasks, &t)
+		tasks = append(tasks, t)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
+	for _, t := range tasks {
+		if err := loadExtraArgs(t); err != nil {
+			return nil, err
+		}
+	}
+
 	return tasks, nil
 }
+
+// FailTask marks the task as failed with reason. The unfinished tasks of
+// the same expression, including everything depending on the failed one,
+// are cancelled and the expression moves to the error state.
+func FailTask(t *model.Task, reason string) error {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return fmt.Errorf("FailTask begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	expr, err := failTask(tx, t, reason)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("FailTask commit error: %w", err)
+	}
+
+	t.Status = model.TaskStatusError
+	t.Error = reason
+	if expr != nil {
+		publishTask(expr.UserID, t)
+		return expressionChanged(expr)
+	}
+	return nil
+}
+
+// failTask fails the task within tx, see FailTask. It returns the failed
+// expression, nil if there is none.
+func failTask(tx *sql.Tx, t *model.Task, reason string) (*model.Expression, error) {
+	_, err := tx.Exec(
+		`UPDATE tasks SET status = ?, error = ? WHERE id = ?`,
+		model.TaskStatusError, reason, t.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("FailTask update task error: %w", err)
+	}
+	return failExpression(tx, t, reason)
+}
+
+// failExpression fails the expression of t within tx because t failed for
+// reason, cancelling its other unfinished tasks. It returns the failed
+// expression, nil if there is none or it is finished already.
+func failExpression(tx *sql.Tx, t *model.Task, reason string) (*model.Expression, error) {
+	exprErr := fmt.Sprintf("task %d (%s) failed: %s", t.ID, t.Op, reason)
+	expr, err := scanExpression(tx.QueryRow(
+		`UPDATE expressions SET status = ?, result = NULL, error = ?, finished_at = ?
+         WHERE id = ? AND status IN (?, ?)
+         RETURNING `+expressionColumns,
+		model.StatusError, exprErr, time.Now().UnixMilli(), t.ExpressionID,
+		model.StatusPending, model.StatusInProgress,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FailTask update expression error: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET status = ?
+         WHERE expression_id = ? AND id <> ? AND status IN (?, ?, ?, ?)`,
+		model.TaskStatusCancelled, t.ExpressionID, t.ID,
+		model.TaskStatusWaiting, model.TaskStatusInProgress, model.TaskStatusDead, model.TaskStatusReplicated,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("FailTask cancel tasks error: %w", err)
+	}
+	return expr, nil
+}
@@ -25,11 +25,11 @@ func CreateUser(login, passwordHash string) error {
 }
 
 func GetUserByLogin(login string) (*model.User, error) {
-	query := `SELECT id, login, password_hash FROM users WHERE login = ?`
+	query := `SELECT id, login, password_hash, role FROM users WHERE login = ?`
 	row := db.GlobalDB.QueryRow(query, login)
 
 	var u model.User
-	err := row.Scan(&u.ID, &u.Login, &u.PasswordHash)
+	err := row.Scan(&u.ID, &u.Login, &u.PasswordHash, &u.Role)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -40,11 +40,11 @@ func GetUserByLogin(login string) (*model.User, error) {
 }
 
 func GetUserByID(id int64) (*model.User, error) {
-	query := `SELECT id, login, password_hash FROM users WHERE id = ?`
+	query := `SELECT id, login, password_hash, role FROM users WHERE id = ?`
 	row := db.GlobalDB.QueryRow(query, id)
 
 	var u model.User
-	err := row.Scan(&u.ID, &u.Login, &u.PasswordHash)
+	err := row.Scan(&u.ID, &u.Login, &u.PasswordHash, &u.Role)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -53,3 +53,14 @@ func GetUserByID(id int64) (*model.User, error) {
 	}
 	return &u, nil
 }
+
+// SetUserRole changes the role of the user with the given login. It reports
+// whether such a user exists.
+func SetUserRole(login, role string) (bool, error) {
+	res, err := db.GlobalDB.Exec(`UPDATE users SET role = ? WHERE login = ?`, role, login)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,404 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+)
+
+// Vote is the state of a replicated task after an agent answered it.
+type Vote struct {
+	// Decided is false while more runs are needed; the task is back in the
+	// queue then.
+	Decided bool
+	// Result is the agreed value. It is nil if the majority reported an
+	// error or the agents did not agree; Error explains why.
+	Result *float64
+	Error  string
+	// Winners and Losers are the agents whose answers matched or
+	// contradicted the decision.
+	Winners []string
+	Losers  []string
+}
+
+// RecordRun stores the answer agentID gave for a task leased to it. Once
+// the answer is final the task is done with its result, or failed with its
+// error, and the expression is done when all of its tasks are. It returns
+// false, changing nothing, if agentID no longer holds the lease.
+//
+// A task of an expression with replication N is computed by N replicas,
+// leased to distinct agents at the same time; the answer given by a
+// majority of N wins. Without a majority tiebreak replicas are scheduled
+// one by one, up to 2N-1 runs in total. Results within tolerance (relative
+// to their magnitude) are considered equal, errors are equal if their text
+// is.
+func RecordRun(t *model.Task, agentID string, result *float64, errText string, tolerance float64) (*Vote, bool, error) {
+	tx, err := db.GlobalDB.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordRun begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	status := model.TaskStatusDone
+	var resVal, errVal interface{}
+	if result != nil {
+		resVal = *result
+	} else {
+		status = model.TaskStatusError
+		errVal = errText
+	}
+	res, err := tx.Exec(
+		`UPDATE tasks SET status = ?, result = ?, error = ?, lease_owner = NULL, lease_expires_at = NULL
+         WHERE id = ? AND status = ? AND lease_owner = ?`,
+		status, resVal, errVal, t.ID, model.TaskStatusInProgress, agentID,
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordRun update error: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, false, err
+	}
+
+	vote := &Vote{Decided: true, Result: result, Error: errText}
+	task := t
+	replicaAdded := false
+	finish := true
+	if t.ReplicaOf != 0 {
+		vote, replicaAdded, err = voteReplicas(tx, t, agentID, resVal, errVal, tolerance)
+		if err != nil {
+			return nil, false, err
+		}
+		finish = vote.Decided
+		if finish {
+			task, err = scanTask(tx.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, t.ReplicaOf))
+			if err != nil {
+				return nil, false, fmt.Errorf("RecordRun replicated task error: %w", err)
+			}
+			// The expression may have been cancelled meanwhile.
+			finish = task.Status == model.TaskStatusReplicated
+		}
+	}
+
+	var userID int64
+	var expr *model.Expression
+	if finish {
+		if err := tx.QueryRow(`SELECT user_id FROM tasks WHERE id = ?`, task.ID).Scan(&userID); err != nil {
+			return nil, false, fmt.Errorf("RecordRun owner error: %w", err)
+		}
+		if vote.Result == nil {
+			expr, err = failTask(tx, task, vote.Error)
+		} else {
+			expr, err = completeTask(tx, task, *vote.Result)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("RecordRun commit error: %w", err)
+	}
+	t.Status, t.Result, t.Error = status, result, errText
+	t.LeaseOwner, t.LeaseExpiresAt = "", nil
+	if replicaAdded || finish && vote.Result != nil {
+		notify.TasksReady.Broadcast()
+	}
+	if finish {
+		task.Result, task.Error = vote.Result, vote.Error
+		task.Status = model.TaskStatusDone
+		if vote.Result == nil {
+			task.Status = model.TaskStatusError
+		}
+		publishTask(userID, task)
+	}
+	if expr != nil {
+		return vote, true, expressionChanged(expr)
+	}
+	return vote, true, nil
+}
+
+// completeTask marks the task done with result within tx and returns its
+// expression if that is done now too, with the result of its last task.
+func completeTask(tx *sql.Tx, t *model.Task, result float64) (*model.Expression, error) {
+	_, err := tx.Exec(
+		`UPDATE tasks SET status = ?, result = ?, error = NULL WHERE id = ?`,
+		model.TaskStatusDone, result, t.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("completeTask update error: %w", err)
+	}
+	if err := adjustDependents(tx, t.ID, -1); err != nil {
+		return nil, err
+	}
+
+	expr, err := scanExpression(tx.QueryRow(
+		`UPDATE expressions SET status = ?1, error = NULL, finished_at = ?2,
+             result = (SELECT result FROM tasks
+                       WHERE expression_id = ?3 AND replica_of IS NULL AND result IS NOT NULL
+                       ORDER BY id DESC LIMIT 1)
+         WHERE id = ?3 AND status IN (?4, ?5) AND NOT EXISTS (
+             SELECT 1 FROM tasks WHERE expression_id = ?3 AND replica_of IS NULL AND status <> ?1
+         )
+         RETURNING `+expressionColumns,
+		model.StatusDone, time.Now().UnixMilli(), t.ExpressionID, model.StatusPending, model.StatusInProgress,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("completeTask expression error: %w", err)
+	}
+	return expr, nil
+}
+
+// voteReplicas stores the run of a replica within tx and votes on the runs
+// of its task so far. It schedules a tiebreak replica if the vote needs one
+// and reports whether it did.
+func voteReplicas(tx *sql.Tx, replica *model.Task, agentID string, resVal, errVal interface{}, tolerance float64) (*Vote, bool, error) {
+	taskID := replica.ReplicaOf
+	_, err := tx.Exec(
+		`INSERT INTO task_runs (task_id, agent_id, result, error, created_at) VALUES (?, ?, ?, ?, ?)`,
+		taskID, agentID, resVal, errVal, time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordRun insert error: %w", err)
+	}
+
+	var replication int
+	err = tx.QueryRow(`SELECT replication FROM expressions WHERE id = ?`, replica.ExpressionID).Scan(&replication)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordRun replication error: %w", err)
+	}
+	runs, err := taskRuns(tx, taskID)
+	if err != nil {
+		return nil, false, err
+	}
+	vote, winners := tally(runs, replication, tolerance)
+
+	if !vote.Decided {
+		// Replicas still computing give the missing runs, otherwise the
+		// vote is tied and another agent has to break it.
+		pending, err := pendingReplicas(tx, taskID)
+		if err != nil {
+			return nil, false, fmt.Errorf("RecordRun pending replicas error: %w", err)
+		}
+		if pending > 0 {
+			return vote, false, nil
+		}
+		return vote, true, addReplica(tx, taskID)
+	}
+	for _, r := range runs {
+		if winners == nil {
+			break
+		}
+		outcome := model.VoteOutvoted
+		if winners[r.ID] {
+			outcome = model.VoteAgreed
+		}
+		if _, err := tx.Exec(`UPDATE task_runs SET vote = ? WHERE id = ?`, outcome, r.ID); err != nil {
+			return nil, false, fmt.Errorf("RecordRun vote error: %w", err)
+		}
+	}
+	return vote, false, nil
+}
+
+// pendingReplicas counts the replicas of a task that may still answer.
+// DEAD and CANCELLED replicas never will.
+func pendingReplicas(tx *sql.Tx, taskID int) (int, error) {
+	var pending int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM tasks WHERE replica_of = ? AND status IN (?, ?, ?)`,
+		taskID, model.TaskStatusWaiting, model.TaskStatusInProgress, model.TaskStatusReplicated,
+	).Scan(&pending)
+	return pending, err
+}
+
+// replaceDeadReplica lets the vote on a task go on without a replica that
+// ran out of retries within tx: once the other replicas answered another
+// agent is asked instead. The expression fails with the error of the
+// replica when as many replicas as its replication died. It returns the
+// failed expression, if any, and whether a replica was scheduled.
+func replaceDeadReplica(tx *sql.Tx, replica *model.Task) (*model.Expression, bool, error) {
+	var replication, dead int
+	err := tx.QueryRow(
+		`SELECT e.replication, (SELECT COUNT(*) FROM tasks WHERE replica_of = t.id AND status = ?)
+         FROM tasks t JOIN expressions e ON e.id = t.expression_id
+         WHERE t.id = ? AND t.status = ?`,
+		model.TaskStatusDead, replica.ReplicaOf, model.TaskStatusReplicated,
+	).Scan(&replication, &dead)
+	if err == sql.ErrNoRows {
+		// The vote is over or the expression was stopped.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("replaceDeadReplica select error: %w", err)
+	}
+	if dead >= replication {
+		expr, err := failExpression(tx, replica, replica.LastError)
+		return expr, false, err
+	}
+
+	pending, err := pendingReplicas(tx, replica.ReplicaOf)
+	if err != nil {
+		return nil, false, fmt.Errorf("replaceDeadReplica pending replicas error: %w", err)
+	}
+	if pending > 0 {
+		// The last of them schedules a tiebreak if the vote needs one.
+		return nil, false, nil
+	}
+	return nil, true, addReplica(tx, replica.ReplicaOf)
+}
+
+// addReplica schedules one more replica of a replicated task within tx.
+func addReplica(tx *sql.Tx, taskID int) error {
+	res, err := tx.Exec(
+		`INSERT INTO tasks (expression_id, op, arg1_value, arg1_task_id, arg2_value, arg2_task_id,
+                            status, pending_deps, user_id, priority, replica_of)
+         SELECT expression_id, op, arg1_value, arg1_task_id, arg2_value, arg2_task_id,
+                ?, pending_deps, user_id, priority, id
+         FROM tasks WHERE id = ?`,
+		model.TaskStatusWaiting, taskID,
+	)
+	if err != nil {
+		return fmt.Errorf("addReplica insert error: %w", err)
+	}
+	replicaID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("addReplica id error: %w", err)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO task_args (task_id, position, value, arg_task_id)
+         SELECT ?, position, value, arg_task_id FROM task_args WHERE task_id = ?`,
+		replicaID, taskID,
+	)
+	if err != nil {
+		return fmt.Errorf("addReplica args error: %w", err)
+	}
+	return nil
+}
+
+// tally groups equal answers and decides the vote. The returned set holds
+// the IDs of the winning runs, it is nil unless a majority was found.
+func tally(runs []*model.TaskRun, replication int, tolerance float64) (*Vote, map[int]bool) {
+	if len(runs) < replication {
+		return &Vote{}, nil
+	}
+
+	var groups [][]*model.TaskRun
+	for _, r := range runs {
+		placed := false
+		for i, g := range groups {
+			if sameAnswer(g[0], r, tolerance) {
+				groups[i] = append(g, r)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			groups = append(groups, []*model.TaskRun{r})
+		}
+	}
+
+	best, tie := 0, false
+	for i, g := range groups {
+		switch {
+		case len(g) > len(groups[best]):
+			best, tie = i, false
+		case i != best && len(g) == len(groups[best]):
+			tie = true
+		}
+	}
+
+	quorum := replication/2 + 1
+	if tie || len(groups[best]) < quorum {
+		if len(runs) < 2*replication-1 {
+			return &Vote{}, nil
+		}
+		answers := make([]string, len(runs))
+		for i, r := range runs {
+			answers[i] = describeRun(r)
+		}
+		return &Vote{
+			Decided: true,
+			Error:   fmt.Sprintf("agents disagree after %d runs: %s", len(runs), strings.Join(answers, ", ")),
+		}, nil
+	}
+
+	winner := groups[best][0]
+	vote := &Vote{Decided: true, Result: winner.Result, Error: winner.Error}
+	winners := make(map[int]bool)
+	for _, r := range groups[best] {
+		winners[r.ID] = true
+		vote.Winners = append(vote.Winners, r.AgentID)
+	}
+	for _, r := range runs {
+		if !winners[r.ID] {
+			vote.Losers = append(vote.Losers, r.AgentID)
+		}
+	}
+	return vote, winners
+}
+
+func sameAnswer(a, b *model.TaskRun, tolerance float64) bool {
+	if a.Result == nil || b.Result == nil {
+		return a.Result == nil && b.Result == nil && a.Error == b.Error
+	}
+	x, y := *a.Result, *b.Result
+	if x == y {
+		return true
+	}
+	scale := math.Max(1, math.Max(math.Abs(x), math.Abs(y)))
+	return math.Abs(x-y) <= tolerance*scale
+}
+
+func describeRun(r *model.TaskRun) string {
+	if r.Result != nil {
+		return fmt.Sprintf("%s=%g", r.AgentID, *r.Result)
+	}
+	return fmt.Sprintf("%s=error(%s)", r.AgentID, r.Error)
+}
+
+func taskRuns(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, taskID int) ([]*model.TaskRun, error) {
+	rows, err := q.Query(
+		`SELECT id, task_id, agent_id, result, error, vote, created_at
+         FROM task_runs WHERE task_id = ? ORDER BY id`,
+		taskID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("taskRuns query error: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*model.TaskRun
+	for rows.Next() {
+		var r model.TaskRun
+		var res sql.NullFloat64
+		var errVal, vote sql.NullString
+		var created int64
+		if err := rows.Scan(&r.ID, &r.TaskID, &r.AgentID, &res, &errVal, &vote, &created); err != nil {
+			return nil, fmt.Errorf("taskRuns scan error: %w", err)
+		}
+		if res.Valid {
+			f := res.Float64
+			r.Result = &f
+		}
+		r.Error = errVal.String
+		r.Vote = vote.String
+		r.CreatedAt = time.UnixMilli(created)
+		runs = append(runs, &r)
+	}
+	return runs, rows.Err()
+}
+
+// GetTaskRuns returns the answers agents gave for a replicated task.
+func GetTaskRuns(taskID int) ([]*model.TaskRun, error) {
+	return taskRuns(db.GlobalDB, taskID)
+}
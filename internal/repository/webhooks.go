@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+)
+
+// WebhookRetry is the policy applied to failed webhook deliveries; the
+// orchestrator sets it from its configuration.
+var WebhookRetry = RetryPolicy{MaxRetries: 5, Backoff: time.Second, MaxBackoff: 10 * time.Minute}
+
+const deliveryColumns = `d.id, d.user_id, d.expression_id, d.url, d.event, d.payload, d.status, d.attempts,
+        d.next_attempt_at, d.response_code, d.last_error, d.created_at, d.delivered_at`
+
+func scanDelivery(row rowScanner, extra ...interface{}) (*model.WebhookDelivery, error) {
+	var d model.WebhookDelivery
+	var payload string
+	var nextAttempt, code, delivered sql.NullInt64
+	var lastErr sql.NullString
+	var created int64
+
+	dest := []interface{}{
+		&d.ID, &d.UserID, &d.ExpressionID, &d.URL, &d.Event, &payload, &d.Status, &d.Attempts,
+		&nextAttempt, &code, &lastErr, &created, &delivered,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	d.Payload = json.RawMessage(payload)
+	d.ResponseCode = int(code.Int64)
+	d.LastError = lastErr.String
+	d.CreatedAt = time.UnixMilli(created)
+	if nextAttempt.Valid {
+		t := time.UnixMilli(nextAttempt.Int64)
+		d.NextAttemptAt = &t
+	}
+	if delivered.Valid {
+		t := time.UnixMilli(delivered.Int64)
+		d.DeliveredAt = &t
+	}
+	return &d, nil
+}
+
+// SetExpressionCallback sets the URL notified once the expression finished.
+func SetExpressionCallback(exprID, url string) error {
+	_, err := db.GlobalDB.Exec(`UPDATE expressions SET callback_url = ? WHERE id = ?`, url, exprID)
+	if err != nil {
+		return fmt.Errorf("set expression callback error: %w", err)
+	}
+	return nil
+}
+
+// GetWebhook returns the account-wide webhook of the user, its URL is empty
+// if none is set. The signing secret is created on first use.
+func GetWebhook(userID int64) (*model.Webhook, error) {
+	secret, err := webhookSecret(userID)
+	if err != nil {
+		return nil, err
+	}
+	var url sql.NullString
+	err = db.GlobalDB.QueryRow(`SELECT webhook_url FROM users WHERE id = ?`, userID).Scan(&url)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("GetWebhook error: %w", err)
+	}
+	return &model.Webhook{URL: url.String, Secret: secret}, nil
+}
+
+// SetWebhook sets the URL notified when any expression of the user
+// finished; an empty URL removes it.
+func SetWebhook(userID int64, url string) (*model.Webhook, error) {
+	var val interface{}
+	if url != "" {
+		val = url
+	}
+	if _, err := db.GlobalDB.Exec(`UPDATE users SET webhook_url = ? WHERE id = ?`, val, userID); err != nil {
+		return nil, fmt.Errorf("SetWebhook error: %w", err)
+	}
+	return GetWebhook(userID)
+}
+
+// webhookSecret returns the key signing the webhooks of the user, creating
+// it on first use.
+func webhookSecret(userID int64) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("webhook secret error: %w", err)
+	}
+	var secret sql.NullString
+	err := db.GlobalDB.QueryRow(
+		`UPDATE users SET webhook_secret = COALESCE(webhook_secret, ?) WHERE id = ?
+         RETURNING webhook_secret`,
+		hex.EncodeToString(key), userID,
+	).Scan(&secret)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("webhook secret error: %w", err)
+	}
+	return secret.String, nil
+}
+
+type webhookPayload struct {
+	Event      string            `json:"event"`
+	Expression *model.Expression `json:"expression"`
+}
+
+// queueWebhooks schedules the webhooks of a finished expression: one to its
+// callback URL and one to the webhook of its owner. Each completion of an
+// expression is reported to each URL once; a reopened expression finishes
+// anew.
+func queueWebhooks(e *model.Expression) error {
+	var callback, account sql.NullString
+	err := db.GlobalDB.QueryRow(
+		`SELECT e.callback_url, u.webhook_url
+         FROM expressions e LEFT JOIN users u ON u.id = e.user_id
+         WHERE e.id = ?`,
+		e.ID,
+	).Scan(&callback, &account)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("queueWebhooks select error: %w", err)
+	}
+
+	var urls []string
+	for _, u := range []string{callback.String, account.String} {
+		if u != "" && (len(urls) == 0 || urls[0] != u) {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	if _, err := webhookSecret(e.UserID); err != nil {
+		return err
+	}
+
+	event := "expression." + strings.ToLower(e.Status)
+	payload, err := json.Marshal(webhookPayload{Event: event, Expression: e})
+	if err != nil {
+		return fmt.Errorf("queueWebhooks payload error: %w", err)
+	}
+
+	now := time.Now().UnixMilli()
+	var finished int64
+	if e.FinishedAt != nil {
+		finished = e.FinishedAt.UnixMilli()
+	}
+	queued := false
+	for _, url := range urls {
+		res, err := db.GlobalDB.Exec(
+			`INSERT OR IGNORE INTO webhook_deliveries
+                 (user_id, expression_id, url, event, payload, status, next_attempt_at, created_at, finished_at)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.UserID, e.ID, url, event, string(payload), model.DeliveryPending, now, now, finished,
+		)
+		if err != nil {
+			return fmt.Errorf("queueWebhooks insert error: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			queued = true
+		}
+	}
+	if queued {
+		notify.WebhooksQueued.Broadcast()
+	}
+	return nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is due at now, with the secrets to sign them.
+func DueWebhookDeliveries(now time.Time, limit int) ([]*model.WebhookDelivery, error) {
+	rows, err := db.GlobalDB.Query(
+		`SELECT `+deliveryColumns+`, COALESCE(u.webhook_secret, '')
+         FROM webhook_deliveries d LEFT JOIN users u ON u.id = d.user_id
+         WHERE d.status = ? AND d.next_attempt_at <= ?
+         ORDER BY d.next_attempt_at, d.id
+         LIMIT ?`,
+		model.DeliveryPending, now.UnixMilli(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DueWebhookDeliveries query error: %w", err)
+	}
+	defer rows.Close()
+
+	var list []*model.WebhookDelivery
+	for rows.Next() {
+		var secret string
+		d, err := scanDelivery(rows, &secret)
+		if err != nil {
+			return nil, fmt.Errorf("DueWebhookDeliveries scan error: %w", err)
+		}
+		d.Secret = secret
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// RecordWebhookDelivered marks the delivery as accepted by the receiver.
+func RecordWebhookDelivered(id int64, now time.Time) error {
+	_, err := db.GlobalDB.Exec(
+		`UPDATE webhook_deliveries
+         SET status = ?, attempts = attempts + 1, delivered_at = ?, next_attempt_at = NULL
+         WHERE id = ?`,
+		model.DeliveryDelivered, now.UnixMilli(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("RecordWebhookDelivered error: %w", err)
+	}
+	return nil
+}
+
+// RecordWebhookFailure records a failed attempt of the delivery, code being
+// the HTTP status of the answer or 0 if there was none, and schedules the
+// next one under WebhookRetry. Out of retries the delivery is FAILED.
+func RecordWebhookFailure(id int64, code int, reason string, now time.Time) error {
+	var codeVal interface{}
+	if code != 0 {
+		codeVal = code
+	}
+	_, err := db.GlobalDB.Exec(
+		`UPDATE webhook_deliveries
+         SET attempts = attempts + 1, response_code = ?5, last_error = ?6,
+             status = CASE WHEN attempts >= ?2 THEN 'FAILED' ELSE 'PENDING' END,
+             next_attempt_at = CASE WHEN attempts >= ?2 THEN NULL
+                                    ELSE ?1 + MIN(?3 << MIN(attempts, 30), ?4) END
+         WHERE id = ?7`,
+		WebhookRetry.args(now, codeVal, reason, id)...,
+	)
+	if err != nil {
+		return fmt.Errorf("RecordWebhookFailure error: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the latest deliveries of the user, newest
+// first, only those of exprID unless it is empty.
+func GetWebhookDeliveries(userID int64, exprID string) ([]*model.WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries d WHERE d.user_id = ?`
+	args := []interface{}{userID}
+	if exprID != "" {
+		query += ` AND d.expression_id = ?`
+		args = append(args, exprID)
+	}
+	query += ` ORDER BY d.id DESC LIMIT 100`
+
+	rows, err := db.GlobalDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("GetWebhookDeliveries query error: %w", err)
+	}
+	defer rows.Close()
+
+	var list []*model.WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetWebhookDeliveries scan error: %w", err)
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
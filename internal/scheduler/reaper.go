@@ -0,0 +1,198 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/agents"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/notify"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/webhook"
+)
+
+// StartLeaseReaper requeues tasks with expired leases every interval until
+// ctx is cancelled.
+func StartLeaseReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := repository.RequeueExpiredLeases(now)
+			if err != nil {
+				log.Printf("[REAPER] requeue error: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[REAPER] requeued %d task(s) with expired leases", n)
+			}
+		}
+	}
+}
+
+// StartDeadlineReaper times out the expressions past their deadline every
+// interval until ctx is cancelled.
+func StartDeadlineReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := repository.ExpireDeadlines(now)
+			if err != nil {
+				log.Printf("[REAPER] deadline error: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[REAPER] %d expression(s) timed out", n)
+			}
+		}
+	}
+}
+
+// StartIdempotencyReaper deletes the expired idempotency keys every
+// interval until ctx is cancelled.
+func StartIdempotencyReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := repository.PurgeIdempotencyKeys(now); err != nil {
+				log.Printf("[REAPER] idempotency keys error: %v", err)
+			}
+		}
+	}
+}
+
+// StartAgentMonitor declares dead the agents that missed their heartbeats
+// for longer than timeout and requeues the tasks they were computing.
+func StartAgentMonitor(ctx context.Context, registry *agents.Registry, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range registry.MarkDead(now, timeout) {
+				n, err := repository.ReleaseAgentTasks(id)
+				if err != nil {
+					log.Printf("[MONITOR] release tasks of agent %q error: %v", id, err)
+					continue
+				}
+				log.Printf("[MONITOR] agent %q missed heartbeats, requeued %d task(s)", id, n)
+			}
+		}
+	}
+}
+
+// StartRoutingMonitor flags every interval the expressions whose ready tasks
+// no alive agent can compute, or not enough distinct agents to vote on
+// their replicas, and clears the flag once they can.
+func StartRoutingMonitor(ctx context.Context, registry *agents.Registry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := CheckRouting(registry); err != nil {
+				log.Printf("[MONITOR] routing check error: %v", err)
+			}
+		}
+	}
+}
+
+// CheckRouting updates the unroutable flags of the expressions with ready
+// tasks against the agents currently alive in registry. Agents polling for
+// tasks do not have to register, so nothing is flagged until one has.
+func CheckRouting(registry *agents.Registry) error {
+	if registry.Len() == 0 {
+		_, err := repository.FlagUnroutable(nil)
+		return err
+	}
+	reqs, err := repository.ReadyRequirements()
+	if err != nil {
+		return err
+	}
+
+	// missing lists the operations of each expression no live agent can
+	// compute, withTags the tags they need.
+	missing := make(map[string][]string)
+	withTags := make(map[string]string)
+	reasons := make(map[string]string)
+	for _, req := range reqs {
+		tags := ""
+		if len(req.Tags) > 0 {
+			tags = " with tags " + strings.Join(req.Tags, ", ")
+		}
+		n := registry.Capable(req.Operation, req.Tags)
+		for _, id := range req.ExpressionIDs {
+			switch {
+			case n == 0:
+				missing[id] = append(missing[id], req.Operation)
+				withTags[id] = tags
+			case n < req.Voters:
+				if _, ok := reasons[id]; !ok {
+					reasons[id] = fmt.Sprintf(
+						"replication needs %d distinct agents, only %d live agent(s) can execute %s%s",
+						req.Voters, n, req.Operation, tags,
+					)
+				}
+			}
+		}
+	}
+	for id, ops := range missing {
+		reasons[id] = "no live agent can execute " + strings.Join(ops, ", ") + withTags[id]
+	}
+
+	flagged, err := repository.FlagUnroutable(reasons)
+	if err != nil {
+		return err
+	}
+	for _, id := range flagged {
+		log.Printf("[MONITOR] expression %s is stuck: %s", id, reasons[id])
+	}
+	return nil
+}
+
+// StartWebhookDispatcher sends the due webhooks as soon as they are queued
+// and retries the failed ones every interval until ctx is cancelled.
+func StartWebhookDispatcher(ctx context.Context, client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		queued := notify.WebhooksQueued.Wait()
+		n, err := webhook.DeliverDue(client, time.Now())
+		if err != nil {
+			log.Printf("[WEBHOOK] delivery error: %v", err)
+		} else if n > 0 {
+			log.Printf("[WEBHOOK] delivered %d webhook(s)", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-queued:
+		case <-ticker.C:
+		}
+	}
+}
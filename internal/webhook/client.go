@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), used by carrier NAT and
+// by the metadata services of some clouds.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// errRedirect refuses redirects: the receiver must answer at the URL the
+// user gave.
+var errRedirect = errors.New("webhook receivers must not redirect")
+
+// NewClient returns the client to deliver webhooks with. Webhook URLs come
+// from users, so it connects only to public addresses, checked on every
+// connection after DNS resolution, and does not follow redirects.
+func NewClient(timeout time.Duration) *http.Client {
+	return newClient(timeout, isPublic)
+}
+
+func newClient(timeout time.Duration, allowed func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !allowed(ip.Unmap()) {
+				return fmt.Errorf("webhook address %s is not public", ip)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on our behalf to any address.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errRedirect
+		},
+	}
+}
+
+// isPublic reports whether ip is a public unicast address: not loopback,
+// private (RFC 1918, unique local), link-local (cloud metadata at
+// 169.254.169.254), shared or unspecified.
+func isPublic(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() &&
+		!ip.IsPrivate() &&
+		!ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!sharedAddressSpace.Contains(ip)
+}
@@ -0,0 +1,7 @@
+package webhook
+
+// NewClientAllowing is NewClient connecting to the addresses allowed
+// accepts, so tests can reach their local receivers.
+var NewClientAllowing = newClient
+
+var IsPublic = isPublic
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+)
+
+// Headers of a webhook request. SignatureHeader carries "sha256=" and the
+// hex HMAC-SHA256 of the body keyed with the secret of the user.
+const (
+	SignatureHeader = "X-Calc-Signature-256"
+	EventHeader     = "X-Calc-Event"
+	DeliveryHeader  = "X-Calc-Delivery"
+)
+
+// batchSize bounds the deliveries sent by one DeliverDue call, workers the
+// receivers it sends to at once.
+const (
+	batchSize = 100
+	workers   = 8
+)
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverDue sends the deliveries due at now with client and records the
+// outcome of each. Any 2xx answer accepts a delivery; other answers and
+// transport errors are retried under repository.WebhookRetry. It returns
+// the number of deliveries accepted.
+//
+// Deliveries to one host are sent in turn and up to workers hosts at once,
+// so a slow receiver holds up only its own deliveries.
+func DeliverDue(client *http.Client, now time.Time) (int, error) {
+	due, err := repository.DueWebhookDeliveries(now, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var hosts []string
+	byHost := make(map[string][]*model.WebhookDelivery)
+	for _, d := range due {
+		host := d.URL
+		if u, err := url.Parse(d.URL); err == nil {
+			host = u.Host
+		}
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], d)
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		delivered int
+		errs      []error
+	)
+	slots := make(chan struct{}, workers)
+	for _, host := range hosts {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(list []*model.WebhookDelivery) {
+			defer func() { <-slots; wg.Done() }()
+			for _, d := range list {
+				ok, err := deliver(client, d)
+				mu.Lock()
+				if ok {
+					delivered++
+				}
+				if err != nil {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(byHost[host])
+	}
+	wg.Wait()
+	return delivered, errors.Join(errs...)
+}
+
+// deliver sends the delivery and records the outcome. It reports whether
+// the receiver accepted it.
+func deliver(client *http.Client, d *model.WebhookDelivery) (bool, error) {
+	code, err := send(client, d)
+	if err != nil {
+		return false, repository.RecordWebhookFailure(d.ID, code, err.Error(), time.Now())
+	}
+	if err := repository.RecordWebhookDelivered(d.ID, time.Now()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// send POSTs the delivery and returns the HTTP status of the answer, 0 if
+// there was none.
+func send(client *http.Client, d *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(d.Secret, d.Payload))
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(d.ID, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
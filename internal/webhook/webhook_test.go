@@ -0,0 +1,299 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/db"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/model"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/repository"
+	"github.com/TuHeKocmoc/yalyceumfinal2/internal/webhook"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("DB_PATH", ":memory:")
+	if err := db.InitDB(); err != nil {
+		panic("failed to init in-memory db: " + err.Error())
+	}
+	os.Exit(m.Run())
+}
+
+type received struct {
+	path, signature, event string
+	body                   []byte
+}
+
+func TestDeliverDue(t *testing.T) {
+	defer func(p repository.RetryPolicy) { repository.WebhookRetry = p }(repository.WebhookRetry)
+	repository.WebhookRetry = repository.RetryPolicy{MaxRetries: 1, Backoff: time.Minute, MaxBackoff: time.Minute}
+
+	var mu sync.Mutex
+	var got []received
+	callbackFailures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, received{r.URL.Path, r.Header.Get(webhook.SignatureHeader), r.Header.Get(webhook.EventHeader), body})
+		switch {
+		case r.URL.Path == "/account":
+			w.WriteHeader(http.StatusGone)
+		case callbackFailures > 0:
+			callbackFailures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	if err := repository.CreateUser("hook-user", "hash"); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	user, err := repository.GetUserByLogin("hook-user")
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByLogin = %v, %v", user, err)
+	}
+	hook, err := repository.SetWebhook(user.ID, receiver.URL+"/account")
+	if err != nil || hook.Secret == "" {
+		t.Fatalf("SetWebhook = %+v, %v", hook, err)
+	}
+
+	expr, err := repository.CreateExpression("1+2", user.ID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	if err := repository.SetExpressionCallback(expr.ID, receiver.URL+"/callback"); err != nil {
+		t.Fatalf("SetExpressionCallback error: %v", err)
+	}
+	result := 3.0
+	expr.Status, expr.Result = model.StatusDone, &result
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	// Finishing again must not report the expression twice.
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+
+	now := time.Now()
+	if n, err := webhook.DeliverDue(receiver.Client(), now); err != nil || n != 0 {
+		t.Fatalf("first DeliverDue = %d, %v; want 0 delivered", n, err)
+	}
+	if n, _ := webhook.DeliverDue(receiver.Client(), now); n != 0 || len(got) != 2 {
+		t.Fatalf("retried before the backoff: %d delivered, %d requests", n, len(got))
+	}
+	if n, err := webhook.DeliverDue(receiver.Client(), now.Add(2*time.Minute)); err != nil || n != 1 {
+		t.Fatalf("second DeliverDue = %d, %v; want 1 delivered", n, err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("receiver got %d requests, want 4", len(got))
+	}
+
+	for _, req := range got {
+		if want := webhook.Sign(hook.Secret, req.body); req.signature != want {
+			t.Errorf("%s: signature %q, want %q", req.path, req.signature, want)
+		}
+		var payload struct {
+			Event      string           `json:"event"`
+			Expression model.Expression `json:"expression"`
+		}
+		if err := json.Unmarshal(req.body, &payload); err != nil {
+			t.Fatalf("%s: decode payload error: %v", req.path, err)
+		}
+		if req.event != "expression.done" || payload.Event != req.event ||
+			payload.Expression.ID != expr.ID || payload.Expression.Result == nil || *payload.Expression.Result != 3 {
+			t.Errorf("%s: unexpected payload %s", req.path, req.body)
+		}
+	}
+
+	deliveries, err := repository.GetWebhookDeliveries(user.ID, expr.ID)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("GetWebhookDeliveries = %d, %v; want 2", len(deliveries), err)
+	}
+	byURL := map[string]*model.WebhookDelivery{}
+	for _, d := range deliveries {
+		byURL[d.URL] = d
+	}
+	if d := byURL[receiver.URL+"/callback"]; d == nil || d.Status != model.DeliveryDelivered || d.Attempts != 2 || d.DeliveredAt == nil {
+		t.Errorf("callback delivery = %+v, want DELIVERED after 2 attempts", d)
+	}
+	if d := byURL[receiver.URL+"/account"]; d == nil || d.Status != model.DeliveryFailed || d.ResponseCode != http.StatusGone || d.NextAttemptAt != nil {
+		t.Errorf("account delivery = %+v, want FAILED with 410", d)
+	}
+}
+
+// finishExpression creates a finished expression of a new user whose
+// webhook is url.
+func finishExpression(t *testing.T, login, url string) *model.Expression {
+	t.Helper()
+	if err := repository.CreateUser(login, "hash"); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	user, err := repository.GetUserByLogin(login)
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByLogin = %v, %v", user, err)
+	}
+	if _, err := repository.SetWebhook(user.ID, url); err != nil {
+		t.Fatalf("SetWebhook error: %v", err)
+	}
+	expr, err := repository.CreateExpression("1+2", user.ID)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	result := 3.0
+	expr.Status, expr.Result = model.StatusDone, &result
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	return expr
+}
+
+func TestDeliverDue_Reopened(t *testing.T) {
+	var hits atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer receiver.Close()
+
+	expr := finishExpression(t, "reopen-user", receiver.URL)
+	if n, err := webhook.DeliverDue(receiver.Client(), time.Now()); err != nil || n != 1 {
+		t.Fatalf("DeliverDue = %d, %v; want 1 delivered", n, err)
+	}
+
+	// The expression is reopened and finishes once more.
+	expr.Status, expr.Result = model.StatusInProgress, nil
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	result := 3.0
+	expr.Status, expr.Result = model.StatusDone, &result
+	if err := repository.UpdateExpression(expr); err != nil {
+		t.Fatalf("UpdateExpression error: %v", err)
+	}
+	if n, err := webhook.DeliverDue(receiver.Client(), time.Now()); err != nil || n != 1 {
+		t.Fatalf("DeliverDue after the reopen = %d, %v; want 1 delivered", n, err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("receiver got %d requests, want 2", n)
+	}
+}
+
+func TestDeliverDue_SlowReceiver(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fastHit := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHit <- struct{}{}
+	}))
+	defer fast.Close()
+
+	// The slow receiver is due first.
+	finishExpression(t, "slow-user", slow.URL)
+	finishExpression(t, "fast-user", fast.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		webhook.DeliverDue(http.DefaultClient, time.Now())
+	}()
+	select {
+	case <-fastHit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow receiver held up the fast one")
+	}
+	release <- struct{}{}
+	<-done
+}
+
+func TestNewClient_PublicOnly(t *testing.T) {
+	var hits atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer receiver.Close()
+
+	client := webhook.NewClient(time.Second)
+	for _, url := range []string{
+		receiver.URL,
+		"http://127.0.0.1:1/",
+		"http://[::1]:1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+	} {
+		resp, err := client.Post(url, "application/json", nil)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: delivered, want the address refused", url)
+		} else if !strings.Contains(err.Error(), "is not public") {
+			t.Errorf("%s: error %v, want the address refused", url, err)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("the loopback receiver got %d request(s)", n)
+	}
+
+	for ip, want := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.100.100.200": false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00:ec2::254":   false,
+		"fe80::1":         false,
+	} {
+		if got := webhook.IsPublic(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("IsPublic(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestNewClient_NoRedirects(t *testing.T) {
+	var hits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer internal.Close()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/admin", http.StatusTemporaryRedirect)
+	}))
+	defer receiver.Close()
+
+	// The test receivers listen on loopback, let the client reach them.
+	client := webhook.NewClientAllowing(time.Second, netip.Addr.IsLoopback)
+	resp, err := client.Post(receiver.URL, "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("redirect followed with status %d", resp.StatusCode)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("the redirect target got %d request(s)", n)
+	}
+
+	// Metadata addresses stay out of reach even when a redirect points there.
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer metadata.Close()
+	if resp, err := client.Post(metadata.URL, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Errorf("redirect to the metadata address followed with status %d", resp.StatusCode)
+	}
+}